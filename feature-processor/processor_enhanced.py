@@ -9,7 +9,7 @@ from collections import defaultdict
 import hashlib
 
 import yaml
-from kafka import KafkaConsumer, KafkaProducer
+from kafka import KafkaConsumer, KafkaProducer, TopicPartition
 import redis
 import psycopg2
 from psycopg2.extras import execute_values
@@ -202,6 +202,7 @@ class EnhancedFeatureProcessor:
         # Kafka configuration
         self.kafka_brokers = os.getenv('KAFKA_BROKERS', 'kafka:9092').split(',')
         self.consumer_group = os.getenv('CONSUMER_GROUP', 'feature-computation-group')
+        self.input_topics = os.getenv('INPUT_TOPICS', 'raw-events').split(',')
         
         # Database configuration
         self.db_config = {
@@ -243,7 +244,7 @@ class EnhancedFeatureProcessor:
         try:
             # Kafka consumer with optimized settings
             self.consumer = KafkaConsumer(
-                'raw-events',
+                *self.input_topics,
                 bootstrap_servers=self.kafka_brokers,
                 group_id=self.consumer_group,
                 auto_offset_reset='earliest',
@@ -284,16 +285,26 @@ class EnhancedFeatureProcessor:
         timestamp = event.get('ingested_at', datetime.utcnow().isoformat())
         
         try:
-            dt = datetime.fromisoformat(timestamp.replace('Z', '+00:00'))
+            # Prefer the user's local calendar attached by the ingestion service
+            if 'local_hour' in event and 'local_day_of_week' in event:
+                hour = int(event['local_hour'])
+                weekday = int(event['local_day_of_week'])
+            else:
+                dt = datetime.fromisoformat(timestamp.replace('Z', '+00:00'))
+                hour = dt.hour
+                weekday = dt.weekday()
             
             if self.registry.should_compute_feature('hour_of_day', variant):
-                features['hour_of_day'] = dt.hour
+                features['hour_of_day'] = hour
             
             if self.registry.should_compute_feature('day_of_week', variant):
-                features['day_of_week'] = dt.weekday()
+                features['day_of_week'] = weekday
             
             if self.registry.should_compute_feature('is_weekend', variant):
-                features['is_weekend'] = dt.weekday() >= 5
+                features['is_weekend'] = weekday >= 5
+            
+            if 'local_is_holiday' in event and self.registry.should_compute_feature('is_holiday', variant):
+                features['is_holiday'] = bool(event['local_is_holiday'])
                 
         except Exception as e:
             logger.error(f"Error computing temporal features: {e}")
@@ -449,9 +460,13 @@ class EnhancedFeatureProcessor:
             event_type = event.get('event_type', 'unknown')
             timestamp = event.get('ingested_at', datetime.utcnow().isoformat())
             
+            # Synthetic probes from the ingestion service's canary mode
+            is_canary = event.get('canary') is True
+            
             # Determine A/B variant for user
             variant = self.registry.get_user_variant(user_id)
-            AB_VARIANT_COUNTER.labels(variant=variant).inc()
+            if not is_canary:
+                AB_VARIANT_COUNTER.labels(variant=variant).inc()
             
             features = {
                 'user_id': user_id,
@@ -523,13 +538,18 @@ class EnhancedFeatureProcessor:
             else:
                 features['engagement_score'] = engagement_score
             
-            # Record metrics for drift detection
-            self.drift_detector.record_feature_value('engagement_score', engagement_score)
-            if 'activity_count_1h' in features:
-                self.drift_detector.record_feature_value('activity_count_1h', features['activity_count_1h'])
-            
-            # Record feature distributions
-            FEATURE_VALUE_DISTRIBUTION.labels('engagement_score').observe(engagement_score)
+            if is_canary:
+                # Echo the probe's nonce so the canary can find this exact event
+                features['canary'] = True
+                features['canary_sent_ms'] = float(event.get('canary_sent_ms', 0))
+            else:
+                # Record metrics for drift detection
+                self.drift_detector.record_feature_value('engagement_score', engagement_score)
+                if 'activity_count_1h' in features:
+                    self.drift_detector.record_feature_value('activity_count_1h', features['activity_count_1h'])
+                
+                # Record feature distributions
+                FEATURE_VALUE_DISTRIBUTION.labels('engagement_score').observe(engagement_score)
             
             # Add original event data
             features['raw_event'] = event
@@ -562,7 +582,7 @@ class EnhancedFeatureProcessor:
             feature_inserts = []
             for key, value in features.items():
                 if key in ['user_id', 'event_type', 'timestamp', 'computed_at', 
-                          'feature_version', 'ab_variant', 'raw_event']:
+                          'feature_version', 'ab_variant', 'raw_event', 'canary']:
                     continue
                 
                 # Skip None values
@@ -602,10 +622,75 @@ class EnhancedFeatureProcessor:
             self.db_conn.rollback()
             raise
     
+    def store_raw_events(self, events: List[Dict[str, Any]]):
+        """Store raw events so ingestion can be reconciled against Kafka"""
+        rows = []
+        for event in events:
+            event_id = event.get('event_id')
+            if not event_id:
+                continue
+            ingested_at = event.get('ingested_at') or datetime.utcnow().isoformat()
+            timestamp = event.get('timestamp')
+            try:
+                datetime.fromisoformat(str(timestamp).replace('Z', '+00:00'))
+            except ValueError:
+                timestamp = ingested_at
+            rows.append((
+                event_id,
+                str(event.get('user_id', 'unknown'))[:100],
+                str(event.get('event_type', 'unknown'))[:50],
+                timestamp,
+                str(event.get('device_type') or '')[:20] or None,
+                json.dumps(event),
+                ingested_at
+            ))
+        
+        if not rows:
+            return
+        try:
+            cursor = self.db_conn.cursor()
+            execute_values(cursor, """
+                INSERT INTO raw_events (
+                    event_id, user_id, event_type, timestamp, device_type, metadata, ingested_at
+                ) VALUES %s
+                ON CONFLICT DO NOTHING
+            """, rows)
+            self.db_conn.commit()
+            cursor.close()
+        except Exception as e:
+            logger.error(f"Failed to store raw events: {e}")
+            self.db_conn.rollback()
+    
+    def refresh_feature_cache(self, features: Dict[str, Any]):
+        """Write new values through to the API's features:<user> cache
+        
+        Existing entries are updated in place; canary users always get an
+        entry so probes can verify the online path.
+        """
+        cache_key = f"features:{features['user_id']}"
+        cached = self.redis_client.get(cache_key)
+        if cached is None and not features.get('canary'):
+            return
+        
+        entry = json.loads(cached) if cached else {}
+        for key, value in features.items():
+            if key in ['user_id', 'event_type', 'timestamp', 'computed_at',
+                      'feature_version', 'ab_variant', 'raw_event', 'canary']:
+                continue
+            if value is None:
+                continue
+            if isinstance(value, bool):
+                value = int(value)
+            entry[key] = {'value': value, 'computed_at': features['computed_at']}
+        
+        ttl = self.redis_client.ttl(cache_key)
+        self.redis_client.setex(cache_key, ttl if ttl and ttl > 0 else 300, json.dumps(entry))
+    
     def process_batch(self, events: List[Dict[str, Any]]):
         """Process multiple events in batch for efficiency"""
         try:
             BATCH_SIZE.observe(len(events))
+            self.store_raw_events(events)
             
             feature_batch = []
             for event in events:
@@ -620,6 +705,7 @@ class EnhancedFeatureProcessor:
             for features in feature_batch:
                 try:
                     self.store_features(features)
+                    self.refresh_feature_cache(features)
                     
                     # Publish to feature-events topic
                     self.producer.send('feature-events', value=features)
@@ -637,11 +723,14 @@ class EnhancedFeatureProcessor:
     def process_event(self, event: Dict[str, Any]):
         """Process a single event"""
         try:
+            self.store_raw_events([event])
+            
             # Compute features
             features = self.compute_features(event)
             
             # Store in database
             self.store_features(features)
+            self.refresh_feature_cache(features)
             
             # Publish to feature-events topic
             self.producer.send('feature-events', value=features)
@@ -688,6 +777,16 @@ class EnhancedFeatureProcessor:
                 
                 try:
                     event = message.value
+                    
+                    # Local view of lag; the ingestion service exports the group-wide figure
+                    highwater = self.consumer.highwater(TopicPartition(message.topic, message.partition))
+                    if highwater is not None:
+                        CONSUMER_LAG.set(max(highwater - message.offset - 1, 0))
+                    
+                    # Skip heartbeat/watermark control messages from the ingestion service
+                    if isinstance(event, dict) and event.get('type') == 'watermark':
+                        continue
+                    
                     self.batch.append(event)
                     
                     # Process batch if size reached or timeout
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The admin server (ADMIN_ADDR, enabled by ADMIN_TOKEN) serves an embedded
+// operations dashboard at /admin/ and the JSON APIs behind it under
+// /admin/api/. Every admin request needs the token, as a bearer token or as
+// the password of HTTP basic auth so browsers can prompt for it.
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	adminTailSize   = 200
+	adminErrorsSize = 100
+	dlqCacheTTL     = 30 * time.Second
+)
+
+var (
+	adminEnabled bool
+	adminToken   string
+	adminMux     = http.NewServeMux()
+	startedAt    = time.Now()
+
+	workerMu     sync.Mutex
+	workerStates []workerState
+
+	tailMu  sync.Mutex
+	tail    []tailEntry
+	tailSeq int64
+
+	errorLog = &recentLog{}
+
+	adminKafka   *kafka.Client
+	dlqTopic     string
+	dlqSample    int
+	dlqMu        sync.Mutex
+	dlqCached    *dlqSummary
+	dlqCachedAt  time.Time
+	producerMu   sync.Mutex
+	producerLast time.Time
+	publicRoutes []string
+
+	httpRequestsTotal = newCounterVec("http_requests_total", "Requests by route and status code", "route", "code")
+)
+
+// workerState is what one event worker is doing
+type workerState struct {
+	ID        int       `json:"id"`
+	State     string    `json:"state"` // idle or busy
+	Since     time.Time `json:"since"`
+	EventID   string    `json:"event_id,omitempty"`
+	Processed int64     `json:"processed"`
+	Failed    int64     `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// tailEntry is one /events outcome in the live tail
+type tailEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Outcome   string    `json:"outcome"`
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	UserID    string    `json:"user_id,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Region    string    `json:"region,omitempty"`
+}
+
+// dlqSummary groups recent dead-letter messages by error
+type dlqSummary struct {
+	Topic     string         `json:"topic"`
+	Messages  int64          `json:"messages"`
+	Sampled   int            `json:"sampled"`
+	Newest    time.Time      `json:"newest,omitempty"`
+	Errors    []dlqErrorLine `json:"errors"`
+	Error     string         `json:"error,omitempty"`
+	FetchedAt time.Time      `json:"fetched_at"`
+}
+
+type dlqErrorLine struct {
+	Error      string   `json:"error"`
+	Count      int      `json:"count"`
+	EventTypes []string `json:"event_types"`
+	Last       string   `json:"last"`
+}
+
+// recentLog keeps the last log lines that report a failure
+type recentLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recentLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	lower := strings.ToLower(line)
+	if strings.Contains(lower, "fail") || strings.Contains(lower, "error") || strings.Contains(lower, "invalid") {
+		l.mu.Lock()
+		l.lines = append(l.lines, line)
+		if len(l.lines) > adminErrorsSize {
+			l.lines = l.lines[len(l.lines)-adminErrorsSize:]
+		}
+		l.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (l *recentLog) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]string, len(l.lines))
+	for i, line := range l.lines {
+		out[len(l.lines)-1-i] = line // newest first
+	}
+	return out
+}
+
+func initAdmin(brokers string) {
+	workerStates = make([]workerState, workerPool)
+	for i := range workerStates {
+		workerStates[i] = workerState{ID: i, State: "idle", Since: startedAt}
+	}
+
+	adminToken = getEnv("ADMIN_TOKEN", "")
+	if adminToken == "" {
+		return
+	}
+	adminEnabled = true
+	log.SetOutput(io.MultiWriter(os.Stderr, errorLog))
+
+	dlqTopic = getEnv("ADMIN_DLQ_TOPIC", "dead-letter-queue")
+	dlqSample = getEnvInt("ADMIN_DLQ_SAMPLE", 100)
+	adminKafka = &kafka.Client{Addr: kafka.TCP(brokers), Timeout: 10 * time.Second}
+
+	static, _ := fs.Sub(dashboardFiles, "dashboard")
+	adminMux.Handle("/admin/", requireAdmin(http.StripPrefix("/admin/", http.FileServer(http.FS(static)))))
+	adminMux.Handle("/admin/api/overview", requireAdmin(http.HandlerFunc(adminOverviewHandler)))
+	adminMux.Handle("/admin/api/errors", requireAdmin(http.HandlerFunc(adminErrorsHandler)))
+	adminMux.Handle("/admin/api/dlq", requireAdmin(http.HandlerFunc(adminDLQHandler)))
+	adminMux.Handle("/admin/api/tail", requireAdmin(http.HandlerFunc(adminTailHandler)))
+	adminMux.Handle("/", http.RedirectHandler("/admin/", http.StatusFound))
+	initControl()
+}
+
+// serveAdmin runs the admin server on its own port
+func serveAdmin(addr string) {
+	log.Printf("Admin dashboard on %s/admin/", addr)
+	log.Fatal(http.ListenAndServe(addr, adminMux))
+}
+
+// requireAdmin checks the admin token as a bearer token or basic-auth
+// password
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ingestion admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countRoute counts requests to a public route by status code
+func countRoute(route string, h http.HandlerFunc) http.HandlerFunc {
+	publicRoutes = append(publicRoutes, route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(recorder, r)
+		httpRequestsTotal.Inc(route, strconv.Itoa(recorder.status))
+	}
+}
+
+// workerBusy and workerDone track what each event worker is doing
+func workerBusy(id int, batch []map[string]interface{}) {
+	workerMu.Lock()
+	s := &workerStates[id]
+	s.State, s.Since, s.EventID = "busy", time.Now(), eventString(batch[0], "event_id")
+	workerMu.Unlock()
+}
+
+func workerDone(id int, err error) {
+	workerMu.Lock()
+	s := &workerStates[id]
+	s.State, s.Since, s.EventID = "idle", time.Now(), ""
+	if err != nil {
+		s.Failed++
+		s.LastError = err.Error()
+	} else {
+		s.Processed++
+	}
+	workerMu.Unlock()
+}
+
+// tailRecord adds an /events outcome to the live tail
+func tailRecord(event map[string]interface{}, eventID, outcome string) {
+	if !adminEnabled {
+		return
+	}
+	tailMu.Lock()
+	tailSeq++
+	tail = append(tail, tailEntry{
+		Seq:       tailSeq,
+		Time:      time.Now().UTC(),
+		Outcome:   outcome,
+		EventID:   eventID,
+		EventType: eventString(event, "event_type"),
+		UserID:    eventString(event, "user_id"),
+		TenantID:  eventString(event, "tenant_id"),
+		Region:    eventString(event, "residency_region"),
+	})
+	if len(tail) > adminTailSize {
+		tail = tail[len(tail)-adminTailSize:]
+	}
+	tailMu.Unlock()
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := metricsSnapshot()
+
+	workerMu.Lock()
+	workers := append([]workerState(nil), workerStates...)
+	workerMu.Unlock()
+
+	// Writer stats cover the time since the previous call
+	producerMu.Lock()
+	stats := kafkaWriter.Stats()
+	window := time.Since(producerLast)
+	if producerLast.IsZero() {
+		window = time.Since(startedAt)
+	}
+	producerLast = time.Now()
+	producerMu.Unlock()
+
+	overview := map[string]interface{}{
+		"time":           time.Now().UTC(),
+		"uptime_seconds": time.Since(startedAt).Seconds(),
+		"queue": map[string]interface{}{
+			"depth":        len(eventChannel),
+			"capacity":     queueSize,
+			"bytes":        queueBytes.Load(),
+			"budget_bytes": queueBudget,
+			"rejected":     metrics["ingestion_queue_rejected_total"],
+		},
+		"workers":       workers,
+		"intake_paused": intakePaused(),
+		"routes":        metrics["http_requests_total"],
+		"dedup":         adminDedupRates(metrics),
+		"producer": map[string]interface{}{
+			"window_seconds": window.Seconds(),
+			"writes":         stats.Writes,
+			"messages":       stats.Messages,
+			"errors":         stats.Errors,
+			"retries":        stats.Retries,
+			"avg_write_ms":   stats.WriteTime.Avg.Milliseconds(),
+			"max_write_ms":   stats.WriteTime.Max.Milliseconds(),
+		},
+		// Events are produced synchronously from memory; there is no disk
+		// spool to drain
+		"spool": map[string]interface{}{"enabled": false},
+	}
+	if lagClient != nil {
+		overview["consumer_lag"] = lagSnapshot()
+	}
+	writeAdminJSON(w, overview)
+}
+
+// adminDedupRates turns the dedup counters into hit rates per policy
+func adminDedupRates(metrics map[string]map[string]float64) map[string]interface{} {
+	type counts struct{ duplicate, new, skipped, near float64 }
+	byPolicy := make(map[string]*counts)
+	get := func(policy string) *counts {
+		if byPolicy[policy] == nil {
+			byPolicy[policy] = &counts{}
+		}
+		return byPolicy[policy]
+	}
+	for labels, value := range metrics["dedup_checks_total"] {
+		c := get(labelValue(labels, "policy"))
+		switch labelValue(labels, "result") {
+		case "duplicate":
+			c.duplicate += value
+		case "new":
+			c.new += value
+		case "skipped":
+			c.skipped += value
+		}
+	}
+	for labels, value := range metrics["near_duplicates_total"] {
+		get(labelValue(labels, "policy")).near += value
+	}
+
+	out := make(map[string]interface{}, len(byPolicy))
+	for policy, c := range byPolicy {
+		rate := 0.0
+		if checked := c.duplicate + c.new; checked > 0 {
+			rate = c.duplicate / checked
+		}
+		out[policy] = map[string]interface{}{
+			"checked":         c.duplicate + c.new,
+			"duplicates":      c.duplicate,
+			"near_duplicates": c.near,
+			"skipped":         c.skipped,
+			"hit_rate":        rate,
+		}
+	}
+	return out
+}
+
+// labelValue reads one label from a snapshot key "a=1,b=2"
+func labelValue(labels, name string) string {
+	for _, pair := range strings.Split(labels, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok && k == name {
+			return v
+		}
+	}
+	return ""
+}
+
+func adminErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	workerMu.Lock()
+	var workerErrors []map[string]interface{}
+	for _, s := range workerStates {
+		if s.LastError != "" {
+			workerErrors = append(workerErrors, map[string]interface{}{"worker": s.ID, "error": s.LastError, "failed": s.Failed})
+		}
+	}
+	workerMu.Unlock()
+
+	writeAdminJSON(w, map[string]interface{}{
+		"log":     errorLog.snapshot(),
+		"workers": workerErrors,
+	})
+}
+
+// adminTailHandler returns tail entries after ?since=<seq>, oldest first
+func adminTailHandler(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+
+	tailMu.Lock()
+	entries := make([]tailEntry, 0, len(tail))
+	for _, e := range tail {
+		if e.Seq > since {
+			entries = append(entries, e)
+		}
+	}
+	seq := tailSeq
+	tailMu.Unlock()
+
+	writeAdminJSON(w, map[string]interface{}{"seq": seq, "events": entries})
+}
+
+func adminDLQHandler(w http.ResponseWriter, r *http.Request) {
+	dlqMu.Lock()
+	defer dlqMu.Unlock()
+	if dlqCached == nil || time.Since(dlqCachedAt) > dlqCacheTTL || r.URL.Query().Get("refresh") != "" {
+		dlqCached = readDLQSummary()
+		dlqCachedAt = time.Now()
+	}
+	writeAdminJSON(w, dlqCached)
+}
+
+// readDLQSummary reads the newest messages of every dead-letter partition
+// and groups them by error
+func readDLQSummary() *dlqSummary {
+	summary := &dlqSummary{Topic: dlqTopic, FetchedAt: time.Now().UTC(), Errors: []dlqErrorLine{}}
+	fail := func(err error) *dlqSummary {
+		summary.Error = err.Error()
+		return summary
+	}
+
+	meta, err := adminKafka.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{dlqTopic}})
+	if err != nil {
+		return fail(err)
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		summary.Error = "topic not found"
+		return summary
+	}
+	var requests []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		requests = append(requests, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+	offsets, err := adminKafka.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{dlqTopic: requests},
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	groups := make(map[string]*dlqErrorLine)
+	types := make(map[string]map[string]bool)
+	for _, p := range offsets.Topics[dlqTopic] {
+		if p.Error != nil || p.LastOffset <= p.FirstOffset {
+			continue
+		}
+		summary.Messages += p.LastOffset - p.FirstOffset
+		start := max(p.FirstOffset, p.LastOffset-int64(dlqSample))
+
+		resp, err := adminKafka.Fetch(ctx, &kafka.FetchRequest{
+			Topic:     dlqTopic,
+			Partition: p.Partition,
+			Offset:    start,
+			MaxBytes:  1 << 20,
+			MaxWait:   100 * time.Millisecond,
+		})
+		if err != nil || resp.Error != nil {
+			continue
+		}
+		for {
+			record, err := resp.Records.ReadRecord()
+			if err != nil {
+				break
+			}
+			if record.Offset < start {
+				continue
+			}
+			var msg struct {
+				Error         string                 `json:"error"`
+				Timestamp     string                 `json:"timestamp"`
+				OriginalEvent map[string]interface{} `json:"original_event"`
+			}
+			if record.Value != nil {
+				data, _ := io.ReadAll(record.Value)
+				json.Unmarshal(data, &msg)
+			}
+			summary.Sampled++
+			if record.Time.After(summary.Newest) {
+				summary.Newest = record.Time.UTC()
+			}
+
+			key := msg.Error
+			if len(key) > 200 {
+				key = key[:200]
+			}
+			group := groups[key]
+			if group == nil {
+				group = &dlqErrorLine{Error: key}
+				groups[key] = group
+				types[key] = make(map[string]bool)
+			}
+			group.Count++
+			if msg.Timestamp > group.Last {
+				group.Last = msg.Timestamp
+			}
+			if eventType := eventString(msg.OriginalEvent, "event_type"); eventType != "" {
+				types[key][eventType] = true
+			}
+		}
+	}
+
+	for key, group := range groups {
+		for eventType := range types[key] {
+			group.EventTypes = append(group.EventTypes, eventType)
+		}
+		sort.Strings(group.EventTypes)
+		summary.Errors = append(summary.Errors, *group)
+	}
+	sort.Slice(summary.Errors, func(i, j int) bool { return summary.Errors[i].Count > summary.Errors[j].Count })
+	return summary
+}
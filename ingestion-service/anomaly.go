@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Anomaly detection learns the normal intake rate of every event_type, API
+// key and platform for each hour of the week, and flags buckets whose count
+// is too far from that seasonal baseline. Series are limited to the
+// configured event types and platforms and to tenant API keys, so clients
+// cannot create new ones.
+//
+// Counts are kept per ANOMALY_BUCKET in Redis so all replicas contribute.
+// When a bucket closes, one replica compares every series with the baseline
+// for its hour-of-week slot (an exponentially weighted mean and variance),
+// emits an ingest_anomaly event for significant drops and spikes unless a
+// mute window covers it, and folds the count into the baseline.
+
+const (
+	anomalyCountsPrefix   = "anomaly:counts:"
+	anomalyBaselinePrefix = "anomaly:baseline:"
+	anomalySeriesKey      = "anomaly:series"
+	anomalyLockPrefix     = "anomaly:lock:"
+)
+
+var (
+	anomalyEnabled    bool
+	anomalyBucket     time.Duration
+	anomalyThreshold  float64
+	anomalyAlpha      float64
+	anomalyMinSamples int64
+	anomalyMinRate    float64
+	anomalyEventTypes map[string]bool
+	anomalyWriter     *kafka.Writer
+	anomalyMutes      = &muteTable{}
+	anomalyStarted    time.Time
+
+	anomaliesTotal      = newCounterVec("ingest_anomalies_total", "Volume anomalies detected", "dimension", "direction")
+	anomaliesMutedTotal = newCounterVec("ingest_anomalies_muted_total", "Volume anomalies suppressed by a mute window", "dimension")
+	anomalyZScore       = newGaugeVec("ingest_rate_zscore", "Deviation of the last bucket from its seasonal baseline", "dimension", "value")
+)
+
+// muteWindow suppresses anomalies during planned changes. Empty dimension or
+// value match everything.
+type muteWindow struct {
+	Dimension string    `json:"dimension"`
+	Value     string    `json:"value"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reason    string    `json:"reason"`
+}
+
+// muteTable holds ANOMALY_MUTE_FILE, re-read when it changes
+type muteTable struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	windows []muteWindow
+}
+
+func initAnomaly(brokers string) {
+	if !getEnvBool("ANOMALY_ENABLED", false) {
+		return
+	}
+
+	anomalyBucket = getEnvDuration("ANOMALY_BUCKET", 5*time.Minute)
+	if anomalyBucket < time.Minute || time.Hour%anomalyBucket != 0 {
+		log.Fatalf("ANOMALY_BUCKET must divide an hour and be at least 1m, got %s", anomalyBucket)
+	}
+	var err error
+	if anomalyThreshold, err = strconv.ParseFloat(getEnv("ANOMALY_Z_THRESHOLD", "4"), 64); err != nil {
+		log.Fatalf("Invalid ANOMALY_Z_THRESHOLD: %v", err)
+	}
+	if anomalyAlpha, err = strconv.ParseFloat(getEnv("ANOMALY_ALPHA", "0.2"), 64); err != nil || anomalyAlpha <= 0 || anomalyAlpha > 1 {
+		log.Fatalf("ANOMALY_ALPHA must be in (0, 1]")
+	}
+	if anomalyMinRate, err = strconv.ParseFloat(getEnv("ANOMALY_MIN_RATE", "5"), 64); err != nil {
+		log.Fatalf("Invalid ANOMALY_MIN_RATE: %v", err)
+	}
+	anomalyMinSamples = int64(getEnvInt("ANOMALY_MIN_SAMPLES", 3))
+	anomalyEventTypes = labelSet(getEnv("ANOMALY_EVENT_TYPES", ""))
+
+	if path := getEnv("ANOMALY_MUTE_FILE", ""); path != "" {
+		anomalyMutes.path = path
+		if err := anomalyMutes.reload(); err != nil {
+			log.Fatalf("Failed to load mute windows from %s: %v", path, err)
+		}
+	}
+
+	anomalyWriter = newKafkaWriter(brokers, getEnv("ANOMALY_TOPIC", "anomalies"))
+	anomalyStarted = time.Now()
+	anomalyEnabled = true
+	log.Printf("Anomaly detection enabled (%s buckets, z >= %g)", anomalyBucket, anomalyThreshold)
+}
+
+// anomalySeries returns the "dimension=value" series an event counts toward
+func anomalySeries(event map[string]interface{}, r *http.Request) []string {
+	apiKey := "none"
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		apiKey = "other"
+		if _, ok := tenants[key]; ok {
+			// Never store the key itself
+			hash := sha256.Sum256([]byte(key))
+			apiKey = "key-" + hex.EncodeToString(hash[:4])
+		}
+	}
+	platform := eventString(event, "platform")
+	if platform == "" {
+		platform = eventString(event, "device_type")
+	}
+
+	return []string{
+		"event_type=" + boundedLabel(eventString(event, "event_type"), anomalyEventTypes),
+		"api_key=" + apiKey,
+		"platform=" + boundedLabel(platform, clientPlatforms),
+	}
+}
+
+// anomalyObserve counts an event in the current bucket once it has been
+// queued or coalesced, so refused traffic does not skew the baselines
+func anomalyObserve(event map[string]interface{}, r *http.Request, now time.Time) {
+	if !anomalyEnabled || isCanary(event) {
+		return
+	}
+	key := anomalyCountsPrefix + strconv.FormatInt(now.Truncate(anomalyBucket).Unix(), 10)
+
+	pipe := redisClient.Pipeline()
+	for _, series := range anomalySeries(event, r) {
+		pipe.HIncrBy(ctx, key, series, 1)
+		pipe.SAdd(ctx, anomalySeriesKey, series)
+	}
+	pipe.Expire(ctx, key, 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Anomaly counting failed: %v", err)
+	}
+}
+
+// anomalyLoop evaluates each bucket shortly after it closes. The bucket the
+// service started in is skipped since this replica only saw part of it.
+func anomalyLoop(grace time.Duration) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	next := anomalyStarted.Truncate(anomalyBucket).Add(anomalyBucket)
+	for now := range ticker.C {
+		for !now.Before(next.Add(anomalyBucket + grace)) {
+			if err := evaluateBucket(next, now); err != nil {
+				log.Printf("Anomaly evaluation for %s failed: %v", next.UTC().Format(time.RFC3339), err)
+			}
+			next = next.Add(anomalyBucket)
+		}
+	}
+}
+
+// hourOfWeek returns the seasonal slot of a bucket, 0 = Monday 00:00 UTC
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return (int(t.Weekday())+6)%7*24 + t.Hour()
+}
+
+func evaluateBucket(start, now time.Time) error {
+	bucketID := strconv.FormatInt(start.Unix(), 10)
+	won, err := redisClient.SetNX(ctx, anomalyLockPrefix+bucketID, "1", 24*time.Hour).Result()
+	if err != nil || !won {
+		return err
+	}
+
+	counts, err := redisClient.HGetAll(ctx, anomalyCountsPrefix+bucketID).Result()
+	if err != nil {
+		return err
+	}
+	series, err := redisClient.SMembers(ctx, anomalySeriesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	if err := anomalyMutes.reload(); err != nil {
+		log.Printf("Failed to reload mute windows: %v", err)
+	}
+
+	slot := strconv.Itoa(hourOfWeek(start))
+	pipe := redisClient.Pipeline()
+	baselines := make([]*redis.SliceCmd, len(series))
+	for i, s := range series {
+		baselines[i] = pipe.HMGet(ctx, anomalyBaselinePrefix+s, slot+":n", slot+":mean", slot+":var")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+
+	update := redisClient.Pipeline()
+	for i, s := range series {
+		observed, _ := strconv.ParseFloat(counts[s], 64)
+		values := baselines[i].Val()
+		n, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+		mean, _ := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+		variance, _ := strconv.ParseFloat(fmt.Sprint(values[2]), 64)
+
+		dimension, value, _ := strings.Cut(s, "=")
+		if n >= anomalyMinSamples {
+			// Poisson noise as a floor so sparse series don't alert on every blip
+			std := math.Max(math.Sqrt(variance), math.Max(math.Sqrt(mean), 1))
+			z := (observed - mean) / std
+			anomalyZScore.Set(z, dimension, value)
+
+			significant := math.Abs(z) >= anomalyThreshold && math.Max(mean, observed) >= anomalyMinRate
+			if significant {
+				direction := "spike"
+				if z < 0 {
+					direction = "drop"
+				}
+				if anomalyMutes.muted(dimension, value, start) {
+					anomaliesMutedTotal.Inc(dimension)
+				} else {
+					anomaliesTotal.Inc(dimension, direction)
+					emitAnomaly(dimension, value, direction, start, observed, mean, std, z, now)
+				}
+			}
+		}
+
+		// Exponentially weighted update; early samples use a plain average
+		alpha := math.Max(anomalyAlpha, 1/float64(n+1))
+		diff := observed - mean
+		mean += alpha * diff
+		variance = (1 - alpha) * (variance + alpha*diff*diff)
+		key := anomalyBaselinePrefix + s
+		update.HSet(ctx, key, slot+":n", n+1, slot+":mean", mean, slot+":var", variance)
+		update.Expire(ctx, key, 8*7*24*time.Hour)
+	}
+	_, err = update.Exec(ctx)
+	return err
+}
+
+func emitAnomaly(dimension, value, direction string, start time.Time, observed, expected, std, z float64, now time.Time) {
+	hash := sha256.Sum256([]byte(dimension + "=" + value + ":" + strconv.FormatInt(start.Unix(), 10)))
+	nowStr := now.UTC().Format(time.RFC3339)
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"event_id":     hex.EncodeToString(hash[:]),
+		"event_type":   "ingest_anomaly",
+		"dimension":    dimension,
+		"value":        value,
+		"direction":    direction,
+		"observed":     observed,
+		"expected":     expected,
+		"stddev":       std,
+		"z_score":      z,
+		"bucket_start": start.UTC().Format(time.RFC3339),
+		"bucket_end":   start.Add(anomalyBucket).UTC().Format(time.RFC3339),
+		"timestamp":    nowStr,
+		"derived":      true,
+	})
+	log.Printf("Anomaly: %s=%s %s (observed %.0f, expected %.1f, z %.1f)", dimension, value, direction, observed, expected, z)
+
+	if err := anomalyWriter.WriteMessages(ctx, kafka.Message{Key: []byte(dimension + "=" + value), Value: data}); err != nil {
+		log.Printf("Failed to publish anomaly: %v", err)
+	}
+}
+
+// reload re-reads the mute windows if the file changed
+func (t *muteTable) reload() error {
+	if t.path == "" {
+		return nil
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	unchanged := info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var windows []muteWindow
+	if err := loadJSONFile(t.path, &windows); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.windows = windows
+	t.modTime = info.ModTime()
+	t.mu.Unlock()
+	log.Printf("Loaded %d anomaly mute windows", len(windows))
+	return nil
+}
+
+// muted reports whether a series is inside a mute window at the given time
+func (t *muteTable) muted(dimension, value string, at time.Time) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, w := range t.windows {
+		if (w.Dimension == "" || w.Dimension == dimension) &&
+			(w.Value == "" || w.Value == value) &&
+			!at.Before(w.Start) && at.Before(w.End) {
+			return true
+		}
+	}
+	return false
+}
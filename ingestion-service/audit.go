@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"ingestion-service/audit"
+)
+
+// Reconciliation counters: every acknowledged event is counted as accepted,
+// and again as produced once its Kafka write succeeds, per UTC hour of
+// ingested_at and route. The audit job (cmd/audit) compares them with the
+// raw-events topic and the raw_events table; its latest report is surfaced
+// here as audit_completeness_ratio.
+
+var (
+	auditEnabled    bool
+	auditSampleRate float64
+
+	auditMu     sync.RWMutex
+	auditReport *audit.Report
+
+	auditCompleteness = newGaugeVec("audit_completeness_ratio", "Completeness of the last audited hour", "stage")
+	auditLastHour     = newGaugeVec("audit_last_hour_unix_seconds", "Start of the last audited hour")
+)
+
+func initAudit() {
+	if !getEnvBool("AUDIT_ENABLED", false) {
+		return
+	}
+	rate, err := strconv.ParseFloat(getEnv("AUDIT_SAMPLE_RATE", "0.01"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		log.Fatalf("Invalid AUDIT_SAMPLE_RATE %q", getEnv("AUDIT_SAMPLE_RATE", ""))
+	}
+	auditSampleRate = rate
+	auditEnabled = true
+	log.Printf("Audit counters enabled (sample rate %g)", rate)
+}
+
+// auditHour buckets an event by the ingested_at stamped at acceptance
+func auditHour(event map[string]interface{}) string {
+	return auditHourAt(eventString(event, "ingested_at"))
+}
+
+func auditHourAt(ingestedAt string) string {
+	if t, err := time.Parse(time.RFC3339, ingestedAt); err == nil {
+		return audit.Hour(t)
+	}
+	return audit.Hour(time.Now())
+}
+
+// auditAccepted counts an event acknowledged with 202
+func auditAccepted(event map[string]interface{}, route string) {
+	if !auditEnabled {
+		return
+	}
+	eventID := eventString(event, "event_id")
+	hour := auditHour(event)
+	key := audit.CountersKey(hour, route)
+
+	pipe := redisClient.Pipeline()
+	pipe.HIncrBy(ctx, key, audit.FieldAccepted, 1)
+	pipe.HIncrBy(ctx, key, audit.FieldAcceptedSum, audit.Checksum(eventID))
+	pipe.Expire(ctx, key, audit.TTL)
+	if audit.Sampled(eventID, auditSampleRate) {
+		sampleKey := audit.SampleKey(hour, route)
+		pipe.SAdd(ctx, sampleKey, eventID)
+		pipe.Expire(ctx, sampleKey, audit.TTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Audit: failed to count accepted event: %v", err)
+	}
+}
+
+// auditProduced counts the acknowledged events a successful Kafka write
+// delivered: the parent of an exploded family, or every member of a
+// coalesced event. Each member is counted in the hour it was accepted in,
+// from accepted (its ingested_at, by coalesced_event_ids), as auditAccepted
+// counted it; the messages are counted in the first member's hour.
+func auditProduced(batch []map[string]interface{}, accepted []string) {
+	if !auditEnabled {
+		return
+	}
+	first := batch[0]
+	route := audit.RouteDirect
+	ids := []string{eventString(first, "event_id")}
+
+	switch {
+	case len(batch) > 1 || eventString(first, "parent_event_id") != "":
+		route = audit.RouteExploded
+		if parentID := eventString(first, "parent_event_id"); parentID != "" {
+			ids = []string{parentID}
+		}
+	case first["event_count"] != nil:
+		route = audit.RouteCoalesced
+		if memberIDs, ok := first["coalesced_event_ids"].([]string); ok {
+			ids = memberIDs
+		}
+	}
+
+	firstHour := auditHour(first)
+	produced := make(map[string]int64)
+	sums := make(map[string]int64)
+	for i, id := range ids {
+		hour := firstHour
+		if route == audit.RouteCoalesced && i < len(accepted) {
+			hour = auditHourAt(accepted[i])
+		}
+		produced[hour]++
+		sums[hour] += audit.Checksum(id)
+	}
+
+	pipe := redisClient.Pipeline()
+	for hour, n := range produced {
+		key := audit.CountersKey(hour, route)
+		pipe.HIncrBy(ctx, key, audit.FieldProduced, n)
+		pipe.HIncrBy(ctx, key, audit.FieldProducedSum, sums[hour])
+		pipe.Expire(ctx, key, audit.TTL)
+	}
+	pipe.HIncrBy(ctx, audit.CountersKey(firstHour, route), audit.FieldMessages, int64(len(batch)))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Audit: failed to count produced events: %v", err)
+	}
+}
+
+// auditReportLoop picks up the audit job's latest report
+func auditReportLoop(interval time.Duration) {
+	for {
+		data, err := redisClient.Get(ctx, audit.LatestReportKey).Bytes()
+		if err == nil {
+			var report audit.Report
+			if err := json.Unmarshal(data, &report); err != nil {
+				log.Printf("Audit: invalid report: %v", err)
+			} else {
+				for stage, s := range report.Stages {
+					auditCompleteness.Set(s.Completeness, stage)
+				}
+				if start, err := audit.ParseHour(report.Hour); err == nil {
+					auditLastHour.Set(float64(start.Unix()))
+				}
+				auditMu.Lock()
+				auditReport = &report
+				auditMu.Unlock()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// latestAuditReport returns the last report seen, or nil
+func latestAuditReport() *audit.Report {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	return auditReport
+}
@@ -0,0 +1,120 @@
+// Package audit defines the Redis layout of the ingestion service's
+// reconciliation counters and the report written by the audit job.
+//
+// For every UTC hour (by ingested_at) and route the service keeps a hash
+// audit:<yyyymmddhh>:<route> with accepted/produced event counts and
+// checksums, plus a deterministic sample of accepted event IDs in
+// audit:<yyyymmddhh>:<route>:sample. Checksums are order-independent sums
+// over event IDs, so equal counts with different IDs still show up.
+package audit
+
+import (
+	"strconv"
+	"time"
+)
+
+// Routes an acknowledged event can take to Kafka
+const (
+	RouteDirect    = "direct"    // queued as a single message
+	RouteCoalesced = "coalesced" // merged with neighbours before producing
+	RouteExploded  = "exploded"  // produced with its child events
+)
+
+// Counter fields of the per-hour, per-route hash
+const (
+	FieldAccepted    = "accepted"     // event IDs acknowledged to clients
+	FieldAcceptedSum = "accepted_sum" // checksum of accepted IDs
+	FieldProduced    = "produced"     // event IDs written to Kafka
+	FieldProducedSum = "produced_sum" // checksum of produced IDs
+	FieldMessages    = "messages"     // Kafka messages written (children included)
+)
+
+const (
+	keyPrefix = "audit:"
+
+	// LatestReportKey holds the most recent Report as JSON
+	LatestReportKey = keyPrefix + "report:latest"
+
+	// TTL is how long counters and reports are kept
+	TTL = 8 * 24 * time.Hour
+)
+
+// Hour returns the bucket an ingestion time falls into
+func Hour(t time.Time) string {
+	return t.UTC().Format("2006010215")
+}
+
+// ParseHour returns the start of a bucket
+func ParseHour(hour string) (time.Time, error) {
+	return time.Parse("2006010215", hour)
+}
+
+// CountersKey is the hash of counters for an hour and route
+func CountersKey(hour, route string) string {
+	return keyPrefix + hour + ":" + route
+}
+
+// SampleKey is the set of sampled accepted IDs for an hour and route
+func SampleKey(hour, route string) string {
+	return CountersKey(hour, route) + ":sample"
+}
+
+// ReportKey holds the Report for an hour as JSON
+func ReportKey(hour string) string {
+	return keyPrefix + "report:" + hour
+}
+
+// Checksum is an event ID's contribution to an hour's checksum. Event IDs are
+// hex SHA-256 digests; other IDs contribute nothing.
+func Checksum(eventID string) int64 {
+	if len(eventID) < 8 {
+		return 0
+	}
+	n, err := strconv.ParseUint(eventID[:8], 16, 32)
+	if err != nil {
+		return 0
+	}
+	return int64(n)
+}
+
+// Sampled reports whether an event ID is in the sample for the given rate.
+// The decision depends only on the ID, so the audit job can select the same
+// IDs from Kafka and the database.
+func Sampled(eventID string, rate float64) bool {
+	if len(eventID) < 16 {
+		return false
+	}
+	n, err := strconv.ParseUint(eventID[8:16], 16, 32)
+	if err != nil {
+		return false
+	}
+	return float64(n) < rate*(1<<32)
+}
+
+// Stage compares one hop of the pipeline for an hour
+type Stage struct {
+	Expected     int64    `json:"expected"`
+	Found        int64    `json:"found"`
+	Completeness float64  `json:"completeness"`
+	ChecksumOK   *bool    `json:"checksum_ok,omitempty"`
+	MissingIDs   []string `json:"missing_ids,omitempty"` // from the sample
+}
+
+// Report is the audit job's result for one hour. Stages are "produced"
+// (accepted vs produced by the service), "kafka" (produced vs present in
+// raw-events) and "raw_events" (Kafka messages vs database rows).
+type Report struct {
+	Hour        string                      `json:"hour"`
+	Routes      map[string]map[string]int64 `json:"routes"`
+	Stages      map[string]*Stage           `json:"stages"`
+	GeneratedAt time.Time                   `json:"generated_at"`
+}
+
+// NewStage computes completeness, treating an empty hop as complete
+func NewStage(expected, found int64) *Stage {
+	s := &Stage{Expected: expected, Found: found, Completeness: 1}
+	if expected > 0 {
+		s.Completeness = float64(found) / float64(expected)
+	}
+	return s
+}
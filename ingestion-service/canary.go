@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Canary probes post a synthetic event for a reserved user through the
+// public /events endpoint every CANARY_INTERVAL, then poll until the feature
+// processor's output for that exact event shows up in the Redis serving
+// cache (features:<user>) and the features table. A probe that hasn't shown
+// up in both within CANARY_SLO counts as a failure.
+//
+// Canary events carry "canary": true and a "canary_sent_ms" nonce; the
+// processor echoes the nonce back as the canary_sent_ms feature and keeps
+// canary events out of drift statistics. Probes send CANARY_API_KEY so that
+// with tenants enabled they are metered against their own tenant rather
+// than the default one, and with residency enabled they name CANARY_REGION
+// in the residency field since they carry no country.
+
+const (
+	canaryEventType   = "canary"
+	canaryFeatureName = "canary_sent_ms"
+	canaryWindow      = 100 // probes in the success ratio
+)
+
+var (
+	canaryUsers     []string
+	canaryTargetURL string
+	canaryAPIKey    string
+	canaryRegion    string
+	canarySLO       time.Duration
+	canaryDB        *sql.DB
+	canaryHTTP      = &http.Client{Timeout: 5 * time.Second}
+
+	canaryMu      sync.Mutex
+	canaryResults []bool
+
+	canaryProbesTotal  = newCounterVec("canary_probes_total", "Canary probes by outcome", "result")
+	canaryLatency      = newGaugeVec("canary_latency_seconds", "Latency of the last successful canary probe", "stage")
+	canaryLatencySum   = newCounterVec("canary_e2e_latency_seconds_sum", "Total end-to-end latency of successful canary probes")
+	canaryLatencyCount = newCounterVec("canary_e2e_latency_seconds_count", "Successful canary probes")
+	canarySuccessRatio = newGaugeVec("canary_success_ratio", "Share of recent canary probes that met the SLO")
+)
+
+func initCanary() {
+	if !getEnvBool("CANARY_ENABLED", false) {
+		return
+	}
+
+	for _, user := range strings.Split(getEnv("CANARY_USERS", "canary-user-1"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			canaryUsers = append(canaryUsers, user)
+		}
+	}
+	canaryTargetURL = getEnv("CANARY_TARGET_URL", "http://localhost:8081/events")
+	canarySLO = getEnvDuration("CANARY_SLO", 30*time.Second)
+	canaryAPIKey = getEnv("CANARY_API_KEY", "")
+	canaryRegion = getEnv("CANARY_REGION", "")
+
+	if dsn := getEnv("CANARY_POSTGRES_DSN", ""); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("Invalid CANARY_POSTGRES_DSN: %v", err)
+		}
+		db.SetMaxOpenConns(2)
+		canaryDB = db
+	}
+	log.Printf("Canary probes enabled for %d users (SLO %s)", len(canaryUsers), canarySLO)
+}
+
+// isCanary reports whether an event is a synthetic probe
+func isCanary(event map[string]interface{}) bool {
+	marker, _ := event["canary"].(bool)
+	return marker
+}
+
+// canaryLoop starts one probe per interval, rotating through the users.
+// Probes run concurrently since the SLO may be longer than the interval.
+func canaryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		<-ticker.C
+		go runCanaryProbe(canaryUsers[i%len(canaryUsers)])
+	}
+}
+
+func runCanaryProbe(userID string) {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	sent := time.Now()
+	sentMs := sent.UnixMilli()
+
+	result := probeCanary(userID, hex.EncodeToString(nonce), sent, sentMs)
+	canaryProbesTotal.Inc(result)
+
+	canaryMu.Lock()
+	canaryResults = append(canaryResults, result == "success")
+	if len(canaryResults) > canaryWindow {
+		canaryResults = canaryResults[1:]
+	}
+	ok := 0
+	for _, r := range canaryResults {
+		if r {
+			ok++
+		}
+	}
+	canarySuccessRatio.Set(float64(ok) / float64(len(canaryResults)))
+	canaryMu.Unlock()
+
+	if result != "success" {
+		log.Printf("Canary probe for %s failed: %s", userID, result)
+	}
+}
+
+// probeCanary sends one probe and waits for it downstream, returning
+// "success" or the stage that failed
+func probeCanary(userID, canaryID string, sent time.Time, sentMs int64) string {
+	event := map[string]interface{}{
+		"user_id":         userID,
+		"event_type":      canaryEventType,
+		"timestamp":       sent.UTC().Format(time.RFC3339Nano),
+		"device_type":     canaryEventType,
+		"canary":          true,
+		"canary_id":       canaryID,
+		canaryFeatureName: sentMs,
+	}
+	if residencyEnabled && canaryRegion != "" {
+		event[residencyCfg.Field] = canaryRegion
+	}
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequest(http.MethodPost, canaryTargetURL, bytes.NewReader(body))
+	if err != nil {
+		return "ingest_error"
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if canaryAPIKey != "" {
+		req.Header.Set("X-API-Key", canaryAPIKey)
+	}
+	resp, err := canaryHTTP.Do(req)
+	if err != nil {
+		return "ingest_error"
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "ingest_rejected"
+	}
+	latencies := map[string]time.Duration{"ingest": time.Since(sent)}
+
+	deadline := sent.Add(canarySLO)
+	for time.Now().Before(deadline) {
+		if _, ok := latencies["redis"]; !ok {
+			if found, err := canaryInRedis(userID, sentMs); err != nil {
+				log.Printf("Canary Redis check failed: %v", err)
+			} else if found {
+				latencies["redis"] = time.Since(sent)
+			}
+		}
+		if _, ok := latencies["postgres"]; !ok && canaryDB != nil {
+			if found, err := canaryInPostgres(userID, sentMs); err != nil {
+				log.Printf("Canary Postgres check failed: %v", err)
+			} else if found {
+				latencies["postgres"] = time.Since(sent)
+			}
+		}
+
+		_, inRedis := latencies["redis"]
+		_, inPostgres := latencies["postgres"]
+		if inRedis && (inPostgres || canaryDB == nil) {
+			e2e := time.Duration(0)
+			for stage, d := range latencies {
+				canaryLatency.Set(d.Seconds(), stage)
+				if d > e2e {
+					e2e = d
+				}
+			}
+			canaryLatency.Set(e2e.Seconds(), "e2e")
+			canaryLatencySum.Add(e2e.Seconds())
+			canaryLatencyCount.Inc()
+			return "success"
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if _, ok := latencies["redis"]; !ok {
+		return "redis_timeout"
+	}
+	return "postgres_timeout"
+}
+
+// canaryInRedis checks the serving cache for the probe's nonce
+func canaryInRedis(userID string, sentMs int64) (bool, error) {
+	data, err := redisClient.Get(ctx, "features:"+userID).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+	var features map[string]struct {
+		Value float64 `json:"value"`
+	}
+	if err := json.Unmarshal(data, &features); err != nil {
+		return false, fmt.Errorf("features:%s: %w", userID, err)
+	}
+	feature, ok := features[canaryFeatureName]
+	return ok && int64(feature.Value) == sentMs, nil
+}
+
+// canaryInPostgres checks the features table for the probe's nonce
+func canaryInPostgres(userID string, sentMs int64) (bool, error) {
+	var value float64
+	err := canaryDB.QueryRowContext(ctx,
+		"SELECT feature_value FROM features WHERE user_id = $1 AND feature_name = $2",
+		userID, canaryFeatureName).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return int64(value) == sentMs, nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Complex event processing: declarative per-user sequence patterns such as
+// "login then logout within 10s" or "3+ views and no purchase within 30m".
+//
+// Partial matches live in Redis (cep:state:<pattern>:<user>) so every replica
+// sees the same state. Each partial match has a deadline in the cep:timers
+// sorted set; the timer loop expires stale partials and confirms patterns
+// with negation once their window closes without a cancelling event.
+//
+// With data residency, state and timers live in the event's region Redis
+// under its prefix, and matches are produced to the region's cluster.
+
+const (
+	cepTimersKey      = "cep:timers"
+	cepMaxEventIDs    = 20 // source event IDs kept per match
+	cepTxRetries      = 3
+	cepTimerBatchSize = 100
+)
+
+var (
+	cepPatterns     []*cepPattern
+	cepWriter       *kafka.Writer
+	cepMatchesTotal = newCounterVec("cep_matches_total", "Pattern matches emitted", "pattern")
+	cepExpiredTotal = newCounterVec("cep_partial_expired_total", "Partial matches that timed out", "pattern")
+)
+
+// cepStep is one ordered step of a pattern
+type cepStep struct {
+	EventType string            `json:"event_type"`
+	Count     int               `json:"count"` // minimum occurrences, default 1
+	Where     map[string]string `json:"where"` // optional field equality filters
+}
+
+// cepPattern is a declarative sequence pattern loaded from CEP_PATTERNS_FILE
+type cepPattern struct {
+	ID     string    `json:"id"`
+	Steps  []cepStep `json:"steps"`
+	Within string    `json:"within"`
+	// Not lists event types that cancel an in-progress match. Patterns with
+	// negation are only confirmed when the window closes.
+	Not []string `json:"not"`
+
+	within time.Duration
+	types  map[string]bool
+}
+
+// cepStore is where one region keeps pattern state and emits matches
+type cepStore struct {
+	client redis.UniversalClient
+	prefix string
+	writer *kafka.Writer
+}
+
+// cepState is the partial match stored per pattern and user
+type cepState struct {
+	Step      int      `json:"step"`
+	Count     int      `json:"count"`
+	StartedAt int64    `json:"started_at"` // unix ms
+	Complete  bool     `json:"complete"`
+	EventIDs  []string `json:"event_ids"`
+}
+
+func initCEP(brokers string) {
+	path := getEnv("CEP_PATTERNS_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var patterns []*cepPattern
+	if err := loadJSONFile(path, &patterns); err != nil {
+		log.Fatalf("Failed to load CEP patterns from %s: %v", path, err)
+	}
+	for _, p := range patterns {
+		if err := p.compile(); err != nil {
+			log.Fatalf("Invalid CEP pattern %q: %v", p.ID, err)
+		}
+	}
+
+	cepPatterns = patterns
+	cepWriter = newKafkaWriter(brokers, getEnv("CEP_OUTPUT_TOPIC", "patterns"))
+	log.Printf("CEP enabled with %d patterns, emitting to %s", len(patterns), cepWriter.Topic)
+}
+
+func (p *cepPattern) compile() error {
+	if p.ID == "" || strings.Contains(p.ID, ":") {
+		return errors.New("id must be non-empty and must not contain ':'")
+	}
+	if len(p.Steps) == 0 {
+		return errors.New("at least one step is required")
+	}
+	within, err := time.ParseDuration(p.Within)
+	if err != nil || within <= 0 {
+		return fmt.Errorf("invalid within %q", p.Within)
+	}
+	p.within = within
+
+	p.types = make(map[string]bool)
+	for i := range p.Steps {
+		if p.Steps[i].EventType == "" {
+			return fmt.Errorf("step %d has no event_type", i)
+		}
+		if p.Steps[i].Count < 1 {
+			p.Steps[i].Count = 1
+		}
+		p.types[p.Steps[i].EventType] = true
+	}
+	for _, t := range p.Not {
+		p.types[t] = true
+	}
+	return nil
+}
+
+func (p *cepPattern) negates(eventType string) bool {
+	for _, t := range p.Not {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s cepStep) matches(event map[string]interface{}) bool {
+	if eventString(event, "event_type") != s.EventType {
+		return false
+	}
+	for field, want := range s.Where {
+		if fmt.Sprint(event[field]) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (s cepStore) stateKey(patternID, userID string) string {
+	return s.prefix + "cep:state:" + patternID + ":" + redisConfig.Tag(userID)
+}
+
+func (s cepStore) timersKey() string {
+	return s.prefix + cepTimersKey
+}
+
+// cepStoreFor returns the store of an event's region, or the default one
+func cepStoreFor(event map[string]interface{}) cepStore {
+	if region := eventRegion(event); region != nil {
+		return cepStore{region.redis, region.RedisPrefix, region.cepWriter}
+	}
+	return cepStore{redisClient, "", cepWriter}
+}
+
+// cepStores lists every store the timer loop scans. Regions sharing the
+// default Redis and prefix share its timers, so each set is listed once.
+func cepStores() []cepStore {
+	names := make([]string, 0, len(residencyRegions))
+	for name := range residencyRegions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stores []cepStore
+	seen := make(map[cepStore]bool) // client and prefix only
+	add := func(store cepStore) {
+		key := cepStore{client: store.client, prefix: store.prefix}
+		if !seen[key] {
+			seen[key] = true
+			stores = append(stores, store)
+		}
+	}
+	for _, name := range names {
+		add(cepStoreFor(map[string]interface{}{"residency_region": name}))
+	}
+	add(cepStore{redisClient, "", cepWriter})
+	return stores
+}
+
+// cepObserve feeds an event that reached Kafka into every relevant pattern.
+// Windows are measured against ingestion time so they agree with the timers.
+func cepObserve(event map[string]interface{}) {
+	userID := eventString(event, "user_id")
+	eventType := eventString(event, "event_type")
+	if userID == "" || eventType == "" {
+		return
+	}
+
+	now := time.Now()
+	store := cepStoreFor(event)
+	for _, p := range cepPatterns {
+		if !p.types[eventType] {
+			continue
+		}
+		if err := cepAdvance(store, p, userID, event, now); err != nil {
+			log.Printf("CEP pattern %s failed for user %s: %v", p.ID, userID, err)
+		}
+	}
+}
+
+func cepLoadState(tx *redis.Tx, key string) (*cepState, error) {
+	data, err := tx.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state cepState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// cepAdvance moves one user's partial match forward under optimistic locking
+func cepAdvance(store cepStore, p *cepPattern, userID string, event map[string]interface{}, now time.Time) error {
+	key := store.stateKey(p.ID, userID)
+	eventType := eventString(event, "event_type")
+	eventID := eventString(event, "event_id")
+
+	var matched *cepState
+	var started, cleared bool
+
+	txf := func(tx *redis.Tx) error {
+		matched, started, cleared = nil, false, false
+
+		state, err := cepLoadState(tx, key)
+		if err != nil {
+			return err
+		}
+		if state != nil && now.Sub(time.UnixMilli(state.StartedAt)) > p.within {
+			if state.Complete {
+				// Window closed without a cancelling event; the timer owns it now
+				return nil
+			}
+			state = nil
+		}
+
+		if state != nil && p.negates(eventType) {
+			cleared = true
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				return nil
+			})
+			return err
+		}
+
+		if state == nil {
+			if !p.Steps[0].matches(event) {
+				return nil
+			}
+			state = &cepState{StartedAt: now.UnixMilli()}
+			started = true
+		} else if state.Complete || !p.Steps[state.Step].matches(event) {
+			return nil
+		}
+
+		state.Count++
+		if len(state.EventIDs) < cepMaxEventIDs {
+			state.EventIDs = append(state.EventIDs, eventID)
+		}
+		if state.Count >= p.Steps[state.Step].Count {
+			state.Step++
+			state.Count = 0
+		}
+
+		if state.Step == len(p.Steps) && len(p.Not) == 0 {
+			matched = state
+			cleared = true
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				return nil
+			})
+			return err
+		}
+
+		state.Complete = state.Step == len(p.Steps)
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		ttl := time.UnixMilli(state.StartedAt).Add(p.within).Sub(now) + time.Minute
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, ttl)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < cepTxRetries; i++ {
+		if err = store.client.Watch(ctx, txf, key); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	member := p.ID + ":" + userID
+	switch {
+	case cleared:
+		store.client.ZRem(ctx, store.timersKey(), member)
+	case started:
+		deadline := now.Add(p.within).UnixMilli()
+		store.client.ZAdd(ctx, store.timersKey(), redis.Z{Score: float64(deadline), Member: member})
+	}
+
+	if matched != nil {
+		return cepEmit(store, p, userID, matched, now)
+	}
+	return nil
+}
+
+// cepTimerLoop fires due deadlines in every store; ZREM arbitrates between
+// replicas
+func cepTimerLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stores := cepStores()
+	for range ticker.C {
+		for _, store := range stores {
+			cepFireDue(store, time.Now())
+		}
+	}
+}
+
+func cepFireDue(store cepStore, now time.Time) {
+	members, err := store.client.ZRangeByScore(ctx, store.timersKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: cepTimerBatchSize,
+	}).Result()
+	if err != nil {
+		log.Printf("CEP timer scan of %s failed: %v", store.timersKey(), err)
+		return
+	}
+
+	for _, member := range members {
+		if removed, err := store.client.ZRem(ctx, store.timersKey(), member).Result(); err != nil || removed == 0 {
+			continue
+		}
+		patternID, userID, ok := strings.Cut(member, ":")
+		if !ok {
+			continue
+		}
+		for _, p := range cepPatterns {
+			if p.ID == patternID {
+				if err := cepFire(store, p, userID, now); err != nil {
+					log.Printf("CEP timer for %s failed: %v", member, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// cepFire resolves a partial match whose deadline has passed
+func cepFire(store cepStore, p *cepPattern, userID string, now time.Time) error {
+	key := store.stateKey(p.ID, userID)
+
+	var matched *cepState
+	var rearm int64
+
+	txf := func(tx *redis.Tx) error {
+		matched, rearm = nil, 0
+
+		state, err := cepLoadState(tx, key)
+		if err != nil || state == nil {
+			return err
+		}
+		deadline := time.UnixMilli(state.StartedAt).Add(p.within)
+		if deadline.After(now) {
+			// The partial was restarted after this timer was read
+			rearm = deadline.UnixMilli()
+			return nil
+		}
+		if state.Complete {
+			matched = state
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < cepTxRetries; i++ {
+		if err = store.client.Watch(ctx, txf, key); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if rearm > 0 {
+		store.client.ZAdd(ctx, store.timersKey(), redis.Z{Score: float64(rearm), Member: p.ID + ":" + userID})
+		return nil
+	}
+	if matched == nil {
+		cepExpiredTotal.Inc(p.ID)
+		return nil
+	}
+	return cepEmit(store, p, userID, matched, now)
+}
+
+// cepEmit publishes a match as a derived event to the store's cluster
+func cepEmit(store cepStore, p *cepPattern, userID string, state *cepState, now time.Time) error {
+	hash := sha256.Sum256([]byte(p.ID + ":" + userID + ":" + strconv.FormatInt(state.StartedAt, 10)))
+	eventID := hex.EncodeToString(hash[:])
+	nowStr := now.UTC().Format(time.RFC3339)
+
+	derived := map[string]interface{}{
+		"event_id":         eventID,
+		"user_id":          userID,
+		"event_type":       "pattern_match",
+		"pattern_id":       p.ID,
+		"window_start":     time.UnixMilli(state.StartedAt).UTC().Format(time.RFC3339),
+		"timestamp":        nowStr,
+		"ingested_at":      nowStr,
+		"source_event_ids": state.EventIDs,
+		"derived":          true,
+		"service":          "ingestion",
+	}
+	jsonData, err := json.Marshal(derived)
+	if err != nil {
+		return err
+	}
+
+	if err := store.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(userID),
+		Value: jsonData,
+	}); err != nil {
+		return err
+	}
+
+	cepMatchesTotal.Inc(p.ID)
+	log.Printf("Pattern %s matched for user %s", p.ID, userID)
+	return nil
+}
@@ -0,0 +1,407 @@
+// Command audit reconciles one hour of ingestion: events the service
+// acknowledged and produced (Redis audit counters), events present in the
+// raw-events topic, and rows in the raw_events table. With RESIDENCY_FILE
+// set, it reads every region's topic and the quarantine topic instead. It prints a JSON
+// report, stores it in Redis for the service's /metrics, and exits non-zero
+// when a stage falls below -fail-below.
+//
+//	audit -hour 2026010512
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+
+	"ingestion-service/audit"
+	"ingestion-service/redisconf"
+	"ingestion-service/watermark"
+)
+
+const maxMissingIDs = 20
+
+var ctx = context.Background()
+
+// residencyFile mirrors the parts of the service's RESIDENCY_FILE that say
+// where events are produced
+type residencyFile struct {
+	Undetermined      string `json:"undetermined"`
+	QuarantineBrokers string `json:"quarantine_brokers"`
+	QuarantineTopic   string `json:"quarantine_topic"`
+	Regions           map[string]struct {
+		Brokers string `json:"brokers"`
+		Topic   string `json:"topic"`
+	} `json:"regions"`
+}
+
+// topicTarget is one Kafka topic events are produced to
+type topicTarget struct {
+	brokers string
+	topic   string
+}
+
+// kafkaCounts is what the raw-events topics hold for the audited hour
+type kafkaCounts struct {
+	ids        int64 // acknowledged event IDs, as the service counts them
+	checksum   int64
+	messages   int64 // data messages, as the processor stores them
+	sampledIDs map[string]bool
+	sampledMsg []string // sampled message event_ids, for the raw_events check
+}
+
+func main() {
+	previous := time.Now().UTC().Add(-time.Hour)
+	hour := flag.String("hour", audit.Hour(previous), "UTC hour to audit (yyyymmddhh)")
+	slack := flag.Duration("slack", 5*time.Minute, "How long after the hour events may still be produced")
+	failBelow := flag.Float64("fail-below", 0, "Exit 1 if any stage's completeness is below this")
+	flag.Parse()
+
+	start, err := audit.ParseHour(*hour)
+	if err != nil {
+		log.Fatalf("Invalid -hour %q: %v", *hour, err)
+	}
+	sampleRate, err := strconv.ParseFloat(getEnv("AUDIT_SAMPLE_RATE", "0.01"), 64)
+	if err != nil {
+		log.Fatalf("Invalid AUDIT_SAMPLE_RATE: %v", err)
+	}
+
+	redisCfg, err := redisconf.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	redisClient, err := redisCfg.NewClient()
+	if err != nil {
+		log.Fatalf("Failed to create Redis client: %v", err)
+	}
+	report := &audit.Report{
+		Hour:        *hour,
+		Routes:      make(map[string]map[string]int64),
+		Stages:      make(map[string]*audit.Stage),
+		GeneratedAt: time.Now().UTC(),
+	}
+
+	// Service counters, summed over routes
+	totals, sample, err := readCounters(redisClient, *hour, report)
+	if err != nil {
+		log.Fatalf("Failed to read audit counters: %v", err)
+	}
+	produced := audit.NewStage(totals[audit.FieldAccepted], totals[audit.FieldProduced])
+	produced.ChecksumOK = boolPtr(totals[audit.FieldAcceptedSum] == totals[audit.FieldProducedSum])
+	report.Stages["produced"] = produced
+
+	// Kafka
+	targets, err := eventTopics(getEnv("KAFKA_BROKERS", "kafka:9092"))
+	if err != nil {
+		log.Fatalf("Failed to load residency config: %v", err)
+	}
+	counts := &kafkaCounts{sampledIDs: make(map[string]bool)}
+	families := make(map[string]bool) // exploded parents already counted
+	for _, target := range targets {
+		if err := readKafka(target, start, start.Add(time.Hour), *slack, sampleRate, counts, families); err != nil {
+			log.Fatalf("Failed to read %s: %v", target.topic, err)
+		}
+	}
+	kafkaStage := audit.NewStage(totals[audit.FieldProduced], counts.ids)
+	kafkaStage.ChecksumOK = boolPtr(totals[audit.FieldProducedSum] == counts.checksum)
+	for _, id := range sample {
+		if !counts.sampledIDs[id] && len(kafkaStage.MissingIDs) < maxMissingIDs {
+			kafkaStage.MissingIDs = append(kafkaStage.MissingIDs, id)
+		}
+	}
+	report.Stages["kafka"] = kafkaStage
+
+	// raw_events
+	if dsn := getEnv("POSTGRES_DSN", ""); dsn != "" {
+		stage, err := checkRawEvents(dsn, start, counts)
+		if err != nil {
+			log.Fatalf("Failed to query raw_events: %v", err)
+		}
+		report.Stages["raw_events"] = stage
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	os.Stdout.Write(append(data, '\n'))
+
+	pipe := redisClient.Pipeline()
+	pipe.Set(ctx, audit.ReportKey(*hour), data, audit.TTL)
+	pipe.Set(ctx, audit.LatestReportKey, data, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to store report: %v", err)
+	}
+
+	for name, stage := range report.Stages {
+		if stage.Completeness < *failBelow {
+			log.Printf("Stage %s is %.4f complete (%d of %d)", name, stage.Completeness, stage.Found, stage.Expected)
+			os.Exit(1)
+		}
+	}
+}
+
+// readCounters sums the hour's counters and collects the accepted sample
+func readCounters(client redis.UniversalClient, hour string, report *audit.Report) (map[string]int64, []string, error) {
+	totals := make(map[string]int64)
+	var sample []string
+
+	for _, route := range []string{audit.RouteDirect, audit.RouteCoalesced, audit.RouteExploded} {
+		fields, err := client.HGetAll(ctx, audit.CountersKey(hour, route)).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(fields) > 0 {
+			counters := make(map[string]int64, len(fields))
+			for field, value := range fields {
+				n, _ := strconv.ParseInt(value, 10, 64)
+				counters[field] = n
+				totals[field] += n
+			}
+			report.Routes[route] = counters
+		}
+
+		ids, err := client.SMembers(ctx, audit.SampleKey(hour, route)).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		sample = append(sample, ids...)
+	}
+	sort.Strings(sample)
+	return totals, sample, nil
+}
+
+// eventTopics lists the topics accepted events are produced to: raw-events,
+// or with RESIDENCY_FILE each region's topic and the quarantine topic
+func eventTopics(brokers string) ([]topicTarget, error) {
+	path := getEnv("RESIDENCY_FILE", "")
+	if path == "" {
+		return []topicTarget{{brokers, "raw-events"}}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg residencyFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var targets []topicTarget
+	seen := make(map[topicTarget]bool)
+	add := func(target topicTarget) {
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	names := make([]string, 0, len(cfg.Regions))
+	for name := range cfg.Regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		region := cfg.Regions[name]
+		target := topicTarget{region.Brokers, region.Topic}
+		if target.brokers == "" {
+			target.brokers = brokers
+		}
+		if target.topic == "" {
+			target.topic = "raw-events"
+		}
+		add(target)
+	}
+	if cfg.Undetermined == "quarantine" {
+		target := topicTarget{cfg.QuarantineBrokers, cfg.QuarantineTopic}
+		if target.brokers == "" {
+			target.brokers = brokers
+		}
+		if target.topic == "" {
+			target.topic = "raw-events-quarantine"
+		}
+		add(target)
+	}
+	return targets, nil
+}
+
+// readKafka scans every partition of a topic from the start of the hour until
+// messages are newer than the hour plus slack, counting data messages whose
+// ingested_at falls in the hour
+func readKafka(target topicTarget, start, end time.Time, slack time.Duration, sampleRate float64,
+	counts *kafkaCounts, families map[string]bool) error {
+	client := &kafka.Client{Addr: kafka.TCP(target.brokers), Timeout: 10 * time.Second}
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{target.topic}})
+	if err != nil {
+		return err
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return fmt.Errorf("%s not found", target.topic)
+	}
+
+	var requests []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		requests = append(requests, kafka.LastOffsetOf(p.ID))
+	}
+	offsets, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{target.topic: requests},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range offsets.Topics[target.topic] {
+		if p.Error != nil {
+			return p.Error
+		}
+		if err := scanPartition(target, p.Partition, p.LastOffset, start, end, slack, sampleRate, counts, families); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanPartition(target topicTarget, partition int, last int64, start, end time.Time, slack time.Duration,
+	sampleRate float64, counts *kafkaCounts, families map[string]bool) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   strings.Split(target.brokers, ","),
+		Topic:     target.topic,
+		Partition: partition,
+		MaxBytes:  10e6,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffsetAt(ctx, start); err != nil {
+		return err
+	}
+
+	for reader.Offset() >= 0 && reader.Offset() < last {
+		readCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		msg, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if msg.Time.After(end.Add(slack)) {
+			break
+		}
+		if watermark.IsControl(msg) {
+			continue
+		}
+
+		var event struct {
+			EventID           string   `json:"event_id"`
+			ParentEventID     string   `json:"parent_event_id"`
+			IngestedAt        string   `json:"ingested_at"`
+			EventCount        int64    `json:"event_count"`
+			ChildCount        int      `json:"child_count"`
+			CoalescedEventIDs []string `json:"coalesced_event_ids"`
+		}
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			continue
+		}
+		// Derived events (e.g. from CEP) have no ingested_at and aren't audited
+		ingestedAt, err := time.Parse(time.RFC3339, event.IngestedAt)
+		if err != nil || ingestedAt.Before(start) || !ingestedAt.Before(end) {
+			continue
+		}
+
+		counts.messages++
+		if audit.Sampled(event.EventID, sampleRate) {
+			counts.sampledMsg = append(counts.sampledMsg, event.EventID)
+		}
+
+		// Count the acknowledged IDs this message delivers
+		var ids []string
+		switch {
+		case event.ParentEventID != "":
+			if !families[event.ParentEventID] {
+				ids = []string{event.ParentEventID}
+			}
+		case len(event.CoalescedEventIDs) > 0:
+			ids = event.CoalescedEventIDs
+		default:
+			ids = []string{event.EventID}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if event.ParentEventID != "" || event.ChildCount > 0 {
+			families[ids[0]] = true
+		}
+
+		n := int64(len(ids))
+		if event.EventCount > n {
+			n = event.EventCount
+		}
+		counts.ids += n
+		for _, id := range ids {
+			counts.checksum += audit.Checksum(id)
+			if audit.Sampled(id, sampleRate) {
+				counts.sampledIDs[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+// checkRawEvents compares the hour's Kafka messages with raw_events rows
+func checkRawEvents(dsn string, start time.Time, counts *kafkaCounts) (*audit.Stage, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var rows int64
+	err = db.QueryRowContext(ctx,
+		"SELECT count(*) FROM raw_events WHERE ingested_at >= $1 AND ingested_at < $2",
+		start, start.Add(time.Hour)).Scan(&rows)
+	if err != nil {
+		return nil, err
+	}
+	stage := audit.NewStage(counts.messages, rows)
+
+	if len(counts.sampledMsg) == 0 {
+		return stage, nil
+	}
+	result, err := db.QueryContext(ctx,
+		"SELECT event_id FROM raw_events WHERE event_id = ANY($1)", pq.Array(counts.sampledMsg))
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	found := make(map[string]bool)
+	for result.Next() {
+		var id string
+		if err := result.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	for _, id := range counts.sampledMsg {
+		if !found[id] && len(stage.MissingIDs) < maxMissingIDs {
+			stage.MissingIDs = append(stage.MissingIDs, id)
+		}
+	}
+	return stage, result.Err()
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
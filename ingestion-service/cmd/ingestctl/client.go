@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// contextConfig is one environment ingestctl can talk to
+type contextConfig struct {
+	URL      string `json:"url"`       // public listener, for send and health
+	AdminURL string `json:"admin_url"` // admin listener (ADMIN_ADDR)
+	Token    string `json:"token"`
+	TokenEnv string `json:"token_env"` // variable holding the token, instead of Token
+	APIKey   string `json:"api_key"`   // X-API-Key sent with test events
+}
+
+// configFile is ~/.config/ingestctl/config.json
+type configFile struct {
+	Current  string                    `json:"current"`
+	Contexts map[string]*contextConfig `json:"contexts"`
+}
+
+// defaultConfig is used without a config file: the docker-compose ports
+func defaultConfig() *configFile {
+	return &configFile{
+		Current: "dev",
+		Contexts: map[string]*contextConfig{
+			"dev": {URL: "http://localhost:8085", AdminURL: "http://localhost:8087", TokenEnv: "ADMIN_TOKEN"},
+		},
+	}
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv("INGESTCTL_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "ingestctl.json"
+	}
+	return filepath.Join(dir, "ingestctl", "config.json")
+}
+
+func loadConfig(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return defaultConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+func saveConfig(path string, cfg *configFile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// contextNames returns the configured contexts in order
+func (cfg *configFile) contextNames() []string {
+	names := make([]string, 0, len(cfg.Contexts))
+	for name := range cfg.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// client calls one context's public and admin endpoints
+type client struct {
+	name string
+	ctx  *contextConfig
+	http *http.Client
+}
+
+func newClient(name string, ctx *contextConfig) *client {
+	return &client{name: name, ctx: ctx, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *client) token() string {
+	if c.ctx.TokenEnv != "" {
+		return os.Getenv(c.ctx.TokenEnv)
+	}
+	return c.ctx.Token
+}
+
+// admin calls the admin API, decoding the JSON response into out
+func (c *client) admin(method, path string, body, out interface{}) error {
+	if c.ctx.AdminURL == "" {
+		return fmt.Errorf("context %s has no admin_url", c.name)
+	}
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.ctx.AdminURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	_, err = c.do(req, out)
+	return err
+}
+
+// public calls the public listener and returns the status code, decoding a
+// JSON response into out when there is one
+func (c *client) public(method, path string, body []byte, out interface{}) (int, error) {
+	if c.ctx.URL == "" {
+		return 0, fmt.Errorf("context %s has no url", c.name)
+	}
+	req, err := http.NewRequest(method, c.ctx.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.ctx.APIKey != "" {
+		req.Header.Set("X-API-Key", c.ctx.APIKey)
+	}
+	return c.do(req, out)
+}
+
+func (c *client) do(req *http.Request, out interface{}) (int, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(data))
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
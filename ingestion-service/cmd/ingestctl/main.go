@@ -0,0 +1,621 @@
+// Command ingestctl is the operator CLI of the ingestion service. It talks
+// to the admin API of a context (ADMIN_ADDR, authenticated with
+// ADMIN_TOKEN) and to the public listener for test events and health.
+// Lookups and purges run in the service, which knows the dedup store,
+// policies and residency regions, so ingestctl needs no Redis access.
+//
+// Contexts for dev, staging and prod are kept in
+// ~/.config/ingestctl/config.json (or INGESTCTL_CONFIG); without a file the
+// docker-compose ports on localhost are used. Every command prints a table,
+// or the API's JSON with -o json.
+//
+//	ingestctl -context staging lookup 3f2a9c...
+//	ingestctl purge -user user_42 -policy clicks
+//	ingestctl pause -reason "broker upgrade" -for 15m
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: ingestctl [-config file] [-context name] [-o table|json] <command> [flags]
+
+Commands:
+  contexts               List contexts
+  use-context <name>     Make a context the default
+  lookup <event_id>      Status record and dedup entries of an event
+  lineage <event_id>     Stages, rules, table versions and build that touched an event
+  purge                  Remove dedup entries by event ID, user or time range
+  send                   Send test events to /events
+  pause                  Pause intake on every replica
+  resume                 Resume intake
+  intake                 Show whether intake is paused
+  config                 Effective configuration of the service
+  rules                  Routes, dedup policies and loaded rules
+  health                 Service, topic and consumer health
+
+Run ingestctl <command> -h for the flags of a command.
+`
+
+var (
+	configPath  string
+	contextName string
+	jsonOutput  bool
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "Contexts file")
+	flag.StringVar(&contextName, "context", os.Getenv("INGESTCTL_CONTEXT"), "Context to use (default: the current one)")
+	output := flag.String("o", "table", "Output format, table or json")
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		log.Fatalf("-o must be table or json")
+	}
+	jsonOutput = *output == "json"
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load contexts: %v", err)
+	}
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "contexts":
+		listContexts(cfg)
+		return
+	case "use-context":
+		useContext(cfg, args)
+		return
+	}
+
+	name := contextName
+	if name == "" {
+		name = cfg.Current
+	}
+	ctx, ok := cfg.Contexts[name]
+	if !ok {
+		log.Fatalf("Unknown context %q (have %s)", name, strings.Join(cfg.contextNames(), ", "))
+	}
+	c := newClient(name, ctx)
+
+	switch command {
+	case "lookup":
+		lookup(c, args)
+	case "lineage":
+		lineage(c, args)
+	case "purge":
+		purge(c, args)
+	case "send":
+		send(c, args)
+	case "pause":
+		pause(c, args)
+	case "resume":
+		resume(c)
+	case "intake":
+		intake(c)
+	case "config":
+		showConfig(c)
+	case "rules":
+		rules(c)
+	case "health":
+		health(c)
+	default:
+		log.Printf("Unknown command %q", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// render prints v as JSON with -o json, or calls table
+func render(v interface{}, table func(w *tabwriter.Writer)) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func listContexts(cfg *configFile) {
+	render(cfg, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "CURRENT\tNAME\tURL\tADMIN URL")
+		for _, name := range cfg.contextNames() {
+			current := ""
+			if name == cfg.Current {
+				current = "*"
+			}
+			ctx := cfg.Contexts[name]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", current, name, ctx.URL, ctx.AdminURL)
+		}
+	})
+}
+
+func useContext(cfg *configFile, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: ingestctl use-context <name>")
+	}
+	if _, ok := cfg.Contexts[args[0]]; !ok {
+		log.Fatalf("Unknown context %q", args[0])
+	}
+	cfg.Current = args[0]
+	if err := saveConfig(configPath, cfg); err != nil {
+		log.Fatalf("Failed to save contexts: %v", err)
+	}
+	fmt.Printf("Switched to context %s\n", args[0])
+}
+
+func lookup(c *client, args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	region := fs.String("region", "", "Residency region holding the event")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Usage: ingestctl lookup [-region r] <event_id>")
+	}
+
+	var result struct {
+		EventID string            `json:"event_id"`
+		Status  map[string]string `json:"status"`
+		Store   string            `json:"store"`
+		Dedup   []struct {
+			Policy string `json:"policy"`
+			Seen   bool   `json:"seen"`
+			Error  string `json:"error"`
+		} `json:"dedup"`
+	}
+	query := url.Values{"event_id": {fs.Arg(0)}, "region": {*region}}
+	if err := c.admin("GET", "/admin/api/events?"+query.Encode(), nil, &result); err != nil {
+		log.Fatal(err)
+	}
+
+	render(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Event %s\n\n", result.EventID)
+		if len(result.Status) == 0 {
+			fmt.Fprintln(w, "No status record")
+		} else {
+			fmt.Fprintln(w, "FIELD\tVALUE")
+			for _, key := range sortedKeys(result.Status) {
+				fmt.Fprintf(w, "%s\t%s\n", key, result.Status[key])
+			}
+		}
+		fmt.Fprintf(w, "\nPOLICY\tSTORE\tSEEN\tERROR\n")
+		for _, d := range result.Dedup {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", d.Policy, result.Store, d.Seen, d.Error)
+		}
+	})
+}
+
+func lineage(c *client, args []string) {
+	fs := flag.NewFlagSet("lineage", flag.ExitOnError)
+	region := fs.String("region", "", "Residency region holding the event")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Usage: ingestctl lineage [-region r] <event_id>")
+	}
+
+	var result struct {
+		EventID       string `json:"event_id"`
+		CoalescedInto string `json:"coalesced_into,omitempty"`
+		Lineage       struct {
+			Build  string            `json:"build"`
+			Config string            `json:"config"`
+			Route  string            `json:"route"`
+			Stages []string          `json:"stages"`
+			Rules  []string          `json:"rules"`
+			Tables map[string]string `json:"tables"`
+		} `json:"lineage"`
+	}
+	query := url.Values{"event_id": {fs.Arg(0)}, "region": {*region}}
+	if _, err := c.public("GET", "/events/lineage?"+query.Encode(), nil, &result); err != nil {
+		log.Fatal(err)
+	}
+
+	trail := result.Lineage
+	render(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Event\t%s\n", result.EventID)
+		if result.CoalescedInto != "" {
+			fmt.Fprintf(w, "Coalesced into\t%s\n", result.CoalescedInto)
+		}
+		fmt.Fprintf(w, "Build\t%s\nConfig\t%s\nRoute\t%s\n", trail.Build, trail.Config, trail.Route)
+		fmt.Fprintf(w, "Stages\t%s\nRules\t%s\n", strings.Join(trail.Stages, " > "), strings.Join(trail.Rules, ", "))
+		for _, name := range sortedKeys(trail.Tables) {
+			fmt.Fprintf(w, "Table %s\t%s\n", name, trail.Tables[name])
+		}
+	})
+}
+
+func purge(c *client, args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	region := fs.String("region", "", "Residency region")
+	policy := fs.String("policy", "", "Only this dedup policy (default: all)")
+	eventIDs := fs.String("event-id", "", "Event IDs to forget (comma-separated)")
+	userID := fs.String("user", "", "Clear this user's near-duplicate claims (not their dedup entries)")
+	from := fs.String("from", "", "Start of the marked-time range (RFC3339)")
+	to := fs.String("to", "", "End of the marked-time range (RFC3339, default now)")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	fs.Parse(args)
+
+	req := map[string]interface{}{"region": *region, "policy": *policy, "user_id": *userID}
+	if *eventIDs != "" {
+		req["event_ids"] = strings.Split(*eventIDs, ",")
+	}
+	if *from != "" {
+		start, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			log.Fatalf("Invalid -from: %v", err)
+		}
+		end := time.Now().UTC()
+		if *to != "" {
+			if end, err = time.Parse(time.RFC3339, *to); err != nil {
+				log.Fatalf("Invalid -to: %v", err)
+			}
+		}
+		req["from"], req["to"] = start, end
+	}
+	if *eventIDs == "" && *userID == "" && *from == "" {
+		log.Fatalf("Usage: ingestctl purge [-region r] [-policy p] (-event-id ids | -user id | -from t [-to t]) [-yes]")
+	}
+	if !*yes && !confirm(fmt.Sprintf("Purge dedup entries in context %s? Matching events will be accepted again.", c.name)) {
+		log.Fatalf("Aborted")
+	}
+
+	var result struct {
+		Store               string   `json:"store"`
+		Policies            []string `json:"policies"`
+		EventIDs            int64    `json:"event_ids"`
+		RangeKeys           int64    `json:"range_keys"`
+		NearDuplicateClaims int64    `json:"near_duplicate_claims"`
+		Errors              []string `json:"errors"`
+	}
+	if err := c.admin("POST", "/admin/api/dedup/purge", req, &result); err != nil {
+		log.Fatal(err)
+	}
+	render(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Store\t%s\nPolicies\t%s\n", result.Store, strings.Join(result.Policies, ", "))
+		fmt.Fprintf(w, "Event IDs forgotten\t%d\nKeys deleted by time\t%d\nNear-duplicate claims\t%d\n",
+			result.EventIDs, result.RangeKeys, result.NearDuplicateClaims)
+		for _, e := range result.Errors {
+			fmt.Fprintf(w, "Error\t%s\n", e)
+		}
+	})
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func send(c *client, args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	count := fs.Int("n", 1, "Number of events")
+	eventType := fs.String("type", "ingestctl_test", "event_type of generated events")
+	userID := fs.String("user", "ingestctl-test", "user_id of generated events")
+	file := fs.String("file", "", "Send this JSON event instead of generated ones")
+	interval := fs.Duration("interval", 0, "Pause between events")
+	fs.Parse(args)
+
+	var template map[string]interface{}
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &template); err != nil {
+			log.Fatalf("Invalid event in %s: %v", *file, err)
+		}
+	}
+
+	type sendResult struct {
+		N        int    `json:"n"`
+		Code     int    `json:"code"`
+		Status   string `json:"status"`
+		EventID  string `json:"event_id,omitempty"`
+		Error    string `json:"error,omitempty"`
+		Duration string `json:"duration"`
+	}
+	var results []sendResult
+	failed := false
+	for i := 1; i <= *count; i++ {
+		event := template
+		if event == nil {
+			// A fresh timestamp keeps generated events distinct for dedup
+			event = map[string]interface{}{
+				"user_id":    *userID,
+				"event_type": *eventType,
+				"timestamp":  time.Now().UTC().Format(time.RFC3339Nano),
+				"source":     "ingestctl",
+				"seq":        i,
+			}
+		}
+		body, _ := json.Marshal(event)
+
+		var resp struct {
+			Status  string `json:"status"`
+			EventID string `json:"event_id"`
+		}
+		start := time.Now()
+		code, err := c.public("POST", "/events", body, &resp)
+		result := sendResult{N: i, Code: code, Status: resp.Status, EventID: resp.EventID, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+		if i < *count && *interval > 0 {
+			time.Sleep(*interval)
+		}
+	}
+
+	render(results, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "N\tCODE\tSTATUS\tEVENT ID\tTIME\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", r.N, r.Code, r.Status, r.EventID, r.Duration, r.Error)
+		}
+	})
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// intakeState is the admin API's pause state
+type intakeState struct {
+	Paused   bool       `json:"paused"`
+	Reason   string     `json:"reason,omitempty"`
+	By       string     `json:"by,omitempty"`
+	PausedAt *time.Time `json:"paused_at,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+func renderIntake(state intakeState) {
+	render(state, func(w *tabwriter.Writer) {
+		if !state.Paused {
+			fmt.Fprintln(w, "Intake is open")
+			return
+		}
+		fmt.Fprintf(w, "Intake is paused\nReason\t%s\nBy\t%s\nSince\t%s\n", state.Reason, state.By, state.PausedAt.Format(time.RFC3339))
+		if state.Until != nil {
+			fmt.Fprintf(w, "Until\t%s\n", state.Until.Format(time.RFC3339))
+		}
+	})
+}
+
+func pause(c *client, args []string) {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	reason := fs.String("reason", "", "Why intake is paused")
+	duration := fs.Duration("for", 0, "Resume automatically after this long")
+	fs.Parse(args)
+
+	req := map[string]string{"reason": *reason, "by": os.Getenv("USER")}
+	if *duration > 0 {
+		req["for"] = duration.String()
+	}
+	var state intakeState
+	if err := c.admin("POST", "/admin/api/intake/pause", req, &state); err != nil {
+		log.Fatal(err)
+	}
+	renderIntake(state)
+}
+
+func resume(c *client) {
+	var state intakeState
+	if err := c.admin("POST", "/admin/api/intake/resume", nil, &state); err != nil {
+		log.Fatal(err)
+	}
+	renderIntake(state)
+}
+
+func intake(c *client) {
+	var state intakeState
+	if err := c.admin("GET", "/admin/api/intake", nil, &state); err != nil {
+		log.Fatal(err)
+	}
+	renderIntake(state)
+}
+
+func showConfig(c *client) {
+	var result struct {
+		Settings []struct {
+			Name    string `json:"name"`
+			Value   string `json:"value"`
+			Default string `json:"default"`
+			Source  string `json:"source"`
+		} `json:"settings"`
+		Derived map[string]interface{} `json:"derived"`
+	}
+	if err := c.admin("GET", "/admin/api/config", nil, &result); err != nil {
+		log.Fatal(err)
+	}
+	render(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE\tDEFAULT")
+		for _, s := range result.Settings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Value, s.Source, s.Default)
+		}
+		fmt.Fprintln(w, "\nDERIVED\tVALUE")
+		for _, key := range sortedKeys(result.Derived) {
+			fmt.Fprintf(w, "%s\t%v\n", key, result.Derived[key])
+		}
+	})
+}
+
+func rules(c *client) {
+	var result map[string]json.RawMessage
+	if err := c.admin("GET", "/admin/api/rules", nil, &result); err != nil {
+		log.Fatal(err)
+	}
+	var routes []struct {
+		Path          string   `json:"path"`
+		DedupPolicies []string `json:"dedup_policies"`
+	}
+	var dedup struct {
+		Store    string `json:"store"`
+		Policies []struct {
+			Name            string   `json:"name"`
+			EventTypes      []string `json:"event_types"`
+			Routes          []string `json:"routes"`
+			Window          string   `json:"window"`
+			Fields          []string `json:"fields"`
+			Enabled         bool     `json:"enabled"`
+			NearDuplicateMs int      `json:"near_duplicate_ms"`
+		} `json:"policies"`
+	}
+	json.Unmarshal(result["routes"], &routes)
+	json.Unmarshal(result["dedup"], &dedup)
+
+	render(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ROUTE\tDEDUP POLICIES")
+		for _, r := range routes {
+			fmt.Fprintf(w, "%s\t%s\n", r.Path, strings.Join(r.DedupPolicies, ", "))
+		}
+
+		fmt.Fprintf(w, "\nPOLICY (%s)\tENABLED\tWINDOW\tEVENT TYPES\tROUTES\tFIELDS\tNEAR-DUP MS\n", dedup.Store)
+		for _, p := range dedup.Policies {
+			fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\t%s\t%d\n", p.Name, p.Enabled, p.Window,
+				listOrAny(p.EventTypes), listOrAny(p.Routes), strings.Join(p.Fields, ","), p.NearDuplicateMs)
+		}
+
+		// Other rule sets are shown one entry per line
+		fmt.Fprintln(w, "\nRULE SET\tENTRY")
+		for _, section := range sortedKeys(result) {
+			if section == "routes" || section == "dedup" {
+				continue
+			}
+			var entries []json.RawMessage
+			if json.Unmarshal(result[section], &entries) != nil {
+				entries = []json.RawMessage{result[section]}
+			}
+			for _, entry := range entries {
+				fmt.Fprintf(w, "%s\t%s\n", section, entry)
+			}
+		}
+	})
+}
+
+func listOrAny(values []string) string {
+	if len(values) == 0 {
+		return "*"
+	}
+	return strings.Join(values, ",")
+}
+
+func health(c *client) {
+	var service map[string]interface{}
+	_, serviceErr := c.public("GET", "/health", nil, &service)
+	readyCode, _ := c.public("GET", "/ready", nil, nil)
+
+	var topics struct {
+		Ready  bool   `json:"ready"`
+		Error  string `json:"error"`
+		Topics []struct {
+			Topic           string `json:"topic"`
+			Partitions      int    `json:"partitions"`
+			UnderReplicated int    `json:"under_replicated"`
+			Offline         int    `json:"offline"`
+			Messages        int64  `json:"messages"`
+			Error           string `json:"error"`
+		} `json:"topics"`
+		ConsumerLag []struct {
+			Group      string  `json:"group"`
+			Topic      string  `json:"topic"`
+			Lag        int64   `json:"lag"`
+			LagSeconds float64 `json:"lag_seconds"`
+			Exceeded   bool    `json:"exceeded"`
+			Error      string  `json:"error"`
+		} `json:"consumer_lag"`
+	}
+	topicsErr := c.admin("GET", "/admin/api/topics", nil, &topics)
+	var state intakeState
+	intakeErr := c.admin("GET", "/admin/api/intake", nil, &state)
+
+	var errs []string
+	for _, err := range []error{serviceErr, topicsErr, intakeErr} {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if topics.Error != "" {
+		errs = append(errs, topics.Error)
+	}
+	healthy := len(errs) == 0 && readyCode == 200
+	for _, t := range topics.Topics {
+		healthy = healthy && t.Offline == 0 && t.UnderReplicated == 0 && t.Error == ""
+	}
+
+	report := map[string]interface{}{
+		"context":    c.name,
+		"healthy":    healthy,
+		"service":    service,
+		"ready_code": readyCode,
+		"intake":     state,
+		"kafka":      topics,
+		"errors":     errs,
+	}
+	render(report, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Context\t%s\n", c.name)
+		if serviceErr != nil {
+			fmt.Fprintf(w, "Service\t%v\n", serviceErr)
+		} else {
+			fmt.Fprintf(w, "Service\t%v (redis %v, queue depth %v)\n", service["status"], service["redis"], service["queue_depth"])
+		}
+		fmt.Fprintf(w, "Ready\t%d\n", readyCode)
+		if intakeErr != nil {
+			fmt.Fprintf(w, "Intake\t%v\n", intakeErr)
+		} else if state.Paused {
+			fmt.Fprintf(w, "Intake\tpaused (%s)\n", state.Reason)
+		} else {
+			fmt.Fprintln(w, "Intake\topen")
+		}
+		if topicsErr != nil {
+			fmt.Fprintf(w, "Topics\t%v\n", topicsErr)
+			return
+		}
+		if topics.Error != "" {
+			fmt.Fprintf(w, "Kafka\t%s\n", topics.Error)
+		}
+
+		fmt.Fprintln(w, "\nTOPIC\tPARTITIONS\tUNDER-REPLICATED\tOFFLINE\tMESSAGES\tERROR")
+		for _, t := range topics.Topics {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", t.Topic, t.Partitions, t.UnderReplicated, t.Offline, t.Messages, t.Error)
+		}
+		if len(topics.ConsumerLag) > 0 {
+			fmt.Fprintln(w, "\nGROUP\tTOPIC\tLAG\tLAG SECONDS\tOVER BUDGET\tERROR")
+			for _, l := range topics.ConsumerLag {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%.1f\t%t\t%s\n", l.Group, l.Topic, l.Lag, l.LagSeconds, l.Exceeded, l.Error)
+			}
+		}
+	})
+	if !healthy {
+		os.Exit(1)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
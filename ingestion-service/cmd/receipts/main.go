@@ -0,0 +1,194 @@
+// Command receipts manages the ingestion service's receipt signing keys and
+// verifies signed receipts offline, against a saved copy of /receipts/keys.
+//
+//	receipts keygen -id 2026-10 -file receipt-keys.json
+//	receipts verify -keys published-keys.json -event event.json <receipt>
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"ingestion-service/receipt"
+)
+
+const usage = `Usage: receipts <command> [flags]
+
+Commands:
+  keygen    Generate a signing key, optionally adding it to a key file
+  verify    Verify a receipt against published keys
+
+Run receipts <command> -h for the flags of a command.
+`
+
+// keyEntry and keyFile mirror the service's RECEIPT_KEYS_FILE
+type keyEntry struct {
+	ID         string `json:"id"`
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+}
+
+type keyFile struct {
+	Current string     `json:"current"`
+	Keys    []keyEntry `json:"keys"`
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "keygen":
+		keygen(args)
+	case "verify":
+		verify(args)
+	default:
+		log.Printf("Unknown command %q", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// keygen creates a key. With -file it is added to the key file and, unless
+// -stage, made current; -drop-private keeps only the public half of the
+// other keys so retired keys can verify but no longer sign.
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := fs.String("id", "", "Key ID, e.g. the month it is introduced")
+	file := fs.String("file", "", "Key file to add the key to (created if missing)")
+	stage := fs.Bool("stage", false, "Add the key without making it current")
+	dropPrivate := fs.Bool("drop-private", false, "Remove the private halves of the other keys")
+	fs.Parse(args)
+	if *id == "" {
+		log.Fatalf("Usage: receipts keygen -id id [-file f] [-stage] [-drop-private]")
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entry := keyEntry{
+		ID:         *id,
+		PrivateKey: base64.StdEncoding.EncodeToString(private.Seed()),
+		PublicKey:  base64.StdEncoding.EncodeToString(public),
+	}
+	if *file == "" {
+		data, _ := json.MarshalIndent(entry, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	var keys keyFile
+	data, err := os.ReadFile(*file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			log.Fatalf("%s: %v", *file, err)
+		}
+	}
+	for _, k := range keys.Keys {
+		if k.ID == *id {
+			log.Fatalf("%s already has a key %s", *file, *id)
+		}
+	}
+	if !*stage || keys.Current == "" {
+		keys.Current = *id
+	}
+	if *dropPrivate {
+		for i := range keys.Keys {
+			if keys.Keys[i].ID == keys.Current {
+				continue
+			}
+			if keys.Keys[i].PrivateKey != "" && keys.Keys[i].PublicKey == "" {
+				seed, err := base64.StdEncoding.DecodeString(keys.Keys[i].PrivateKey)
+				if err != nil || len(seed) != ed25519.SeedSize {
+					log.Fatalf("Key %s: invalid private_key", keys.Keys[i].ID)
+				}
+				derived := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+				keys.Keys[i].PublicKey = base64.StdEncoding.EncodeToString(derived)
+			}
+			keys.Keys[i].PrivateKey = ""
+		}
+	}
+	keys.Keys = append([]keyEntry{entry}, keys.Keys...)
+
+	data, _ = json.MarshalIndent(keys, "", "  ")
+	if err := os.WriteFile(*file, append(data, '\n'), 0o600); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Added key %s to %s (current: %s)\n", *id, *file, keys.Current)
+}
+
+// verify checks a receipt, given as its X-Ingest-Receipt header value or as
+// JSON, and with -event that it was issued for that event body
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keysPath := fs.String("keys", "", "Saved /receipts/keys document")
+	eventPath := fs.String("event", "", "Event body the receipt was issued for")
+	fs.Parse(args)
+	if *keysPath == "" || fs.NArg() != 1 {
+		log.Fatalf("Usage: receipts verify -keys file [-event file] <receipt | ->")
+	}
+
+	data, err := os.ReadFile(*keysPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := receipt.ParseKeys(data)
+	if err != nil {
+		log.Fatalf("%s: %v", *keysPath, err)
+	}
+
+	input := fs.Arg(0)
+	if input == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		input = string(data)
+	}
+	var rec receipt.Receipt
+	if input = strings.TrimSpace(input); strings.HasPrefix(input, "{") {
+		err = json.Unmarshal([]byte(input), &rec)
+	} else {
+		rec, err = receipt.Decode(input)
+	}
+	if err != nil {
+		log.Fatalf("Invalid receipt: %v", err)
+	}
+
+	if *eventPath != "" {
+		body, readErr := os.ReadFile(*eventPath)
+		if readErr != nil {
+			log.Fatal(readErr)
+		}
+		err = rec.VerifyBody(keys, body)
+	} else {
+		err = rec.Verify(keys)
+	}
+	if err != nil {
+		log.Fatalf("INVALID: %v", err)
+	}
+	fmt.Printf("VALID: event %s received %s", rec.EventID, rec.ReceivedAt)
+	if rec.Tenant != "" {
+		fmt.Printf(" for tenant %s", rec.Tenant)
+	}
+	fmt.Printf(", signed by key %s\n", rec.KeyID)
+}
@@ -0,0 +1,431 @@
+// Command replay copies a time range of raw-events into a reprocessing topic,
+// so a fixed processor can recompute features for that period without
+// touching the live consumer group's offsets.
+//
+// Offsets for -start and -end are resolved on every partition from message
+// timestamps. Messages can be filtered by user_id and event_type, and
+// watermark control messages are dropped. Progress is checkpointed after
+// every batch, so an interrupted replay resumes where it stopped when
+// re-run with the same arguments. Delivery is at-least-once.
+//
+//	replay -start 2026-01-05T00:00:00Z -end 2026-01-05T06:00:00Z \
+//	    -event-type purchase -rate 2000 -checkpoint /tmp/replay.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"ingestion-service/watermark"
+)
+
+const batchSize = 100
+
+var ctx = context.Background()
+
+// checkpoint records the resolved range and progress of a replay
+type checkpoint struct {
+	Source     string              `json:"source"`
+	Target     string              `json:"target"`
+	Start      time.Time           `json:"start"`
+	End        time.Time           `json:"end"`
+	UserIDs    []string            `json:"user_ids,omitempty"`
+	EventTypes []string            `json:"event_types,omitempty"`
+	Partitions map[int]*rangeState `json:"partitions"`
+}
+
+// rangeState is one partition's range; Next is the first offset not yet copied
+type rangeState struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"` // exclusive
+	Next int64 `json:"next"`
+}
+
+type stats struct {
+	scanned  atomic.Int64
+	copied   atomic.Int64
+	filtered atomic.Int64
+}
+
+func main() {
+	startFlag := flag.String("start", "", "Start of the range (RFC3339, inclusive)")
+	endFlag := flag.String("end", "", "End of the range (RFC3339, exclusive)")
+	source := flag.String("source", "raw-events", "Topic to replay from")
+	target := flag.String("target", "raw-events-replay", "Topic to copy into")
+	userIDs := flag.String("user-id", "", "Only these user_ids (comma-separated)")
+	eventTypes := flag.String("event-type", "", "Only these event_types (comma-separated)")
+	rate := flag.Int("rate", 1000, "Maximum messages per second written, 0 = unlimited")
+	checkpointPath := flag.String("checkpoint", "", "Checkpoint file for resuming")
+	progressEvery := flag.Duration("progress", 10*time.Second, "Progress report interval")
+	dryRun := flag.Bool("dry-run", false, "Resolve offsets and print the plan without copying")
+	flag.Parse()
+
+	start, err := time.Parse(time.RFC3339, *startFlag)
+	if err != nil {
+		log.Fatalf("Invalid -start: %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, *endFlag)
+	if err != nil {
+		log.Fatalf("Invalid -end: %v", err)
+	}
+	if !end.After(start) {
+		log.Fatalf("-end must be after -start")
+	}
+	if *source == *target {
+		log.Fatalf("-target must differ from -source")
+	}
+	brokers := getEnv("KAFKA_BROKERS", "kafka:9092")
+
+	plan := &checkpoint{
+		Source:     *source,
+		Target:     *target,
+		Start:      start.UTC(),
+		End:        end.UTC(),
+		UserIDs:    splitList(*userIDs),
+		EventTypes: splitList(*eventTypes),
+	}
+
+	// Resume a matching checkpoint, or resolve the range afresh
+	if saved, err := loadCheckpoint(*checkpointPath); err != nil {
+		log.Fatalf("Failed to read checkpoint: %v", err)
+	} else if saved != nil {
+		if !sameReplay(saved, plan) {
+			log.Fatalf("Checkpoint %s belongs to a different replay; remove it or change -checkpoint", *checkpointPath)
+		}
+		plan = saved
+		log.Printf("Resuming from %s", *checkpointPath)
+	} else {
+		if plan.Partitions, err = resolveRanges(brokers, *source, start, end); err != nil {
+			log.Fatalf("Failed to resolve offsets: %v", err)
+		}
+	}
+
+	var total int64
+	partitions := make([]int, 0, len(plan.Partitions))
+	for p, r := range plan.Partitions {
+		partitions = append(partitions, p)
+		total += r.To - r.Next
+		log.Printf("Partition %d: offsets %d-%d, next %d", p, r.From, r.To, r.Next)
+	}
+	sort.Ints(partitions)
+	log.Printf("%d messages to scan", total)
+	if *dryRun || total == 0 {
+		return
+	}
+	if err := saveCheckpoint(*checkpointPath, plan); err != nil {
+		log.Fatalf("Failed to write checkpoint: %v", err)
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers),
+		Topic:        *target,
+		Balancer:     &kafka.Hash{}, // keeps each key's messages in order
+		BatchSize:    batchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		Compression:  kafka.Gzip,
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	var st stats
+	done := make(chan struct{})
+	go reportProgress(&st, total, *progressEvery, done)
+
+	limiter := newLimiter(*rate)
+	for _, p := range partitions {
+		if err := copyPartition(brokers, plan, p, writer, limiter, &st, *checkpointPath); err != nil {
+			close(done)
+			log.Fatalf("Partition %d failed: %v (re-run to resume)", p, err)
+		}
+	}
+	close(done)
+	log.Printf("Replay complete: %d scanned, %d copied, %d filtered", st.scanned.Load(), st.copied.Load(), st.filtered.Load())
+}
+
+// resolveRanges finds the offsets of the first messages at or after start
+// and end on every partition
+func resolveRanges(brokers, topic string, start, end time.Time) (map[int]*rangeState, error) {
+	client := &kafka.Client{Addr: kafka.TCP(brokers), Timeout: 10 * time.Second}
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+	var partitions []int
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+
+	last, err := listOffsets(client, topic, partitions, kafka.LastOffsetOf)
+	if err != nil {
+		return nil, err
+	}
+	atTime := func(t time.Time) (map[int]int64, error) {
+		offsets, err := listOffsets(client, topic, partitions, func(p int) kafka.OffsetRequest {
+			return kafka.TimeOffsetOf(p, t)
+		})
+		// No message at or after t: the range ends at the log end
+		for p, offset := range offsets {
+			if offset < 0 {
+				offsets[p] = last[p]
+			}
+		}
+		return offsets, err
+	}
+	from, err := atTime(start)
+	if err != nil {
+		return nil, err
+	}
+	to, err := atTime(end)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make(map[int]*rangeState, len(partitions))
+	for _, p := range partitions {
+		ranges[p] = &rangeState{From: from[p], To: to[p], Next: from[p]}
+	}
+	return ranges, nil
+}
+
+func listOffsets(client *kafka.Client, topic string, partitions []int, request func(int) kafka.OffsetRequest) (map[int]int64, error) {
+	requests := make([]kafka.OffsetRequest, len(partitions))
+	for i, p := range partitions {
+		requests[i] = request(p)
+	}
+	resp, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int]int64)
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+		offsets[p.Partition] = p.LastOffset
+		for offset := range p.Offsets {
+			offsets[p.Partition] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// copyPartition copies one partition's remaining range in batches,
+// checkpointing after each batch is written
+func copyPartition(brokers string, plan *checkpoint, partition int, writer *kafka.Writer,
+	limiter *limiter, st *stats, checkpointPath string) error {
+	state := plan.Partitions[partition]
+	if state.Next >= state.To {
+		return nil
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   strings.Split(brokers, ","),
+		Topic:     plan.Source,
+		Partition: partition,
+		MaxBytes:  10e6,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(state.Next); err != nil {
+		return err
+	}
+
+	users := toSet(plan.UserIDs)
+	types := toSet(plan.EventTypes)
+	batch := make([]kafka.Message, 0, batchSize)
+	flush := func(next int64) error {
+		if len(batch) > 0 {
+			if err := writer.WriteMessages(ctx, batch...); err != nil {
+				return err
+			}
+			st.copied.Add(int64(len(batch)))
+			batch = batch[:0]
+		}
+		state.Next = next
+		return saveCheckpoint(checkpointPath, plan)
+	}
+
+	for state.Next < state.To {
+		readCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		msg, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if msg.Offset >= state.To {
+			break
+		}
+		st.scanned.Add(1)
+
+		if !watermark.IsControl(msg) && matches(msg, users, types) {
+			limiter.wait()
+			batch = append(batch, kafka.Message{
+				Key:   msg.Key,
+				Value: msg.Value,
+				Headers: append(msg.Headers, kafka.Header{
+					Key:   "x-replay-source",
+					Value: []byte(plan.Source + "/" + strconv.Itoa(partition) + "/" + strconv.FormatInt(msg.Offset, 10)),
+				}),
+			})
+		} else {
+			st.filtered.Add(1)
+		}
+
+		if len(batch) == batchSize {
+			if err := flush(msg.Offset + 1); err != nil {
+				return err
+			}
+		} else {
+			state.Next = msg.Offset + 1
+		}
+	}
+	return flush(state.To)
+}
+
+// matches applies the user_id and event_type filters
+func matches(msg kafka.Message, users, types map[string]bool) bool {
+	if users == nil && types == nil {
+		return true
+	}
+	var event struct {
+		UserID    string `json:"user_id"`
+		EventType string `json:"event_type"`
+	}
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		return false
+	}
+	return (users == nil || users[event.UserID]) && (types == nil || types[event.EventType])
+}
+
+func reportProgress(st *stats, total int64, every time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	started := time.Now()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			scanned := st.scanned.Load()
+			rate := float64(scanned) / time.Since(started).Seconds()
+			eta := "unknown"
+			if rate > 0 {
+				eta = (time.Duration(float64(total-scanned)/rate) * time.Second).Round(time.Second).String()
+			}
+			log.Printf("Progress: %d/%d scanned (%.1f%%), %d copied, %d filtered, %.0f msg/s, ETA %s",
+				scanned, total, 100*float64(scanned)/float64(total), st.copied.Load(), st.filtered.Load(), rate, eta)
+		}
+	}
+}
+
+// limiter spaces writes evenly to stay under a rate
+type limiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSecond int) *limiter {
+	if perSecond <= 0 {
+		return &limiter{}
+	}
+	return &limiter{interval: time.Second / time.Duration(perSecond), next: time.Now()}
+}
+
+func (l *limiter) wait() {
+	if l.interval == 0 {
+		return
+	}
+	if d := time.Until(l.next); d > 0 {
+		time.Sleep(d)
+	}
+	l.next = l.next.Add(l.interval)
+	// Don't bank credit while idle
+	if now := time.Now(); l.next.Before(now) {
+		l.next = now
+	}
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	return &cp, json.Unmarshal(data, &cp)
+}
+
+// saveCheckpoint replaces the checkpoint atomically
+func saveCheckpoint(path string, cp *checkpoint) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sameReplay(a, b *checkpoint) bool {
+	return a.Source == b.Source && a.Target == b.Target &&
+		a.Start.Equal(b.Start) && a.End.Equal(b.End) &&
+		reflect.DeepEqual(a.UserIDs, b.UserIDs) && reflect.DeepEqual(a.EventTypes, b.EventTypes)
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
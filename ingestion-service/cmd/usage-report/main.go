@@ -0,0 +1,98 @@
+// Command usage-report exports per-tenant usage as CSV for chargeback, from
+// the usage_rollups table or, with -url, from a running service's admin
+// /admin/api/usage/report endpoint.
+//
+//	usage-report -from 2026-01-01 -to 2026-01-31 -period month > january.csv
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"ingestion-service/usage"
+)
+
+func main() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := flag.String("from", today.AddDate(0, 0, -today.Day()+1).Format(usage.DayFormat), "First day (YYYY-MM-DD)")
+	to := flag.String("to", today.Format(usage.DayFormat), "Last day, inclusive (YYYY-MM-DD)")
+	tenant := flag.String("tenant", "", "Only this tenant")
+	period := flag.String("period", "day", "Group by day or month")
+	dsn := flag.String("dsn", os.Getenv("POSTGRES_DSN"), "Postgres DSN")
+	serviceURL := flag.String("url", "", "Ingestion service admin URL (ADMIN_ADDR), used instead of Postgres")
+	token := flag.String("token", os.Getenv("ADMIN_TOKEN"), "Admin token for -url")
+	output := flag.String("o", "", "Output file (default stdout)")
+	flag.Parse()
+
+	if *period != "day" && *period != "month" {
+		log.Fatalf("-period must be day or month")
+	}
+	fromDay, err := time.Parse(usage.DayFormat, *from)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	toDay, err := time.Parse(usage.DayFormat, *to)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *serviceURL != "" {
+		query := url.Values{"from": {*from}, "to": {*to}, "tenant": {*tenant}, "period": {*period}}
+		req, err := http.NewRequest("GET", *serviceURL+"/admin/api/usage/report?"+query.Encode(), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+*token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			log.Fatalf("Report failed: %s: %s", resp.Status, body)
+		}
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *dsn == "" {
+		fmt.Fprintln(os.Stderr, "usage-report needs -dsn (or POSTGRES_DSN) or -url")
+		os.Exit(2)
+	}
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := usage.Query(context.Background(), db, fromDay, toDay, *tenant, *period == "month")
+	if err != nil {
+		log.Fatalf("Query failed: %v", err)
+	}
+	if err := usage.WriteCSV(out, rows); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Coalescing merges rapid-fire events of the same user and event_type into
+// one event carrying event_count and first/last timestamps. Only event types
+// with a rule are held back, and exact types (purchases) never are.
+
+// Most members one group holds. Every member ID is kept for dedup marking
+// and the watermark's in-flight set, so a group is released once full even
+// without max_count.
+const coalesceMaxMembers = 100
+
+// Event types that must always be delivered one-for-one
+var defaultExactEventTypes = []string{"purchase"}
+
+var (
+	coalesceRules   map[string]*coalesceRule
+	coalesceMu      sync.Mutex
+	coalescePending = make(map[string]*coalesceGroup)
+
+	coalesceMergedTotal  = newCounterVec("coalesce_events_merged_total", "Events folded into an earlier event", "event_type")
+	coalesceFlushedTotal = newCounterVec("coalesce_groups_flushed_total", "Coalesced events released to the queue", "event_type")
+	coalescePendingGauge = newGaugeVec("coalesce_pending_groups", "Groups currently held in a coalescing window")
+)
+
+// coalesceConfig is loaded from COALESCE_RULES_FILE
+type coalesceConfig struct {
+	ExactEventTypes []string        `json:"exact_event_types"`
+	Rules           []*coalesceRule `json:"rules"`
+}
+
+type coalesceRule struct {
+	EventType string `json:"event_type"`
+	Window    string `json:"window"`
+	MaxCount  int    `json:"max_count"` // flush early once this many merged, 0 = coalesceMaxMembers
+
+	window time.Duration
+}
+
+// coalesceGroup is the pending merged event for one user and event_type
+type coalesceGroup struct {
+	event    map[string]interface{}
+	rule     *coalesceRule
+	count    int
+	first    time.Time
+	last     time.Time
+	eventIDs []string
+	accepted []string // ingested_at of each member, by eventIDs
+	deadline time.Time
+	bytes    int64         // queue charge of the first event
+	trail    *eventLineage // lineage of the first event
+}
+
+func initCoalescing() {
+	path := getEnv("COALESCE_RULES_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var cfg coalesceConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		log.Fatalf("Failed to load coalescing rules from %s: %v", path, err)
+	}
+
+	exact := make(map[string]bool)
+	for _, t := range append(defaultExactEventTypes, cfg.ExactEventTypes...) {
+		exact[t] = true
+	}
+
+	rules := make(map[string]*coalesceRule)
+	for _, rule := range cfg.Rules {
+		if exact[rule.EventType] {
+			log.Printf("Ignoring coalescing rule for exact event type %q", rule.EventType)
+			continue
+		}
+		window, err := time.ParseDuration(rule.Window)
+		if err != nil || window <= 0 {
+			log.Fatalf("Invalid coalescing window %q for %q", rule.Window, rule.EventType)
+		}
+		rule.window = window
+		if rule.MaxCount <= 0 || rule.MaxCount > coalesceMaxMembers {
+			rule.MaxCount = coalesceMaxMembers
+		}
+		rules[rule.EventType] = rule
+	}
+
+	if len(rules) > 0 {
+		coalesceRules = rules
+		log.Printf("Coalescing enabled for %d event types", len(rules))
+	}
+}
+
+// coalesceAdd holds an event in its coalescing window. It returns false when
+// the event is not eligible and should be queued as usual, and errQueueFull
+// when it would start a group the queue's byte budget has no room for.
+func coalesceAdd(event map[string]interface{}, size int64, trail *eventLineage) (bool, error) {
+	eventType := eventString(event, "event_type")
+	userID := eventString(event, "user_id")
+	rule, ok := coalesceRules[eventType]
+	if !ok || userID == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	ts := eventTime(event, now)
+	eventID := eventString(event, "event_id")
+	key := userID + "\x00" + eventType
+
+	coalesceMu.Lock()
+	group, exists := coalescePending[key]
+	if !exists {
+		// A group is charged when it starts, since its flush cannot be refused
+		if !reserveQueue(size) {
+			coalesceMu.Unlock()
+			return false, errQueueFull
+		}
+		// The group keeps its own copy: the flush adds fields from another
+		// goroutine while the first member's handler may still read its map
+		coalescePending[key] = &coalesceGroup{
+			event:    maps.Clone(event),
+			rule:     rule,
+			count:    1,
+			first:    ts,
+			last:     ts,
+			eventIDs: []string{eventID},
+			accepted: []string{eventString(event, "ingested_at")},
+			deadline: now.Add(rule.window),
+			bytes:    size,
+			trail:    trail,
+		}
+		coalesceMu.Unlock()
+		return true, nil
+	}
+
+	for _, id := range group.eventIDs {
+		if id == eventID {
+			// Client retry of an event already in the window
+			coalesceMu.Unlock()
+			return true, nil
+		}
+	}
+	group.count++
+	if ts.Before(group.first) {
+		group.first = ts
+	}
+	if ts.After(group.last) {
+		group.last = ts
+	}
+	group.eventIDs = append(group.eventIDs, eventID)
+	group.accepted = append(group.accepted, eventString(event, "ingested_at"))
+	full := group.count >= rule.MaxCount
+	if full {
+		delete(coalescePending, key)
+	}
+	coalesceMu.Unlock()
+
+	coalesceMergedTotal.Inc(eventType)
+	if full {
+		coalesceFlush(group)
+	}
+	return true, nil
+}
+
+// coalesceLoop releases groups whose window has elapsed
+func coalesceLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var due []*coalesceGroup
+
+		coalesceMu.Lock()
+		for key, group := range coalescePending {
+			if !now.Before(group.deadline) {
+				due = append(due, group)
+				delete(coalescePending, key)
+			}
+		}
+		coalescePendingGauge.Set(float64(len(coalescePending)))
+		coalesceMu.Unlock()
+
+		for _, group := range due {
+			coalesceFlush(group)
+		}
+	}
+}
+
+// coalesceFlush queues the merged event, blocking if the queue is full since
+// every member has already been acknowledged to its client
+func coalesceFlush(group *coalesceGroup) {
+	event := group.event
+	event["event_count"] = group.count
+	event["first_timestamp"] = group.first.Format(time.RFC3339Nano)
+	event["last_timestamp"] = group.last.Format(time.RFC3339Nano)
+	if group.count > 1 {
+		event["coalesced_event_ids"] = group.eventIDs
+	}
+
+	group.trail.add("coalesce", group.rule.EventType)
+
+	coalesceFlushedTotal.Inc(group.rule.EventType)
+	enqueue(queuedBatch{events: []map[string]interface{}{event}, bytes: group.bytes, lineage: group.trail, accepted: group.accepted})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configSetting is one setting as the service resolved it, for the admin
+// config API
+type configSetting struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	Source  string `json:"source"` // env or default
+}
+
+var (
+	configMu       sync.Mutex
+	configSettings = make(map[string]configSetting)
+)
+
+// Settings whose values are never shown
+var secretSettings = []string{"PASSWORD", "TOKEN", "SECRET", "DSN"}
+
+// recordSetting remembers the value a setting resolved to
+func recordSetting(key string, value, fallback interface{}, fromEnv bool) {
+	s := configSetting{Name: key, Value: fmt.Sprint(value), Default: fmt.Sprint(fallback), Source: "default"}
+	if fromEnv {
+		s.Source = "env"
+	}
+	for _, secret := range secretSettings {
+		if strings.Contains(key, secret) && s.Value != "" {
+			s.Value = "<redacted>"
+		}
+	}
+	configMu.Lock()
+	configSettings[key] = s
+	configMu.Unlock()
+}
+
+// effectiveConfig lists every setting read so far, by name
+func effectiveConfig() []configSetting {
+	configMu.Lock()
+	defer configMu.Unlock()
+	out := make([]configSetting, 0, len(configSettings))
+	for _, s := range configSettings {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// getEnv returns the value of an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		recordSetting(key, value, fallback, true)
+		return value
+	}
+	recordSetting(key, fallback, fallback, false)
+	return fallback
+}
+
+// getEnvInt parses an integer environment variable, falling back on error
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		recordSetting(key, value, fallback, true)
+		return value
+	}
+	recordSetting(key, fallback, fallback, false)
+	return fallback
+}
+
+// getEnvBool parses a boolean environment variable, falling back on error
+func getEnvBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		recordSetting(key, value, fallback, true)
+		return value
+	}
+	recordSetting(key, fallback, fallback, false)
+	return fallback
+}
+
+// getEnvDuration parses a Go duration ("500ms", "30m"), falling back on error
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		recordSetting(key, value, fallback, true)
+		return value
+	}
+	recordSetting(key, fallback, fallback, false)
+	return fallback
+}
+
+// loadJSONFile decodes a JSON config file into v
+func loadJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Operator controls on the admin port, used by cmd/ingestctl: pausing and
+// resuming intake, the effective configuration, loaded routes and rules,
+// event lookups, dedup purges and topic health.
+//
+// A pause is stored in Redis so every replica behind the load balancer
+// stops accepting events, not just the one that served the request. Each
+// replica re-reads it every INTAKE_POLL_INTERVAL.
+
+const intakePauseKey = "admin:intake_paused"
+
+var (
+	intakePause atomic.Pointer[intakeState]
+
+	intakePausedTotal = newCounterVec("intake_paused_requests_total", "Events rejected while intake was paused")
+)
+
+// intakeState is a pause as stored in Redis
+type intakeState struct {
+	Paused   bool       `json:"paused"`
+	Reason   string     `json:"reason,omitempty"`
+	By       string     `json:"by,omitempty"`
+	PausedAt time.Time  `json:"paused_at"`
+	Until    *time.Time `json:"until,omitempty"` // nil = until resumed
+}
+
+// purgeRequest selects dedup entries to remove. Event IDs and the time range
+// apply to the content-hash stores; a user ID clears that user's
+// near-duplicate claims, which are the only dedup keys carrying a user. The
+// user's dedup entries stay and have to be purged by event ID or time range.
+type purgeRequest struct {
+	Region   string    `json:"region"`
+	Policy   string    `json:"policy"` // empty = every enabled policy
+	EventIDs []string  `json:"event_ids"`
+	UserID   string    `json:"user_id"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+type purgeResult struct {
+	Store               string   `json:"store"`
+	Policies            []string `json:"policies"`
+	EventIDs            int64    `json:"event_ids"`
+	RangeKeys           int64    `json:"range_keys"`
+	NearDuplicateClaims int64    `json:"near_duplicate_claims"`
+	Errors              []string `json:"errors,omitempty"`
+}
+
+func initControl() {
+	adminMux.Handle("/admin/api/intake", requireAdmin(http.HandlerFunc(adminIntakeHandler)))
+	adminMux.Handle("/admin/api/intake/pause", requireAdmin(http.HandlerFunc(adminPauseHandler)))
+	adminMux.Handle("/admin/api/intake/resume", requireAdmin(http.HandlerFunc(adminResumeHandler)))
+	adminMux.Handle("/admin/api/config", requireAdmin(http.HandlerFunc(adminConfigHandler)))
+	adminMux.Handle("/admin/api/rules", requireAdmin(http.HandlerFunc(adminRulesHandler)))
+	adminMux.Handle("/admin/api/events", requireAdmin(http.HandlerFunc(adminEventHandler)))
+	adminMux.Handle("/admin/api/dedup/purge", requireAdmin(http.HandlerFunc(adminPurgeHandler)))
+	adminMux.Handle("/admin/api/topics", requireAdmin(http.HandlerFunc(adminTopicsHandler)))
+	adminMux.Handle("/admin/api/usage/report", requireAdmin(http.HandlerFunc(adminUsageReportHandler)))
+}
+
+// intakePaused reports whether /events should refuse events
+func intakePaused() bool {
+	state := intakePause.Load()
+	return state != nil && (state.Until == nil || time.Now().Before(*state.Until))
+}
+
+// intakeLoop picks up pauses and resumes made through any replica
+func intakeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state, err := readIntakeState()
+		if err != nil {
+			log.Printf("Failed to read intake state: %v", err)
+			continue
+		}
+		intakePause.Store(state)
+	}
+}
+
+// readIntakeState returns the stored pause, or nil while intake is open
+func readIntakeState() (*intakeState, error) {
+	data, err := redisClient.Get(ctx, intakePauseKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state intakeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func adminIntakeHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := readIntakeState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if state == nil {
+		writeAdminJSON(w, map[string]bool{"paused": false})
+		return
+	}
+	writeAdminJSON(w, state)
+}
+
+// adminPauseHandler pauses intake on every replica, optionally for a
+// limited time ({"reason": ..., "by": ..., "for": "15m"})
+func adminPauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		By     string `json:"by"`
+		For    string `json:"for"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	state := &intakeState{Paused: true, Reason: req.Reason, By: req.By, PausedAt: time.Now().UTC()}
+	var ttl time.Duration
+	if req.For != "" {
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid for duration", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+		until := state.PausedAt.Add(d)
+		state.Until = &until
+	}
+	data, _ := json.Marshal(state)
+	if err := redisClient.Set(ctx, intakePauseKey, data, ttl).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	intakePause.Store(state)
+	log.Printf("Intake paused by %q: %s", req.By, req.Reason)
+	writeAdminJSON(w, state)
+}
+
+func adminResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := redisClient.Del(ctx, intakePauseKey).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	intakePause.Store(nil)
+	log.Printf("Intake resumed")
+	writeAdminJSON(w, map[string]bool{"paused": false})
+}
+
+// adminConfigHandler lists every setting the service read, with secrets
+// redacted, and what was derived from them
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, map[string]interface{}{
+		"settings": effectiveConfig(),
+		"derived": map[string]interface{}{
+			"build":              buildVersion,
+			"config_version":     configVersion,
+			"workers":            workerPool,
+			"queue_max_events":   queueSize,
+			"queue_budget_bytes": queueBudget,
+			"memory_limit_bytes": memoryLimitBytes,
+			"dedup_store":        dedup.Name(),
+			"redis_mode":         redisConfig.Mode,
+			"redis_addrs":        redisConfig.Addrs,
+			"redis_tls":          redisConfig.TLS,
+			"redis_hash_tags":    redisConfig.HashTags,
+			"receipt_key":        receiptKeys.currentID(),
+		},
+	})
+}
+
+// adminRulesHandler shows the public routes with the dedup policies that
+// can apply to them, and every loaded rule set
+func adminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	type policyView struct {
+		Name                string   `json:"name"`
+		EventTypes          []string `json:"event_types,omitempty"`
+		Routes              []string `json:"routes,omitempty"`
+		Window              string   `json:"window"`
+		Bucket              string   `json:"bucket"`
+		ExpectedEntries     int64    `json:"expected_entries,omitempty"`
+		FalsePositiveRate   float64  `json:"false_positive_rate,omitempty"`
+		BloomBits           uint64   `json:"bloom_bits,omitempty"`
+		BloomHashes         int      `json:"bloom_hashes,omitempty"`
+		Fields              []string `json:"fields,omitempty"`
+		Enabled             bool     `json:"enabled"`
+		NearDuplicateMs     int      `json:"near_duplicate_ms,omitempty"`
+		NearDuplicateFields []string `json:"near_duplicate_fields,omitempty"`
+	}
+	type routeView struct {
+		Path          string   `json:"path"`
+		DedupPolicies []string `json:"dedup_policies,omitempty"`
+	}
+	type tenantView struct {
+		ID      string       `json:"id"`
+		Name    string       `json:"name"`
+		APIKeys int          `json:"api_keys"`
+		Quotas  tenantQuotas `json:"quotas"`
+		Policy  string       `json:"policy"`
+		Region  string       `json:"region,omitempty"`
+	}
+
+	var policies []policyView
+	for _, p := range dedupPolicyList() {
+		policies = append(policies, policyView{
+			Name:                p.Name,
+			EventTypes:          p.EventTypes,
+			Routes:              p.Routes,
+			Window:              p.window.String(),
+			Bucket:              p.bucket.String(),
+			ExpectedEntries:     p.ExpectedEntries,
+			FalsePositiveRate:   p.FalsePositiveRate,
+			BloomBits:           p.bloomBits,
+			BloomHashes:         p.bloomHashes,
+			Fields:              p.Fields,
+			Enabled:             p.enabled,
+			NearDuplicateMs:     p.NearDuplicateMs,
+			NearDuplicateFields: p.NearDuplicateFields,
+		})
+	}
+
+	var routes []routeView
+	for _, path := range publicRoutes {
+		route := routeView{Path: path}
+		if path == "/events" {
+			for _, p := range dedupPolicyList() {
+				if matchesAny(p.Routes, path) {
+					route.DedupPolicies = append(route.DedupPolicies, p.Name)
+				}
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	rules := map[string]interface{}{
+		"routes": routes,
+		"dedup":  map[string]interface{}{"store": dedup.Name(), "policies": policies},
+	}
+	if coalesceRules != nil {
+		list := make([]*coalesceRule, 0, len(coalesceRules))
+		for _, rule := range coalesceRules {
+			list = append(list, rule)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].EventType < list[j].EventType })
+		rules["coalesce"] = list
+	}
+	if explodeRules != nil {
+		list := make([]*explodeRule, 0, len(explodeRules))
+		for _, rule := range explodeRules {
+			list = append(list, rule)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].EventType < list[j].EventType })
+		rules["explode"] = list
+	}
+	if len(cepPatterns) > 0 {
+		rules["cep_patterns"] = cepPatterns
+	}
+	if len(lookupTables) > 0 {
+		rules["lookup_tables"] = lookupTables
+	}
+	if residencyEnabled {
+		rules["residency"] = residencyCfg
+	}
+	if tenantsByID != nil {
+		var list []tenantView
+		for _, t := range tenantsByID {
+			list = append(list, tenantView{ID: t.ID, Name: t.Name, APIKeys: len(t.APIKeys), Quotas: t.Quotas, Policy: t.Policy, Region: t.Region})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		rules["tenants"] = list
+	}
+	writeAdminJSON(w, rules)
+}
+
+// adminRegionRedis resolves ?region= to a Redis client, rejecting unknown
+// regions instead of falling back to the default
+func adminRegionRedis(region string) (redis.UniversalClient, string, bool) {
+	if region == "" {
+		return redisClient, "", true
+	}
+	if _, ok := residencyRegions[region]; !ok {
+		return nil, "", false
+	}
+	client, prefix := regionRedis(map[string]interface{}{"residency_region": region})
+	return client, prefix, true
+}
+
+// adminEventHandler returns an event's status record and whether each
+// enabled dedup policy has it marked
+func adminEventHandler(w http.ResponseWriter, r *http.Request) {
+	eventID := r.URL.Query().Get("event_id")
+	if eventID == "" {
+		http.Error(w, "event_id is required", http.StatusBadRequest)
+		return
+	}
+	client, prefix, ok := adminRegionRedis(r.URL.Query().Get("region"))
+	if !ok {
+		http.Error(w, "Unknown region", http.StatusBadRequest)
+		return
+	}
+
+	status, err := client.HGetAll(ctx, prefix+statusPrefix+eventID).Result()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	type dedupEntry struct {
+		Policy string `json:"policy"`
+		Seen   bool   `json:"seen"`
+		Error  string `json:"error,omitempty"`
+	}
+	var entries []dedupEntry
+	now := time.Now()
+	for _, p := range dedupPolicyList() {
+		if !p.enabled {
+			continue
+		}
+		seen, err := dedup.Seen(client, prefix, p, eventID, now)
+		entry := dedupEntry{Policy: p.Name, Seen: seen}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entries = append(entries, entry)
+	}
+
+	writeAdminJSON(w, map[string]interface{}{
+		"event_id": eventID,
+		"status":   status,
+		"store":    dedup.Name(),
+		"dedup":    entries,
+	})
+}
+
+// adminPurgeHandler removes dedup entries so matching events are accepted
+// again
+func adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	hasRange := !req.From.IsZero() || !req.To.IsZero()
+	if hasRange && (req.From.IsZero() || req.To.IsZero() || !req.To.After(req.From)) {
+		http.Error(w, "from and to must both be set, with to after from", http.StatusBadRequest)
+		return
+	}
+	if len(req.EventIDs) == 0 && req.UserID == "" && !hasRange {
+		http.Error(w, "One of event_ids, user_id or from/to is required", http.StatusBadRequest)
+		return
+	}
+	client, prefix, ok := adminRegionRedis(req.Region)
+	if !ok {
+		http.Error(w, "Unknown region", http.StatusBadRequest)
+		return
+	}
+
+	var policies []*dedupPolicy
+	for _, p := range dedupPolicyList() {
+		if req.Policy == "" || req.Policy == p.Name {
+			policies = append(policies, p)
+		}
+	}
+	if len(policies) == 0 {
+		http.Error(w, "Unknown policy", http.StatusBadRequest)
+		return
+	}
+
+	result := &purgeResult{Store: dedup.Name()}
+	fail := func(err error) { result.Errors = append(result.Errors, err.Error()) }
+	now := time.Now()
+	for _, p := range policies {
+		result.Policies = append(result.Policies, p.Name)
+		if len(req.EventIDs) > 0 {
+			n, err := dedup.Forget(client, prefix, p, req.EventIDs, now)
+			result.EventIDs += n
+			if err != nil {
+				fail(err)
+			}
+		}
+		if hasRange {
+			n, err := dedup.Purge(client, prefix, p, req.From, req.To, now)
+			result.RangeKeys += n
+			if err != nil {
+				fail(err)
+			}
+		}
+		if req.UserID != "" {
+			pattern := prefix + "near:" + escapeGlob(p.Name) + ":" + escapeGlob(redisConfig.Tag(req.UserID)) + ":*"
+			keys, err := scanClientKeys(client, pattern)
+			if err != nil {
+				fail(err)
+			}
+			n, err := deleteKeys(client, keys)
+			result.NearDuplicateClaims += n
+			if err != nil {
+				fail(err)
+			}
+		}
+	}
+	// Shadow keys of sampled IDs would otherwise report false positives
+	if len(req.EventIDs) > 0 && dedup.Name() != "keys" {
+		keys := make([]string, 0, len(req.EventIDs))
+		for _, id := range req.EventIDs {
+			keys = append(keys, prefix+"dedup:exact:"+id)
+		}
+		if _, err := deleteKeys(client, keys); err != nil {
+			fail(err)
+		}
+	}
+
+	log.Printf("Dedup purge in region %q: %d event IDs, %d range keys, %d near-duplicate claims",
+		req.Region, result.EventIDs, result.RangeKeys, result.NearDuplicateClaims)
+	writeAdminJSON(w, result)
+}
+
+// escapeGlob escapes SCAN pattern characters in a key part
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// adminTopicsHandler reports partition health and offsets of the topics the
+// service produces to on KAFKA_BROKERS, with consumer lag
+func adminTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	type topicHealth struct {
+		Topic           string `json:"topic"`
+		Partitions      int    `json:"partitions"`
+		UnderReplicated int    `json:"under_replicated"`
+		Offline         int    `json:"offline"`
+		Messages        int64  `json:"messages"` // retained
+		Error           string `json:"error,omitempty"`
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(topic string) {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			names = append(names, topic)
+		}
+	}
+	add(kafkaWriter.Topic)
+	for _, writer := range []*kafka.Writer{cepWriter, anomalyWriter} {
+		if writer != nil {
+			add(writer.Topic)
+		}
+	}
+	for _, target := range lagTargets {
+		add(target.topic)
+	}
+	add(dlqTopic)
+
+	response := map[string]interface{}{"ready": !lagExceeded()}
+	if lagClient != nil {
+		response["consumer_lag"] = lagSnapshot()
+	}
+	meta, err := adminKafka.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		response["error"] = err.Error()
+		writeAdminJSON(w, response)
+		return
+	}
+
+	requests := make(map[string][]kafka.OffsetRequest)
+	for _, t := range meta.Topics {
+		for _, p := range t.Partitions {
+			requests[t.Name] = append(requests[t.Name], kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+		}
+	}
+	offsets, err := adminKafka.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: requests})
+	if err != nil {
+		response["error"] = err.Error()
+	}
+
+	topics := make([]topicHealth, 0, len(meta.Topics))
+	for _, t := range meta.Topics {
+		health := topicHealth{Topic: t.Name, Partitions: len(t.Partitions)}
+		if t.Error != nil {
+			health.Error = t.Error.Error()
+		}
+		for _, p := range t.Partitions {
+			if p.Error != nil || p.Leader.Host == "" {
+				health.Offline++
+			} else if len(p.Isr) < len(p.Replicas) {
+				health.UnderReplicated++
+			}
+		}
+		if offsets != nil {
+			for _, p := range offsets.Topics[t.Name] {
+				if p.Error == nil && p.LastOffset > p.FirstOffset {
+					health.Messages += p.LastOffset - p.FirstOffset
+				}
+			}
+		}
+		topics = append(topics, health)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	response["topics"] = topics
+	writeAdminJSON(w, response)
+}
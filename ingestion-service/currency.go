@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Currency normalisation validates amount/currency on purchase-type events
+// against ISO 4217 and converts the amount to BASE_CURRENCY with the rate
+// effective at event time. Rates come from a local CSV that is reloaded
+// when it changes:
+//
+//	effective_from,currency,rate
+//	2026-01-01,EUR,1.0850
+//
+// where rate is units of the base currency per one unit of currency.
+
+// ISO 4217 codes and their minor units
+var iso4217 = map[string]int{
+	"AED": 2, "ARS": 2, "AUD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BRL": 2,
+	"CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2, "COP": 2, "CZK": 2, "DKK": 2,
+	"EGP": 2, "EUR": 2, "GBP": 2, "GHS": 2, "HKD": 2, "HUF": 2, "IDR": 2,
+	"ILS": 2, "INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KES": 2, "KRW": 0,
+	"KWD": 3, "LKR": 2, "MAD": 2, "MXN": 2, "MYR": 2, "NGN": 2, "NOK": 2,
+	"NZD": 2, "OMR": 3, "PEN": 2, "PHP": 2, "PKR": 2, "PLN": 2, "QAR": 2,
+	"RON": 2, "RSD": 2, "RUB": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TND": 3, "TRY": 2, "TWD": 2, "UAH": 2, "UGX": 0, "USD": 2, "UYU": 2,
+	"VND": 0, "XAF": 0, "XOF": 0, "ZAR": 2,
+}
+
+var (
+	currencyEventTypes map[string]bool
+	baseCurrency       string
+	fxRates            = &fxTable{}
+
+	errInvalidCurrency = errors.New("invalid currency")
+	errInvalidAmount   = errors.New("invalid amount")
+	errNoRate          = errors.New("no exchange rate")
+
+	currencyNormalizedTotal = newCounterVec("currency_normalized_total", "Purchase amounts converted to the base currency", "currency")
+	currencyRejectedTotal   = newCounterVec("currency_rejected_total", "Purchase events rejected during normalisation", "reason")
+)
+
+// fxRate is one row of the rate table
+type fxRate struct {
+	effective time.Time
+	rate      float64
+}
+
+// fxTable holds rates per currency sorted by effective time
+type fxTable struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	version string
+	rates   map[string][]fxRate
+}
+
+func initCurrency() {
+	path := getEnv("FX_RATES_FILE", "")
+	if path == "" {
+		return
+	}
+
+	baseCurrency = strings.ToUpper(getEnv("BASE_CURRENCY", "USD"))
+	if _, ok := iso4217[baseCurrency]; !ok {
+		log.Fatalf("BASE_CURRENCY %q is not an ISO 4217 code", baseCurrency)
+	}
+
+	currencyEventTypes = make(map[string]bool)
+	for _, t := range strings.Split(getEnv("CURRENCY_EVENT_TYPES", "purchase"), ",") {
+		currencyEventTypes[strings.TrimSpace(t)] = true
+	}
+
+	fxRates.path = path
+	if err := fxRates.reload(); err != nil {
+		log.Fatalf("Failed to load exchange rates from %s: %v", path, err)
+	}
+	go fxRates.refreshLoop(getEnvDuration("FX_RELOAD_INTERVAL", 5*time.Minute))
+	log.Printf("Currency normalisation enabled (base %s)", baseCurrency)
+}
+
+// reload re-reads the rate table if the file changed
+func (t *fxTable) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	unchanged := info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	reader := csv.NewReader(io.TeeReader(f, hash))
+	rates := make(map[string][]fxRate)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 || record[0] == "effective_from" {
+			continue
+		}
+
+		effective, err := parseEffectiveTime(record[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		code := strings.ToUpper(strings.TrimSpace(record[1]))
+		if _, ok := iso4217[code]; !ok {
+			return fmt.Errorf("line %d: unknown currency %q", line, record[1])
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("line %d: invalid rate %q", line, record[2])
+		}
+		rates[code] = append(rates[code], fxRate{effective: effective, rate: rate})
+	}
+	for _, series := range rates {
+		sort.Slice(series, func(i, j int) bool { return series[i].effective.Before(series[j].effective) })
+	}
+
+	t.mu.Lock()
+	t.rates = rates
+	t.modTime = info.ModTime()
+	t.version = hex.EncodeToString(hash.Sum(nil))[:12]
+	t.mu.Unlock()
+	log.Printf("Loaded exchange rates for %d currencies (version %s)", len(rates), t.version)
+	return nil
+}
+
+func parseEffectiveTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func (t *fxTable) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := t.reload(); err != nil {
+			log.Printf("Failed to reload exchange rates: %v", err)
+		}
+	}
+}
+
+// Version identifies the loaded rate table contents
+func (t *fxTable) Version() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version
+}
+
+// rateAt returns the latest rate effective at or before the given time
+func (t *fxTable) rateAt(code string, at time.Time) (fxRate, bool) {
+	if code == baseCurrency {
+		return fxRate{rate: 1}, true
+	}
+
+	t.mu.RLock()
+	series := t.rates[code]
+	t.mu.RUnlock()
+
+	i := sort.Search(len(series), func(i int) bool { return series[i].effective.After(at) })
+	if i == 0 {
+		return fxRate{}, false
+	}
+	return series[i-1], true
+}
+
+// parseAmount accepts JSON numbers and numeric strings
+func parseAmount(value interface{}) (float64, bool) {
+	var amount float64
+	switch v := value.(type) {
+	case float64:
+		amount = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false
+		}
+		amount = parsed
+	default:
+		return 0, false
+	}
+	return amount, !math.IsNaN(amount) && !math.IsInf(amount, 0)
+}
+
+func roundMinor(amount float64, minorUnits int) float64 {
+	scale := math.Pow10(minorUnits)
+	return math.Round(amount*scale) / scale
+}
+
+// normalizeCurrency validates and converts the amount on purchase-type
+// events. Events without amount and currency are left untouched.
+func normalizeCurrency(event map[string]interface{}, now time.Time) error {
+	if !currencyEventTypes[eventString(event, "event_type")] {
+		return nil
+	}
+	rawAmount, hasAmount := event["amount"]
+	rawCurrency, hasCurrency := event["currency"]
+	if !hasAmount && !hasCurrency {
+		return nil
+	}
+
+	code, _ := rawCurrency.(string)
+	code = strings.ToUpper(strings.TrimSpace(code))
+	minorUnits, ok := iso4217[code]
+	if !ok {
+		currencyRejectedTotal.Inc("currency")
+		return fmt.Errorf("%w %v", errInvalidCurrency, rawCurrency)
+	}
+	amount, ok := parseAmount(rawAmount)
+	if !ok {
+		currencyRejectedTotal.Inc("amount")
+		return fmt.Errorf("%w %v", errInvalidAmount, rawAmount)
+	}
+	// Refunds are not sent through this path
+	if amount < 0 {
+		currencyRejectedTotal.Inc("negative")
+		return fmt.Errorf("%w %v: negative", errInvalidAmount, rawAmount)
+	}
+
+	at := eventTime(event, now)
+	rate, ok := fxRates.rateAt(code, at)
+	if !ok {
+		currencyRejectedTotal.Inc("rate")
+		return fmt.Errorf("%w for %s at %s", errNoRate, code, at.Format(time.RFC3339))
+	}
+
+	event["original_amount"] = rawAmount
+	event["original_currency"] = rawCurrency
+	event["amount"] = roundMinor(amount, minorUnits)
+	event["currency"] = code
+	event["amount_base"] = roundMinor(amount*rate.rate, iso4217[baseCurrency])
+	event["base_currency"] = baseCurrency
+	event["fx_rate"] = rate.rate
+	if !rate.effective.IsZero() {
+		event["fx_rate_effective"] = rate.effective.UTC().Format(time.RFC3339)
+	}
+
+	currencyNormalizedTotal.Inc(code)
+	return nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Dedup storage records which event IDs have been produced so client retries
+// can be answered with "duplicate". DEDUP_STORE picks the structure:
+//
+//	keys        - one event:<policy>:<id> key per event, exact, ~100 bytes each
+//	fingerprint - per-bucket sets of 32-bit fingerprints, sharded so each set
+//	              stays small enough for Redis' intset encoding (~4 bytes each)
+//	bloom       - one fixed-size Bloom filter bitmap per bucket
+//
+// The time-bucketed stores write to the bucket of the mark time and check
+// every bucket overlapping the policy's window. Buckets are sized per policy
+// (an eighth of the window by default), so windows of days cost a handful
+// of lookups per event instead of millions of keys. Both are probabilistic:
+// a fraction of sampled events is also tracked with exact keys and the
+// measured false-positive rate is exported alongside the estimated one.
+
+var (
+	dedup           dedupStore
+	dedupWindow     time.Duration
+	dedupSampleRate float64
+
+	dedupStatsMu sync.Mutex
+
+	dedupChecksTotal    = newCounterVec("dedup_checks_total", "Duplicate checks by store, policy and result", "store", "policy", "result")
+	dedupFPRSampleTotal = newCounterVec("dedup_fpr_samples_total", "Sampled new events checked against exact keys", "store", "policy", "outcome")
+	dedupMeasuredFPR    = newGaugeVec("dedup_measured_false_positive_ratio", "False positives among sampled new events", "store", "policy")
+	dedupEstimatedFPR   = newGaugeVec("dedup_estimated_false_positive_ratio", "False-positive rate estimated from fill over the window", "store", "policy")
+	dedupMemoryBytes    = newGaugeVec("dedup_memory_bytes", "Redis memory used by dedup structures over the window", "store", "policy")
+	dedupEntriesGauge   = newGaugeVec("dedup_entries", "Event IDs marked within the window", "store", "policy")
+	dedupBytesPerEntry  = newGaugeVec("dedup_bytes_per_entry", "Redis memory per marked event ID", "store", "policy")
+)
+
+// dedupStore checks and marks event IDs of a policy on the Redis client and
+// key prefix of the event's residency region
+type dedupStore interface {
+	Name() string
+	Seen(client redis.UniversalClient, prefix string, p *dedupPolicy, id string, now time.Time) (bool, error)
+	Mark(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) error
+	// Stats returns bytes used and the estimated false-positive rate for
+	// the policy's buckets in its window
+	Stats(client redis.UniversalClient, prefix string, p *dedupPolicy, entries int64, now time.Time) (int64, float64, error)
+	// Forget removes event IDs from the policy's window and returns how
+	// many entries were removed
+	Forget(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) (int64, error)
+	// Purge removes what the policy marked between from and to and returns
+	// how many keys were deleted
+	Purge(client redis.UniversalClient, prefix string, p *dedupPolicy, from, to, now time.Time) (int64, error)
+}
+
+// errDedupCannotForget is returned by stores that can only purge by time
+var errDedupCannotForget = errors.New("bloom filters cannot forget single event IDs, purge by time range instead")
+
+func initDedup() {
+	dedupWindow = getEnvDuration("DEDUP_WINDOW", time.Hour)
+	if dedupWindow <= 0 {
+		log.Fatalf("DEDUP_WINDOW must be positive")
+	}
+	sampleRate, err := strconv.ParseFloat(getEnv("DEDUP_FPR_SAMPLE_RATE", "0.001"), 64)
+	if err != nil || sampleRate < 0 || sampleRate > 1 {
+		log.Fatalf("Invalid DEDUP_FPR_SAMPLE_RATE")
+	}
+	dedupSampleRate = sampleRate
+
+	switch name := getEnv("DEDUP_STORE", "keys"); name {
+	case "keys":
+		dedup = keysStore{}
+	case "fingerprint":
+		shards := getEnvInt("DEDUP_FP_SHARDS", 4096)
+		if shards <= 0 {
+			log.Fatalf("DEDUP_FP_SHARDS must be positive")
+		}
+		dedup = fingerprintStore{shards: uint32(shards)}
+	case "bloom":
+		bits := getEnvInt("DEDUP_BLOOM_BITS", 1<<27)
+		hashes := getEnvInt("DEDUP_BLOOM_HASHES", 7)
+		if bits <= 0 || bits > dedupBloomMaxBits || hashes <= 0 || hashes > 16 {
+			log.Fatalf("DEDUP_BLOOM_BITS must be between 1 and 2^32 and DEDUP_BLOOM_HASHES between 1 and 16")
+		}
+		dedup = bloomStore{bits: uint64(bits), hashes: hashes}
+	default:
+		log.Fatalf("Unknown DEDUP_STORE %q (keys, fingerprint or bloom)", name)
+	}
+	log.Printf("Dedup store %s, default window %s", dedup.Name(), dedupWindow)
+
+	initDedupPolicies()
+}
+
+// dedupBuckets returns the policy's bucket numbers overlapping its window
+// ending now, newest first
+func dedupBuckets(now time.Time, p *dedupPolicy) []int64 {
+	size := int64(p.bucket / time.Second)
+	newest := now.Unix() / size
+	oldest := now.Add(-p.window).Unix() / size
+	buckets := make([]int64, 0, newest-oldest+1)
+	for b := newest; b >= oldest; b-- {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// dedupBucketTTL keeps a bucket until its newest mark leaves the window
+func dedupBucketTTL(p *dedupPolicy) time.Duration {
+	return p.window + p.bucket
+}
+
+// dedupHash returns the 32 bytes of an event ID, hashing IDs that are not
+// already SHA-256 hex
+func dedupHash(id string) []byte {
+	if len(id) == 64 {
+		if b, err := hex.DecodeString(id); err == nil {
+			return b
+		}
+	}
+	sum := sha256.Sum256([]byte(id))
+	return sum[:]
+}
+
+// dedupBucketsBetween returns the buckets in the window that overlap from
+// to to, so purges round out to whole buckets
+func dedupBucketsBetween(now time.Time, p *dedupPolicy, from, to time.Time) []int64 {
+	size := int64(p.bucket / time.Second)
+	var buckets []int64
+	for _, b := range dedupBuckets(now, p) {
+		if b*size < to.Unix() && (b+1)*size > from.Unix() {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// deleteKeys deletes keys one command each, so cluster clients can route
+// them, and returns how many existed
+func deleteKeys(client redis.UniversalClient, keys []string) (int64, error) {
+	pipe := client.Pipeline()
+	cmds := make([]*redis.IntCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipe.Del(ctx, key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, cmd := range cmds {
+		deleted += cmd.Val()
+	}
+	return deleted, nil
+}
+
+func dedupCountKey(prefix, policy string, bucket int64) string {
+	return prefix + "dedup:count:" + policy + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// checkDedup looks the event ID up in the configured store, and for sampled
+// IDs also in exact keys to measure false positives
+func checkDedup(client redis.UniversalClient, prefix string, p *dedupPolicy, id string) (bool, error) {
+	now := time.Now()
+	seen, err := dedup.Seen(client, prefix, p, id, now)
+	if err != nil {
+		dedupChecksTotal.Inc(dedup.Name(), p.Name, "error")
+		return false, err
+	}
+	if seen {
+		dedupChecksTotal.Inc(dedup.Name(), p.Name, "duplicate")
+	} else {
+		dedupChecksTotal.Inc(dedup.Name(), p.Name, "new")
+	}
+
+	if dedup.Name() != "keys" && dedupSampled(id) {
+		exact, err := client.Exists(ctx, prefix+"dedup:exact:"+id).Result()
+		if err == nil && exact == 0 {
+			outcome := "true_negative"
+			if seen {
+				outcome = "false_positive"
+			}
+			dedupFPRSampleTotal.Inc(dedup.Name(), p.Name, outcome)
+
+			dedupStatsMu.Lock()
+			p.sampledNew++
+			if seen {
+				p.falsePositives++
+			}
+			dedupMeasuredFPR.Set(p.falsePositives/p.sampledNew, dedup.Name(), p.Name)
+			dedupStatsMu.Unlock()
+		}
+	}
+	return seen, nil
+}
+
+// markDedup records produced event IDs and bumps the bucket's entry count
+func markDedup(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	now := time.Now()
+	if err := dedup.Mark(client, prefix, p, ids, now); err != nil {
+		log.Printf("Dedup mark failed: %v", err)
+		return
+	}
+
+	pipe := client.Pipeline()
+	countKey := dedupCountKey(prefix, p.Name, dedupBuckets(now, p)[0])
+	pipe.IncrBy(ctx, countKey, int64(len(ids)))
+	pipe.Expire(ctx, countKey, dedupBucketTTL(p))
+	if dedup.Name() != "keys" {
+		for _, id := range ids {
+			if dedupSampled(id) {
+				pipe.Set(ctx, prefix+"dedup:exact:"+id, "1", p.window)
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Dedup count failed: %v", err)
+	}
+
+	dedupStatsMu.Lock()
+	p.lastMarked = ids[len(ids)-1]
+	dedupStatsMu.Unlock()
+}
+
+// dedupSampled selects IDs for exact shadow tracking from bytes the stores
+// do not use
+func dedupSampled(id string) bool {
+	if dedupSampleRate <= 0 {
+		return false
+	}
+	h := dedupHash(id)
+	return float64(binary.BigEndian.Uint32(h[28:32]))/float64(math.MaxUint32) < dedupSampleRate
+}
+
+// dedupStatsLoop refreshes the memory and fill gauges of every enabled
+// policy for the default region
+func dedupStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, p := range dedupPolicyList() {
+			if !p.enabled {
+				continue
+			}
+			var entries int64
+			for _, b := range dedupBuckets(now, p) {
+				n, err := redisClient.Get(ctx, dedupCountKey("", p.Name, b)).Int64()
+				if err != nil && err != redis.Nil {
+					log.Printf("Dedup stats failed: %v", err)
+				}
+				entries += n
+			}
+			memory, fpr, err := dedup.Stats(redisClient, "", p, entries, now)
+			if err != nil {
+				log.Printf("Dedup stats failed for policy %s: %v", p.Name, err)
+				continue
+			}
+			name := dedup.Name()
+			dedupEntriesGauge.Set(float64(entries), name, p.Name)
+			dedupMemoryBytes.Set(float64(memory), name, p.Name)
+			dedupEstimatedFPR.Set(fpr, name, p.Name)
+			if entries > 0 {
+				dedupBytesPerEntry.Set(float64(memory)/float64(entries), name, p.Name)
+			}
+		}
+	}
+}
+
+// keysStore is the exact one-key-per-event store. Keys are namespaced by
+// policy so a purge can tell each key's mark time from its TTL and its own
+// policy's window.
+type keysStore struct{}
+
+func (keysStore) Name() string { return "keys" }
+
+func (keysStore) key(prefix string, p *dedupPolicy, id string) string {
+	return prefix + "event:" + p.Name + ":" + id
+}
+
+func (s keysStore) Seen(client redis.UniversalClient, prefix string, p *dedupPolicy, id string, now time.Time) (bool, error) {
+	exists, err := client.Exists(ctx, s.key(prefix, p, id)).Result()
+	return exists > 0, err
+}
+
+func (s keysStore) Mark(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) error {
+	pipe := client.Pipeline()
+	for _, id := range ids {
+		pipe.Set(ctx, s.key(prefix, p, id), "1", p.window)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Stats extrapolates from the size of the policy's most recently marked key
+func (s keysStore) Stats(client redis.UniversalClient, prefix string, p *dedupPolicy, entries int64, now time.Time) (int64, float64, error) {
+	dedupStatsMu.Lock()
+	id := p.lastMarked
+	dedupStatsMu.Unlock()
+	if id == "" {
+		return 0, 0, nil
+	}
+	size, err := client.MemoryUsage(ctx, s.key(prefix, p, id)).Result()
+	if err == redis.Nil {
+		return 0, 0, nil
+	}
+	return size * entries, 0, err
+}
+
+func (s keysStore) Forget(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) (int64, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, s.key(prefix, p, id))
+	}
+	return deleteKeys(client, keys)
+}
+
+// Purge scans the policy's event keys and works out their mark time from
+// the remaining TTL and the policy's window
+func (keysStore) Purge(client redis.UniversalClient, prefix string, p *dedupPolicy, from, to, now time.Time) (int64, error) {
+	keys, err := scanClientKeys(client, prefix+"event:"+escapeGlob(p.Name)+":*")
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), 500)]
+		keys = keys[len(chunk):]
+
+		pipe := client.Pipeline()
+		ttls := make([]*redis.DurationCmd, len(chunk))
+		for i, key := range chunk {
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return deleted, err
+		}
+		var matched []string
+		for i, key := range chunk {
+			if ttls[i].Val() <= 0 {
+				continue
+			}
+			marked := now.Add(ttls[i].Val() - p.window)
+			if !marked.Before(from) && marked.Before(to) {
+				matched = append(matched, key)
+			}
+		}
+		n, err := deleteKeys(client, matched)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// fingerprintStore keeps 32-bit fingerprints in sets keyed by policy, bucket
+// and shard. The shard comes from different bits than the fingerprint, so
+// the effective fingerprint is 32 bits plus log2(shards).
+type fingerprintStore struct {
+	shards uint32
+}
+
+func (fingerprintStore) Name() string { return "fingerprint" }
+
+func (s fingerprintStore) locate(id string) (uint32, string) {
+	h := dedupHash(id)
+	fp := binary.BigEndian.Uint32(h[0:4])
+	shard := binary.BigEndian.Uint32(h[4:8]) % s.shards
+	// Signed so the set uses the 4-byte intset encoding
+	return shard, strconv.FormatInt(int64(int32(fp)), 10)
+}
+
+func (s fingerprintStore) key(prefix, policy string, bucket int64, shard uint32) string {
+	return prefix + "dedup:fp:" + policy + ":" + strconv.FormatInt(bucket, 10) + ":" + strconv.FormatUint(uint64(shard), 10)
+}
+
+func (s fingerprintStore) Seen(client redis.UniversalClient, prefix string, p *dedupPolicy, id string, now time.Time) (bool, error) {
+	shard, fp := s.locate(id)
+	pipe := client.Pipeline()
+	var cmds []*redis.BoolCmd
+	for _, b := range dedupBuckets(now, p) {
+		cmds = append(cmds, pipe.SIsMember(ctx, s.key(prefix, p.Name, b, shard), fp))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Val() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s fingerprintStore) Mark(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) error {
+	bucket := dedupBuckets(now, p)[0]
+	pipe := client.Pipeline()
+	for _, id := range ids {
+		shard, fp := s.locate(id)
+		key := s.key(prefix, p.Name, bucket, shard)
+		pipe.SAdd(ctx, key, fp)
+		pipe.Expire(ctx, key, dedupBucketTTL(p))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Stats samples up to 64 shards per bucket and scales by the shard count.
+// A new ID collides when its fingerprint is already in its shard of any
+// bucket in the window.
+func (s fingerprintStore) Stats(client redis.UniversalClient, prefix string, p *dedupPolicy, entries int64, now time.Time) (int64, float64, error) {
+	step := s.shards / 64
+	if step == 0 {
+		step = 1
+	}
+	buckets := dedupBuckets(now, p)
+	var sampled, total int64
+	for _, b := range buckets {
+		pipe := client.Pipeline()
+		var cmds []*redis.IntCmd
+		for shard := uint32(0); shard < s.shards; shard += step {
+			cmds = append(cmds, pipe.MemoryUsage(ctx, s.key(prefix, p.Name, b, shard)))
+		}
+		pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			if cmd.Err() == nil {
+				total += cmd.Val()
+			}
+		}
+		sampled += int64(len(cmds))
+	}
+	if sampled == 0 {
+		return 0, 0, nil
+	}
+	memory := total * int64(len(buckets)) * int64(s.shards) / sampled
+	space := float64(s.shards) * (1 << 32)
+	return memory, 1 - math.Exp(-float64(entries)/space), nil
+}
+
+// Forget removes each ID's fingerprint from every bucket in the window. An
+// ID sharing its fingerprint and shard with another is forgotten with it.
+func (s fingerprintStore) Forget(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) (int64, error) {
+	pipe := client.Pipeline()
+	var cmds []*redis.IntCmd
+	for _, id := range ids {
+		shard, fp := s.locate(id)
+		for _, b := range dedupBuckets(now, p) {
+			cmds = append(cmds, pipe.SRem(ctx, s.key(prefix, p.Name, b, shard), fp))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, cmd := range cmds {
+		removed += cmd.Val()
+	}
+	return removed, nil
+}
+
+// Purge deletes every shard of the buckets overlapping the range
+func (s fingerprintStore) Purge(client redis.UniversalClient, prefix string, p *dedupPolicy, from, to, now time.Time) (int64, error) {
+	var keys []string
+	for _, b := range dedupBucketsBetween(now, p, from, to) {
+		for shard := uint32(0); shard < s.shards; shard++ {
+			keys = append(keys, s.key(prefix, p.Name, b, shard))
+		}
+		keys = append(keys, dedupCountKey(prefix, p.Name, b))
+	}
+	return deleteKeys(client, keys)
+}
+
+// bloomStore keeps one Bloom filter bitmap per policy and bucket, with k
+// probe positions from double hashing the event ID. Policies with expected
+// entries are sized for them; the others use DEDUP_BLOOM_BITS and
+// DEDUP_BLOOM_HASHES.
+type bloomStore struct {
+	bits   uint64
+	hashes int
+}
+
+func (bloomStore) Name() string { return "bloom" }
+
+// size returns the filter bits and probes of a policy
+func (s bloomStore) size(p *dedupPolicy) (uint64, int) {
+	if p.bloomBits > 0 {
+		return p.bloomBits, p.bloomHashes
+	}
+	return s.bits, s.hashes
+}
+
+func (s bloomStore) key(prefix, policy string, bucket int64) string {
+	return prefix + "dedup:bloom:" + policy + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// bitfieldArgs builds one BITFIELD call probing or setting every position
+func (s bloomStore) bitfieldArgs(p *dedupPolicy, id, op string) []interface{} {
+	bits, hashes := s.size(p)
+	h := dedupHash(id)
+	h1 := binary.BigEndian.Uint64(h[8:16])
+	h2 := binary.BigEndian.Uint64(h[16:24]) | 1
+	args := make([]interface{}, 0, hashes*4)
+	for i := 0; i < hashes; i++ {
+		offset := (h1 + uint64(i)*h2) % bits
+		if op == "GET" {
+			args = append(args, "GET", "u1", offset)
+		} else {
+			args = append(args, "SET", "u1", offset, 1)
+		}
+	}
+	return args
+}
+
+func (s bloomStore) Seen(client redis.UniversalClient, prefix string, p *dedupPolicy, id string, now time.Time) (bool, error) {
+	args := s.bitfieldArgs(p, id, "GET")
+	pipe := client.Pipeline()
+	var cmds []*redis.IntSliceCmd
+	for _, b := range dedupBuckets(now, p) {
+		cmds = append(cmds, pipe.BitField(ctx, s.key(prefix, p.Name, b), args...))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		all := true
+		for _, bit := range cmd.Val() {
+			if bit == 0 {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s bloomStore) Mark(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) error {
+	key := s.key(prefix, p.Name, dedupBuckets(now, p)[0])
+	pipe := client.Pipeline()
+	for _, id := range ids {
+		pipe.BitField(ctx, key, s.bitfieldArgs(p, id, "SET")...)
+	}
+	pipe.Expire(ctx, key, dedupBucketTTL(p))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Stats combines the per-bucket false-positive rate (fill^k, with fill read
+// from BITCOUNT) across every bucket in the window
+func (s bloomStore) Stats(client redis.UniversalClient, prefix string, p *dedupPolicy, entries int64, now time.Time) (int64, float64, error) {
+	bits, hashes := s.size(p)
+	var memory int64
+	miss := 1.0
+	for _, b := range dedupBuckets(now, p) {
+		key := s.key(prefix, p.Name, b)
+		size, err := client.MemoryUsage(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		memory += size
+		set, err := client.BitCount(ctx, key, nil).Result()
+		if err != nil {
+			return 0, 0, err
+		}
+		fill := float64(set) / float64(bits)
+		miss *= 1 - math.Pow(fill, float64(hashes))
+	}
+	return memory, 1 - miss, nil
+}
+
+func (bloomStore) Forget(client redis.UniversalClient, prefix string, p *dedupPolicy, ids []string, now time.Time) (int64, error) {
+	return 0, errDedupCannotForget
+}
+
+// Purge deletes the filters of the buckets overlapping the range
+func (s bloomStore) Purge(client redis.UniversalClient, prefix string, p *dedupPolicy, from, to, now time.Time) (int64, error) {
+	var keys []string
+	for _, b := range dedupBucketsBetween(now, p, from, to) {
+		keys = append(keys, s.key(prefix, p.Name, b), dedupCountKey(prefix, p.Name, b))
+	}
+	return deleteKeys(client, keys)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Dedup policies decide, per event type or route, how an event's ID is
+// derived and how long it is remembered. Policies from DEDUP_POLICIES_FILE
+// are matched in order and the first whose event_types and routes both match
+// wins; everything else falls under the "default" policy.
+//
+//	window  - how long produced IDs are remembered (default DEDUP_WINDOW)
+//	bucket  - time bucket of the fingerprint and bloom stores (default window/8)
+//	expected_entries, false_positive_rate - size the policy's Bloom filters
+//	          for that many IDs per window at that rate over the window
+//	fields  - the ID hashes event_type and these fields instead of the body;
+//	          events missing any of them fall back to the body hash
+//	enabled - false gives every event a unique ID and skips the check
+//
+// Policies can also suppress near-duplicates, see neardup.go.
+
+const (
+	// Default number of buckets a policy's window is split into
+	dedupBucketsPerWindow = 8
+	// Largest Redis string, 512 MiB
+	dedupBloomMaxBits = 1 << 32
+)
+
+type dedupPolicy struct {
+	Name       string   `json:"name"`
+	EventTypes []string `json:"event_types"` // empty = any
+	Routes     []string `json:"routes"`      // request paths, empty = any
+	Window     string   `json:"window"`
+	Bucket     string   `json:"bucket"`
+	Fields     []string `json:"fields"`
+	Enabled    *bool    `json:"enabled"`
+
+	NearDuplicateMs     int      `json:"near_duplicate_ms"`     // 0 = off
+	NearDuplicateFields []string `json:"near_duplicate_fields"` // beyond user_id and event_type
+
+	// Bloom filter sizing, DEDUP_BLOOM_BITS and DEDUP_BLOOM_HASHES when unset
+	ExpectedEntries   int64   `json:"expected_entries"`
+	FalsePositiveRate float64 `json:"false_positive_rate"` // default 0.001
+
+	window  time.Duration
+	bucket  time.Duration
+	enabled bool
+
+	bloomBits   uint64 // 0 = the store's defaults
+	bloomHashes int
+
+	// Guarded by dedupStatsMu
+	lastMarked     string
+	sampledNew     float64
+	falsePositives float64
+}
+
+// dedupPolicyConfig is loaded from DEDUP_POLICIES_FILE
+type dedupPolicyConfig struct {
+	Default  *dedupPolicy   `json:"default"`
+	Policies []*dedupPolicy `json:"policies"`
+}
+
+var (
+	dedupPolicies       []*dedupPolicy
+	dedupDefaultPolicy  *dedupPolicy
+	dedupPoliciesByName map[string]*dedupPolicy
+	dedupUniqueCounter  uint64
+
+	dedupFieldsMissingTotal = newCounterVec("dedup_fields_missing_total", "Events hashed by body because a fingerprint field was missing", "policy")
+)
+
+func initDedupPolicies() {
+	dedupDefaultPolicy = &dedupPolicy{Name: "default"}
+	resolveDedupPolicy(dedupDefaultPolicy)
+	dedupPoliciesByName = map[string]*dedupPolicy{"default": dedupDefaultPolicy}
+
+	path := getEnv("DEDUP_POLICIES_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var cfg dedupPolicyConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		log.Fatalf("Failed to load dedup policies from %s: %v", path, err)
+	}
+
+	if cfg.Default != nil {
+		cfg.Default.Name = "default"
+		resolveDedupPolicy(cfg.Default)
+		dedupDefaultPolicy = cfg.Default
+		dedupPoliciesByName["default"] = cfg.Default
+	}
+	for _, p := range cfg.Policies {
+		if p.Name == "" || dedupPoliciesByName[p.Name] != nil {
+			log.Fatalf("Dedup policy needs a unique name other than \"default\": %+v", p)
+		}
+		// Names are a segment of Redis keys scanned by prefix
+		if strings.Contains(p.Name, ":") {
+			log.Fatalf("Dedup policy name %q must not contain \":\"", p.Name)
+		}
+		resolveDedupPolicy(p)
+		dedupPoliciesByName[p.Name] = p
+	}
+	dedupPolicies = cfg.Policies
+	log.Printf("Loaded %d dedup policies", len(dedupPolicies))
+}
+
+func resolveDedupPolicy(p *dedupPolicy) {
+	p.window = dedupWindow
+	if p.Window != "" {
+		window, err := time.ParseDuration(p.Window)
+		if err != nil || window <= 0 {
+			log.Fatalf("Invalid window %q for dedup policy %q", p.Window, p.Name)
+		}
+		p.window = window
+	}
+	// Enough buckets to expire IDs close to the window, few enough to check
+	// in one round trip
+	p.bucket = max(p.window/dedupBucketsPerWindow, time.Second).Truncate(time.Second)
+	if p.Bucket != "" {
+		bucket, err := time.ParseDuration(p.Bucket)
+		if err != nil || bucket < time.Second {
+			log.Fatalf("Invalid bucket %q for dedup policy %q (at least 1s)", p.Bucket, p.Name)
+		}
+		p.bucket = bucket.Truncate(time.Second)
+	}
+	if p.ExpectedEntries < 0 || p.FalsePositiveRate < 0 || p.FalsePositiveRate >= 1 {
+		log.Fatalf("Invalid Bloom sizing for dedup policy %q", p.Name)
+	}
+	if p.ExpectedEntries > 0 {
+		if p.FalsePositiveRate == 0 {
+			p.FalsePositiveRate = 0.001
+		}
+		p.bloomBits, p.bloomHashes = bloomSize(p)
+		if p.bloomBits > dedupBloomMaxBits {
+			log.Fatalf("Dedup policy %q needs %d-bit Bloom filters, more than Redis allows; use a smaller bucket", p.Name, p.bloomBits)
+		}
+	}
+	p.enabled = p.Enabled == nil || *p.Enabled
+}
+
+// bloomSize sizes one bucket's filter. A bucket holds its share of the
+// expected entries, and every bucket in the window is checked, so each gets
+// the share of the target rate that keeps the combined rate on target.
+func bloomSize(p *dedupPolicy) (uint64, int) {
+	perBucket := math.Ceil(float64(p.ExpectedEntries) * float64(p.bucket) / float64(p.window))
+	checked := math.Ceil(float64(p.window)/float64(p.bucket)) + 1
+	rate := 1 - math.Pow(1-p.FalsePositiveRate, 1/checked)
+
+	bits := math.Ceil(-perBucket * math.Log(rate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / perBucket * math.Ln2))
+	return uint64(max(bits, 64)), min(max(hashes, 1), 16)
+}
+
+// dedupPolicyFor picks the policy for an incoming event
+func dedupPolicyFor(event map[string]interface{}, route string) *dedupPolicy {
+	eventType := eventString(event, "event_type")
+	for _, p := range dedupPolicies {
+		if matchesAny(p.EventTypes, eventType) && matchesAny(p.Routes, route) {
+			return p
+		}
+	}
+	return dedupDefaultPolicy
+}
+
+// dedupPolicyOf returns the policy an accepted event was stamped with
+func dedupPolicyOf(event map[string]interface{}) *dedupPolicy {
+	if p, ok := dedupPoliciesByName[eventString(event, "dedup_policy")]; ok {
+		return p
+	}
+	return dedupDefaultPolicy
+}
+
+// dedupPolicyList returns the default policy followed by the configured ones
+func dedupPolicyList() []*dedupPolicy {
+	return append([]*dedupPolicy{dedupDefaultPolicy}, dedupPolicies...)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// eventID derives the ID duplicates are detected by
+func (p *dedupPolicy) eventID(env *eventEnvelope) string {
+	if !p.enabled {
+		n := atomic.AddUint64(&dedupUniqueCounter, 1)
+		data := strconv.AppendInt(append(env.Canon, 0), time.Now().UnixNano(), 10)
+		data = strconv.AppendUint(append(data, 0), n, 10)
+		hash := sha256.Sum256(data)
+		return hex.EncodeToString(hash[:])
+	}
+	if len(p.Fields) == 0 {
+		return env.id()
+	}
+
+	// Without every field the fingerprint would collapse unrelated events
+	values := map[string]interface{}{"event_type": env.Fields["event_type"]}
+	for _, field := range p.Fields {
+		value, ok := env.Fields[field]
+		if !ok || value == nil {
+			dedupFieldsMissingTotal.Inc(p.Name)
+			return env.id()
+		}
+		values[field] = value
+	}
+	data, _ := json.Marshal(values)
+	hash := sha256.Sum256(append([]byte(p.Name+"\x00"), data...))
+	return hex.EncodeToString(hash[:])
+}
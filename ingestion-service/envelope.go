@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// The hot path reads each request body, bounded by EVENT_MAX_BYTES, into a
+// pooled envelope and parses it in a single pass. That pass validates the
+// JSON, writes the canonical encoding the event ID is hashed from, and
+// decodes into the envelope: user_id and event_type into typed fields, and
+// every top-level member into a table of its key, canonical bytes and
+// decoded value. The event map the stages work on is pooled with the
+// envelope.
+//
+// The canonical form is exactly what json.Marshal produces for the decoded
+// map (sorted keys, Go's float formatting and string escaping), so event IDs
+// are unchanged. When the worker encodes the event for Kafka, members that
+// still hold their decoded value are copied from the canonical bytes and
+// only fields the stages added or replaced are encoded. Stages replace
+// top-level fields and never modify nested values in place, which is what
+// makes the copy safe.
+//
+// A queued envelope is shared by the handler and the worker, and goes back
+// to the pool once both have released it.
+
+// Nesting limit, as in encoding/json
+const maxNestingDepth = 10000
+
+var (
+	errNotObject = errors.New("event must be a JSON object")
+	errSyntax    = errors.New("invalid JSON")
+	errTooDeep   = errors.New("JSON nested too deeply")
+)
+
+var (
+	lineSeparator      = []byte("\u2028")
+	paragraphSeparator = []byte("\u2029")
+)
+
+var (
+	envelopePool = sync.Pool{New: func() interface{} { return new(eventEnvelope) }}
+	messagePool  = sync.Pool{New: func() interface{} { return new(messageBuffer) }}
+)
+
+// eventEnvelope is the pooled per-request state of eventsHandler
+type eventEnvelope struct {
+	Body  bytes.Buffer // request body as received
+	Canon []byte       // canonical encoding of Body
+
+	// Typed members, empty when absent or not a string
+	UserID    string
+	EventType string
+
+	// Fields is the decoded event the stages work on. It is pooled with the
+	// envelope, so nothing may keep it once the envelope is released.
+	Fields map[string]interface{}
+
+	members []envelopeMember // top-level members in key order
+	scratch []canonMember    // for sorting object members
+	depth   int
+	refs    atomic.Int32
+}
+
+// envelopeMember is one decoded top-level member and where its canonical
+// value sits in Canon
+type envelopeMember struct {
+	key        string
+	start, end int
+	value      interface{}
+}
+
+// canonMember is one object member: its decoded key and raw value
+type canonMember struct {
+	key   []byte
+	value []byte
+}
+
+func acquireEnvelope() *eventEnvelope {
+	env := envelopePool.Get().(*eventEnvelope)
+	env.refs.Store(1)
+	return env
+}
+
+// retain adds a reference for a worker the envelope is handed to
+func (env *eventEnvelope) retain() {
+	env.refs.Add(1)
+}
+
+// releaseEnvelope drops a reference and returns the envelope, with its
+// event map, to the pool after the last one
+func releaseEnvelope(env *eventEnvelope) {
+	if env.refs.Add(-1) > 0 {
+		return
+	}
+	env.Body.Reset()
+	env.Canon = env.Canon[:0]
+	env.UserID, env.EventType = "", ""
+	env.depth = 0
+	clear(env.Fields)
+	clear(env.members[:cap(env.members)])
+	env.members = env.members[:0]
+	clear(env.scratch[:cap(env.scratch)])
+	env.scratch = env.scratch[:0]
+	envelopePool.Put(env)
+}
+
+// decode reads the body and parses it into Canon, the typed members and
+// Fields
+func (env *eventEnvelope) decode(r io.Reader) error {
+	if _, err := env.Body.ReadFrom(r); err != nil {
+		return err
+	}
+	v := trimSpace(env.Body.Bytes())
+	if len(v) == 0 || v[0] != '{' {
+		return errNotObject
+	}
+
+	if env.Fields == nil {
+		env.Fields = make(map[string]interface{})
+	}
+	canon, _, err := env.appendObject(env.Canon[:0], v, true)
+	env.Canon = canon
+	if err != nil {
+		return err
+	}
+	env.UserID, _ = env.Fields["user_id"].(string)
+	env.EventType, _ = env.Fields["event_type"].(string)
+	return nil
+}
+
+// id hashes the canonical encoding
+func (env *eventEnvelope) id() string {
+	hash := sha256.Sum256(env.Canon)
+	return hex.EncodeToString(hash[:])
+}
+
+// member returns the decoded top-level member with the key, or nil
+func (env *eventEnvelope) member(key string) *envelopeMember {
+	i, found := slices.BinarySearchFunc(env.members, key, func(m envelopeMember, key string) int {
+		return strings.Compare(m.key, key)
+	})
+	if !found {
+		return nil
+	}
+	return &env.members[i]
+}
+
+// appendValue appends the canonical form of exactly one JSON value and
+// returns what it decodes to
+func (env *eventEnvelope) appendValue(dst, v []byte) ([]byte, interface{}, error) {
+	if len(v) == 0 {
+		return dst, nil, errSyntax
+	}
+	if v[0] == '{' || v[0] == '[' {
+		if env.depth++; env.depth > maxNestingDepth {
+			return dst, nil, errTooDeep
+		}
+		defer func() { env.depth-- }()
+	}
+	switch v[0] {
+	case '{':
+		return env.appendObject(dst, v, false)
+	case '[':
+		return env.appendArray(dst, v)
+	case '"':
+		s, err := parseString(v)
+		if err != nil {
+			return dst, nil, err
+		}
+		return appendEncodedString(dst, s), string(s), nil
+	case 't', 'f', 'n':
+		switch string(v) {
+		case "true":
+			return append(dst, v...), true, nil
+		case "false":
+			return append(dst, v...), false, nil
+		case "null":
+			return append(dst, v...), nil, nil
+		}
+		return dst, nil, errSyntax
+	default:
+		if !validNumber(v) {
+			return dst, nil, errSyntax
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return dst, nil, err
+		}
+		return appendCanonicalNumber(dst, v, f), f, nil
+	}
+}
+
+// appendObject sorts members by key, keeping the last of duplicate keys as
+// decoding into a map does. The top-level object decodes into Fields and
+// the member table.
+func (env *eventEnvelope) appendObject(dst, v []byte, top bool) ([]byte, interface{}, error) {
+	base := len(env.scratch)
+	defer func() { env.scratch = env.scratch[:base] }()
+
+	i := skipSpace(v, 1)
+	for at(v, i) != '}' {
+		if at(v, i) != '"' {
+			return dst, nil, errSyntax
+		}
+		keyEnd := skipString(v, i)
+		key, err := parseString(v[i:keyEnd])
+		if err != nil {
+			return dst, nil, err
+		}
+		i = skipSpace(v, keyEnd)
+		if at(v, i) != ':' {
+			return dst, nil, errSyntax
+		}
+		i = skipSpace(v, i+1)
+		valueEnd := skipValue(v, i)
+		env.scratch = append(env.scratch, canonMember{key: key, value: v[i:valueEnd]})
+		i = skipSpace(v, valueEnd)
+		switch at(v, i) {
+		case ',':
+			i = skipSpace(v, i+1)
+			if at(v, i) != '"' {
+				return dst, nil, errSyntax
+			}
+		case '}':
+		default:
+			return dst, nil, errSyntax
+		}
+	}
+	if i != len(v)-1 {
+		return dst, nil, errSyntax
+	}
+
+	members := env.scratch[base:]
+	slices.SortStableFunc(members, func(a, b canonMember) int { return bytes.Compare(a.key, b.key) })
+
+	var object map[string]interface{}
+	if top {
+		object = env.Fields
+	} else {
+		object = make(map[string]interface{}, len(members))
+	}
+	dst = append(dst, '{')
+	first := true
+	for j, m := range members {
+		// Earlier duplicates are still validated, then dropped
+		if j+1 < len(members) && bytes.Equal(m.key, members[j+1].key) {
+			n := len(dst)
+			var err error
+			if dst, _, err = env.appendValue(dst, m.value); err != nil {
+				return dst, nil, err
+			}
+			dst = dst[:n]
+			continue
+		}
+		if !first {
+			dst = append(dst, ',')
+		}
+		first = false
+		dst = appendEncodedString(dst, m.key)
+		dst = append(dst, ':')
+		start := len(dst)
+		var value interface{}
+		var err error
+		if dst, value, err = env.appendValue(dst, m.value); err != nil {
+			return dst, nil, err
+		}
+		key := string(m.key)
+		object[key] = value
+		if top {
+			env.members = append(env.members, envelopeMember{key: key, start: start, end: len(dst), value: value})
+		}
+	}
+	return append(dst, '}'), object, nil
+}
+
+func (env *eventEnvelope) appendArray(dst, v []byte) ([]byte, interface{}, error) {
+	array := []interface{}{}
+	dst = append(dst, '[')
+	i := skipSpace(v, 1)
+	for first := true; at(v, i) != ']'; first = false {
+		end := skipValue(v, i)
+		if !first {
+			dst = append(dst, ',')
+		}
+		var value interface{}
+		var err error
+		if dst, value, err = env.appendValue(dst, v[i:end]); err != nil {
+			return dst, nil, err
+		}
+		array = append(array, value)
+		i = skipSpace(v, end)
+		switch at(v, i) {
+		case ',':
+			i = skipSpace(v, i+1)
+			if at(v, i) == ']' {
+				return dst, nil, errSyntax
+			}
+		case ']':
+		default:
+			return dst, nil, errSyntax
+		}
+	}
+	if i != len(v)-1 {
+		return dst, nil, errSyntax
+	}
+	return append(dst, ']'), array, nil
+}
+
+// parseString returns the contents of a quoted string, unescaping only when
+// needed
+func parseString(quoted []byte) ([]byte, error) {
+	if len(quoted) < 2 || quoted[len(quoted)-1] != '"' {
+		return nil, errSyntax
+	}
+	content := quoted[1 : len(quoted)-1]
+	if simpleString(content) {
+		return content, nil
+	}
+	var s string
+	if err := json.Unmarshal(quoted, &s); err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// simpleString reports whether string contents decode to themselves
+func simpleString(s []byte) bool {
+	for _, b := range s {
+		if b < 0x20 || b == '"' || b == '\\' {
+			return false
+		}
+	}
+	return utf8.Valid(s)
+}
+
+func appendEncodedString[T string | []byte](dst []byte, s T) []byte {
+	if plainString(s) {
+		dst = append(dst, '"')
+		dst = append(dst, s...)
+		return append(dst, '"')
+	}
+	encoded, _ := json.Marshal(string(s))
+	return append(dst, encoded...)
+}
+
+// plainString reports whether string contents read the same escaped and
+// unescaped, and need no escaping from json.Marshal
+func plainString[T string | []byte](s T) bool {
+	highBytes := false
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b < 0x20, b == '"', b == '\\', b == '<', b == '>', b == '&':
+			return false
+		case b >= utf8.RuneSelf:
+			highBytes = true
+		}
+	}
+	if !highBytes {
+		return true
+	}
+	// json.Marshal escapes U+2028 and U+2029 and replaces invalid UTF-8
+	b := []byte(s)
+	return utf8.Valid(b) && !bytes.Contains(b, lineSeparator) && !bytes.Contains(b, paragraphSeparator)
+}
+
+// validNumber checks the JSON number grammar, which is stricter than
+// strconv.ParseFloat
+func validNumber(v []byte) bool {
+	i := 0
+	if at(v, i) == '-' {
+		i++
+	}
+	switch {
+	case at(v, i) == '0':
+		i++
+	case at(v, i) >= '1' && at(v, i) <= '9':
+		for i++; isDigit(at(v, i)); i++ {
+		}
+	default:
+		return false
+	}
+	if at(v, i) == '.' {
+		if !isDigit(at(v, i+1)) {
+			return false
+		}
+		for i++; isDigit(at(v, i)); i++ {
+		}
+	}
+	if c := at(v, i); c == 'e' || c == 'E' {
+		i++
+		if c := at(v, i); c == '+' || c == '-' {
+			i++
+		}
+		if !isDigit(at(v, i)) {
+			return false
+		}
+		for ; isDigit(at(v, i)); i++ {
+		}
+	}
+	return i == len(v)
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+// appendCanonicalNumber formats a number the way json.Marshal formats the
+// float64 it decodes to. Integers of up to 15 digits are copied as is.
+func appendCanonicalNumber(dst, v []byte, f float64) []byte {
+	digits := v
+	if digits[0] == '-' {
+		digits = digits[1:]
+	}
+	plain := len(digits) <= 15
+	for _, b := range digits {
+		if b < '0' || b > '9' {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return append(dst, v...)
+	}
+	return appendFloat(dst, f)
+}
+
+// appendFloat formats a float64 as json.Marshal does
+func appendFloat(dst []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
+
+// at returns v[i], or 0 past the end
+func at(v []byte, i int) byte {
+	if i < len(v) {
+		return v[i]
+	}
+	return 0
+}
+
+func skipSpace(v []byte, i int) int {
+	for i < len(v) && (v[i] == ' ' || v[i] == '\t' || v[i] == '\n' || v[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// trimSpace trims JSON whitespace only
+func trimSpace(v []byte) []byte {
+	v = v[skipSpace(v, 0):]
+	for len(v) > 0 && (v[len(v)-1] == ' ' || v[len(v)-1] == '\t' || v[len(v)-1] == '\n' || v[len(v)-1] == '\r') {
+		v = v[:len(v)-1]
+	}
+	return v
+}
+
+// skipString returns the index just past the string starting at i
+func skipString(v []byte, i int) int {
+	for j := i + 1; j < len(v); j++ {
+		switch v[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1
+		}
+	}
+	return len(v)
+}
+
+// skipValue returns the index just past the value starting at i
+func skipValue(v []byte, i int) int {
+	if i >= len(v) {
+		return i
+	}
+	switch v[i] {
+	case '"':
+		return skipString(v, i)
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(v); j++ {
+			switch v[j] {
+			case '"':
+				j = skipString(v, j) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return len(v)
+	default:
+		j := i
+		for j < len(v) && v[j] != ',' && v[j] != '}' && v[j] != ']' && v[j] != ':' &&
+			v[j] != ' ' && v[j] != '\t' && v[j] != '\n' && v[j] != '\r' {
+			j++
+		}
+		return j
+	}
+}
+
+// messageBuffer is a pooled Kafka message value with the scratch state of
+// encoding it
+type messageBuffer struct {
+	data    []byte
+	keys    []string
+	scratch bytes.Buffer
+	encoder *json.Encoder
+}
+
+func (buf *messageBuffer) Bytes() []byte { return buf.data }
+
+// encodeEvent encodes an event as json.Marshal would into a pooled buffer.
+// Members still holding what env decoded are copied from its canonical
+// bytes; env may be nil. Release the buffer with releaseMessage once the
+// message has been written.
+func encodeEvent(event map[string]interface{}, env *eventEnvelope) (*messageBuffer, error) {
+	buf := messagePool.Get().(*messageBuffer)
+	buf.keys = buf.keys[:0]
+	for key := range event {
+		buf.keys = append(buf.keys, key)
+	}
+	slices.Sort(buf.keys)
+
+	dst := append(buf.data[:0], '{')
+	for i, key := range buf.keys {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendEncodedString(dst, key)
+		dst = append(dst, ':')
+
+		value := event[key]
+		if env != nil {
+			if m := env.member(key); m != nil && sameValue(m.value, value) {
+				dst = append(dst, env.Canon[m.start:m.end]...)
+				continue
+			}
+		}
+		var err error
+		if dst, err = buf.appendValue(dst, value); err != nil {
+			buf.data = dst
+			releaseMessage(buf)
+			return nil, err
+		}
+	}
+	buf.data = append(dst, '}')
+	return buf, nil
+}
+
+// appendValue encodes the value types the stages add without reflection,
+// and anything else with a reused encoder
+func (buf *messageBuffer) appendValue(dst []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return appendEncodedString(dst, v), nil
+	case bool:
+		return strconv.AppendBool(dst, v), nil
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(dst, v, 10), nil
+	case float64:
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return appendFloat(dst, v), nil
+		}
+	case nil:
+		return append(dst, "null"...), nil
+	}
+	if buf.encoder == nil {
+		buf.encoder = json.NewEncoder(&buf.scratch)
+	}
+	buf.scratch.Reset()
+	if err := buf.encoder.Encode(value); err != nil {
+		return dst, err
+	}
+	return append(dst, bytes.TrimSuffix(buf.scratch.Bytes(), []byte("\n"))...), nil
+}
+
+// sameValue reports whether a member still holds the value it decoded to.
+// Objects and arrays count as unchanged while they are the same instance.
+func sameValue(decoded, current interface{}) bool {
+	switch d := decoded.(type) {
+	case string:
+		c, ok := current.(string)
+		return ok && c == d
+	case float64:
+		c, ok := current.(float64)
+		return ok && c == d
+	case bool:
+		c, ok := current.(bool)
+		return ok && c == d
+	case nil:
+		return current == nil
+	case map[string]interface{}:
+		c, ok := current.(map[string]interface{})
+		return ok && c != nil && reflect.ValueOf(c).UnsafePointer() == reflect.ValueOf(d).UnsafePointer()
+	case []interface{}:
+		c, ok := current.([]interface{})
+		return ok && c != nil && len(c) == len(d) && (len(d) == 0 || &c[0] == &d[0])
+	}
+	return false
+}
+
+func releaseMessage(buf *messageBuffer) {
+	messagePool.Put(buf)
+}
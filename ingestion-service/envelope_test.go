@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests and benchmarks for the eventsHandler hot path, without Redis and Kafka:
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// The baseline functions reproduce the previous path: decode into a map,
+// marshal it for the event ID, and marshal it again for the Kafka message.
+
+var benchEvent = []byte(`{
+  "user_id": "user_4821",
+  "event_type": "page_view",
+  "timestamp": "2024-05-01T12:30:45.123456",
+  "device_type": "mobile",
+  "platform": "ios",
+  "sdk_version": "3.2.1",
+  "session_id": "5f0c2a9e-61d4-4b8e-9a57-0f3c6d2b1e44",
+  "page": "/products/42?ref=home&utm_source=mail",
+  "properties": {"duration_ms": 1234.5, "scroll_depth": 0.75, "tags": ["sale", "new"], "position": 3}
+}`)
+
+// Inputs the canonical encoding must get exactly right
+var canonicalCases = []string{
+	string(benchEvent),
+	`{}`,
+	`{"b":1,"a":2,"a":3}`,
+	`{"n":[1.0,1e2,-0,0.000001,1e-7,123456789012345678,1.5e300,-2.50]}`,
+	`{"s":"tab\there","q":"say \"hi\"","u":"été","html":"<a href='x'>&</a>"}`,
+	`{"unicode":"日本語","sep":"a b","slash":"a\/b","ctl":"\u0001"}`,
+	`{"nested":{"z":{"y":[{"b":true,"a":null}]},"a":false}, "key": "escaped key"}`,
+	" \n{\"spaced\" :\t[ 1 , 2 ] }\n",
+}
+
+// TestCanonicalEncoding checks the canonical encoding against json.Marshal
+// of the decoded map; any difference would change event IDs
+func TestCanonicalEncoding(t *testing.T) {
+	for _, input := range canonicalCases {
+		env := acquireEnvelope()
+		if err := env.decode(bytes.NewReader([]byte(input))); err != nil {
+			t.Fatalf("decode %s: %v", input, err)
+		}
+		want, _ := json.Marshal(env.Fields)
+		if !bytes.Equal(env.Canon, want) {
+			t.Errorf("canonical form of %s\n got %s\nwant %s", input, env.Canon, want)
+		}
+		releaseEnvelope(env)
+	}
+}
+
+// TestEncodeEvent checks messages against json.Marshal of the stamped event,
+// with members spliced from the canonical bytes, replaced or added
+func TestEncodeEvent(t *testing.T) {
+	for _, input := range canonicalCases {
+		env := acquireEnvelope()
+		if err := env.decode(bytes.NewReader([]byte(input))); err != nil {
+			t.Fatalf("decode %s: %v", input, err)
+		}
+		stamp(env.Fields, env.id())
+		env.Fields["nested"] = map[string]interface{}{"replaced": []interface{}{1.5, "x"}}
+		env.Fields["count"] = 3
+		for _, source := range []*eventEnvelope{env, nil} {
+			buf, err := encodeEvent(env.Fields, source)
+			if err != nil {
+				t.Fatalf("encode %s: %v", input, err)
+			}
+			want, _ := json.Marshal(env.Fields)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("message for %s\n got %s\nwant %s", input, buf.Bytes(), want)
+			}
+			releaseMessage(buf)
+		}
+		releaseEnvelope(env)
+	}
+}
+
+// TestDecodeRejects checks that bodies json.Unmarshal refuses are refused
+func TestDecodeRejects(t *testing.T) {
+	for _, input := range []string{
+		``, `[]`, `"x"`, `{`, `{"a":1,}`, `{"a":01}`, `{"a":1.}`, `{"a":-}`,
+		`{"a":nul}`, `{"a":tru}`, `{"a" 1}`, `{"a":1}{}`, `{"a":1} x`,
+		`{"a":"unterminated}`, `{"a":"\x"}`, `{"a":[1,]}`, `{1:2}`,
+		"{\"a\":\"ctl\x01\"}",
+	} {
+		var target map[string]interface{}
+		if json.Unmarshal([]byte(input), &target) == nil {
+			t.Fatalf("json.Unmarshal accepts %q", input)
+		}
+		env := acquireEnvelope()
+		if err := env.decode(bytes.NewReader([]byte(input))); err == nil {
+			t.Errorf("decode accepted %q", input)
+		}
+		releaseEnvelope(env)
+	}
+
+	deep := strings.Repeat("[", maxNestingDepth+1) + strings.Repeat("]", maxNestingDepth+1)
+	env := acquireEnvelope()
+	if err := env.decode(strings.NewReader(`{"a":` + deep + `}`)); err != errTooDeep {
+		t.Errorf("decode of %d nested arrays = %v, want %v", maxNestingDepth+1, err, errTooDeep)
+	}
+	releaseEnvelope(env)
+}
+
+func baselineEventID(body []byte) (map[string]interface{}, string) {
+	var event map[string]interface{}
+	json.NewDecoder(bytes.NewReader(body)).Decode(&event)
+	data, _ := json.Marshal(event)
+	hash := sha256.Sum256(data)
+	return event, hex.EncodeToString(hash[:])
+}
+
+func stamp(event map[string]interface{}, id string) {
+	event["ingested_at"] = "2024-05-01T12:30:46Z"
+	event["service"] = "ingestion"
+	event["event_id"] = id
+}
+
+func BenchmarkDecodeAndID(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			baselineEventID(benchEvent)
+		}
+	})
+	b.Run("envelope", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			env := acquireEnvelope()
+			env.decode(bytes.NewReader(benchEvent))
+			env.id()
+			releaseEnvelope(env)
+		}
+	})
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	event, id := baselineEventID(benchEvent)
+	stamp(event, id)
+
+	b.Run("baseline", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.Marshal(event)
+		}
+	})
+	b.Run("envelope", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, _ := encodeEvent(event, nil)
+			releaseMessage(buf)
+		}
+	})
+}
+
+// BenchmarkHotPath runs decode, ID, stamping and encoding from parallel
+// goroutines and reports the 99th percentile latency per event
+func BenchmarkHotPath(b *testing.B) {
+	run := func(b *testing.B, handle func()) {
+		b.ReportAllocs()
+		var mu sync.Mutex
+		var latencies []time.Duration
+		b.RunParallel(func(pb *testing.PB) {
+			local := make([]time.Duration, 0, 1024)
+			for pb.Next() {
+				start := time.Now()
+				handle()
+				local = append(local, time.Since(start))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		})
+		if len(latencies) > 0 {
+			slices.Sort(latencies)
+			p99 := latencies[len(latencies)*99/100]
+			b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns")
+		}
+	}
+
+	b.Run("baseline", func(b *testing.B) {
+		run(b, func() {
+			event, id := baselineEventID(benchEvent)
+			stamp(event, id)
+			json.Marshal(event)
+		})
+	})
+	b.Run("envelope", func(b *testing.B) {
+		run(b, func() {
+			env := acquireEnvelope()
+			env.decode(bytes.NewReader(benchEvent))
+			stamp(env.Fields, env.id())
+			buf, _ := encodeEvent(env.Fields, env)
+			releaseMessage(buf)
+			releaseEnvelope(env)
+		})
+	})
+}
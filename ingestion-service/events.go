@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Timestamp layouts accepted for the client-supplied "timestamp" field.
+// The simulator sends Python isoformat() without a zone, which is UTC.
+var eventTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// Client-reported platforms and SDK versions become metric labels and Redis
+// keys, so only configured values are kept and anything else is "other"
+var (
+	clientPlatforms   map[string]bool
+	clientSDKVersions map[string]bool
+)
+
+func initClientLabels() {
+	clientPlatforms = labelSet(getEnv("CLIENT_PLATFORMS", "ios,android,web"))
+	clientSDKVersions = labelSet(getEnv("CLIENT_SDK_VERSIONS", ""))
+}
+
+func labelSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			set[value] = true
+		}
+	}
+	return set
+}
+
+// clientLabel maps a client-supplied field to a bounded label value:
+// "unknown" when absent, "other" when not in allowed
+func clientLabel(event map[string]interface{}, field string, allowed map[string]bool) string {
+	return boundedLabel(eventString(event, field), allowed)
+}
+
+func boundedLabel(value string, allowed map[string]bool) string {
+	switch {
+	case value == "":
+		return "unknown"
+	case allowed[value]:
+		return value
+	default:
+		return "other"
+	}
+}
+
+// Fields eventsHandler still reads once an event has been queued
+var summaryFields = []string{"event_id", "event_type", "user_id", "tenant_id", "residency_region", "ingested_at",
+	"platform", "device_type", "canary"}
+
+// eventSummary copies the fields the handler needs after queueing, since a
+// queued event belongs to a worker
+func eventSummary(event map[string]interface{}) map[string]interface{} {
+	summary := make(map[string]interface{}, len(summaryFields))
+	for _, field := range summaryFields {
+		if value, ok := event[field]; ok {
+			summary[field] = value
+		}
+	}
+	return summary
+}
+
+// eventString returns a string field from an event, or "" if absent
+func eventString(event map[string]interface{}, field string) string {
+	value, _ := event[field].(string)
+	return value
+}
+
+// eventTime returns the client event time, falling back to now
+func eventTime(event map[string]interface{}, now time.Time) time.Time {
+	if ts := eventString(event, "timestamp"); ts != "" {
+		for _, layout := range eventTimeLayouts {
+			if t, err := time.Parse(layout, ts); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return now.UTC()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Explode splits composite payloads (cart items, search results) into one
+// child event per array element. Children inherit the parent's fields, get
+// an item_index, a deterministic event_id and a parent_event_id, and are
+// produced with the parent atomically.
+//
+// Families do not go through a kafka.Writer, which merges concurrent calls
+// into shared batches and splits them by BatchSize and BatchBytes. Each
+// family is sent as its own produce request holding one record batch for
+// one partition, which the broker appends all or nothing. Families larger
+// than EXPLODE_MAX_FAMILY_BYTES, which must stay under the topic's
+// max.message.bytes, are rejected with 413 before they are queued.
+
+const (
+	explodeMaxItemsLimit = 1000
+	explodeAttempts      = 3
+)
+
+var errFamilyTooLarge = errors.New("exploded event is too large")
+
+var (
+	explodeRules          map[string]*explodeRule
+	explodeFamilies       *familyProducer
+	explodeMaxFamilyBytes int
+
+	explodeChildrenTotal = newCounterVec("explode_children_total", "Child events produced from composite events", "event_type")
+	explodeTooLargeTotal = newCounterVec("explode_too_large_total", "Composite events rejected for their family size", "event_type")
+)
+
+// explodeRule is one entry of EXPLODE_RULES_FILE
+type explodeRule struct {
+	EventType      string `json:"event_type"`
+	Field          string `json:"field"`
+	ChildEventType string `json:"child_event_type"` // default "<event_type>_item"
+	ItemPrefix     string `json:"item_prefix"`      // prefix for object item fields, default "item_"
+	MaxItems       int    `json:"max_items"`        // larger arrays are rejected, default 100
+	DropParent     bool   `json:"drop_parent"`      // produce only the children
+}
+
+func initExplode(brokers string) {
+	path := getEnv("EXPLODE_RULES_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var rules []*explodeRule
+	if err := loadJSONFile(path, &rules); err != nil {
+		log.Fatalf("Failed to load explode rules from %s: %v", path, err)
+	}
+
+	explodeRules = make(map[string]*explodeRule)
+	for _, rule := range rules {
+		if rule.EventType == "" || rule.Field == "" {
+			log.Fatalf("Explode rule needs event_type and field: %+v", rule)
+		}
+		if rule.ChildEventType == "" {
+			rule.ChildEventType = rule.EventType + "_item"
+		}
+		if rule.ItemPrefix == "" {
+			rule.ItemPrefix = "item_"
+		}
+		if rule.MaxItems <= 0 {
+			rule.MaxItems = 100
+		}
+		if rule.MaxItems > explodeMaxItemsLimit {
+			log.Fatalf("Explode rule %s: max_items above %d", rule.EventType, explodeMaxItemsLimit)
+		}
+		explodeRules[rule.EventType] = rule
+	}
+
+	explodeMaxFamilyBytes = getEnvInt("EXPLODE_MAX_FAMILY_BYTES", 1<<20)
+	if explodeMaxFamilyBytes <= 0 {
+		log.Fatalf("EXPLODE_MAX_FAMILY_BYTES must be positive")
+	}
+	explodeFamilies = newFamilyProducer(brokers, "raw-events")
+	log.Printf("Explode enabled for %d event types (families up to %d bytes)", len(explodeRules), explodeMaxFamilyBytes)
+}
+
+// explodeEvent returns the events to produce for a parent. Events without a
+// rule, or without an array in the rule's field, are returned unchanged.
+func explodeEvent(event map[string]interface{}) ([]map[string]interface{}, error) {
+	rule, ok := explodeRules[eventString(event, "event_type")]
+	if !ok {
+		return []map[string]interface{}{event}, nil
+	}
+	items, ok := event[rule.Field].([]interface{})
+	if !ok || len(items) == 0 {
+		return []map[string]interface{}{event}, nil
+	}
+	if len(items) > rule.MaxItems {
+		return nil, fmt.Errorf("%s has %d items, limit is %d", rule.Field, len(items), rule.MaxItems)
+	}
+
+	parentID := eventString(event, "event_id")
+	batch := make([]map[string]interface{}, 0, len(items)+1)
+	if !rule.DropParent {
+		event["child_count"] = len(items)
+		batch = append(batch, event)
+	}
+
+	for i, item := range items {
+		child := make(map[string]interface{}, len(event)+4)
+		for k, v := range event {
+			if k != rule.Field && k != "child_count" {
+				child[k] = v
+			}
+		}
+		if fields, ok := item.(map[string]interface{}); ok {
+			for k, v := range fields {
+				child[rule.ItemPrefix+k] = v
+			}
+		} else {
+			child["item"] = item
+		}
+
+		hash := sha256.Sum256([]byte(parentID + ":" + strconv.Itoa(i)))
+		child["event_id"] = hex.EncodeToString(hash[:])
+		child["event_type"] = rule.ChildEventType
+		child["parent_event_id"] = parentID
+		child["item_index"] = i
+		batch = append(batch, child)
+	}
+
+	explodeChildrenTotal.Add(float64(len(items)), rule.EventType)
+	return batch, nil
+}
+
+// checkFamilySize rejects a family whose messages, keyed by the parent and
+// carrying the lineage header, would not fit in one record batch
+func checkFamilySize(eventType string, batch []map[string]interface{}, trail *eventLineage) error {
+	var header int
+	if trail != nil {
+		lineage, _ := json.Marshal(trail)
+		header = len(lineageHeader) + len(lineage)
+	}
+	size := 0
+	for _, event := range batch {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		size += len(data) + len(eventString(event, "event_id")) + header
+	}
+	if size > explodeMaxFamilyBytes {
+		explodeTooLargeTotal.Inc(eventType)
+		return fmt.Errorf("%w: %d bytes with children, limit is %d", errFamilyTooLarge, size, explodeMaxFamilyBytes)
+	}
+	return nil
+}
+
+// familyProducer writes each family as one record batch in one produce
+// request to the partition the hash balancer picks for the family's key
+type familyProducer struct {
+	client  *kafka.Client
+	brokers string
+	topic   string
+
+	mu         sync.Mutex
+	partitions []int
+	refreshed  time.Time
+}
+
+func newFamilyProducer(brokers, topic string) *familyProducer {
+	return &familyProducer{
+		client:  &kafka.Client{Addr: kafka.TCP(brokers), Timeout: 10 * time.Second},
+		brokers: brokers,
+		topic:   topic,
+	}
+}
+
+// topicPartitions returns the sorted partition IDs, refreshed every minute
+func (p *familyProducer) topicPartitions() ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partitions == nil || time.Since(p.refreshed) > time.Minute {
+		partitions, err := readPartitions(p.brokers, p.topic)
+		if err != nil {
+			if p.partitions != nil {
+				return p.partitions, nil
+			}
+			return nil, err
+		}
+		sort.Ints(partitions)
+		p.partitions, p.refreshed = partitions, time.Now()
+	}
+	return p.partitions, nil
+}
+
+// produce writes the family's messages, which share one key
+func (p *familyProducer) produce(messages []kafka.Message) error {
+	partitions, err := p.topicPartitions()
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", p.topic)
+	}
+	partition := (&kafka.Hash{}).Balance(messages[0], partitions...)
+
+	for attempt := 1; ; attempt++ {
+		err = p.send(partition, messages)
+		if err == nil || attempt == explodeAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
+
+// send makes one produce request; records are rebuilt per attempt because
+// the request consumes them
+func (p *familyProducer) send(partition int, messages []kafka.Message) error {
+	now := time.Now()
+	records := make([]kafka.Record, len(messages))
+	for i, msg := range messages {
+		records[i] = kafka.Record{
+			Time:    now,
+			Key:     kafka.NewBytes(msg.Key),
+			Value:   kafka.NewBytes(msg.Value),
+			Headers: msg.Headers,
+		}
+	}
+	resp, err := p.client.Produce(ctx, &kafka.ProduceRequest{
+		Topic:        p.topic,
+		Partition:    partition,
+		RequiredAcks: kafka.RequireOne,
+		Compression:  kafka.Gzip,
+		Records:      kafka.NewRecordReader(records...),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	for _, err := range resp.RecordErrors {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckFamilySize(t *testing.T) {
+	savedRules, savedLimit := explodeRules, explodeMaxFamilyBytes
+	t.Cleanup(func() { explodeRules, explodeMaxFamilyBytes = savedRules, savedLimit })
+	explodeRules = map[string]*explodeRule{
+		"checkout": {EventType: "checkout", Field: "items", ChildEventType: "checkout_item", ItemPrefix: "item_", MaxItems: 100},
+	}
+
+	items := make([]interface{}, 10)
+	for i := range items {
+		items[i] = map[string]interface{}{"sku": strings.Repeat("x", 100)}
+	}
+	batch, err := explodeEvent(map[string]interface{}{"event_id": "p1", "event_type": "checkout", "items": items})
+	if err != nil {
+		t.Fatalf("explodeEvent: %v", err)
+	}
+	if len(batch) != 11 {
+		t.Fatalf("explodeEvent returned %d events, want 11", len(batch))
+	}
+
+	explodeMaxFamilyBytes = 1 << 20
+	if err := checkFamilySize("checkout", batch, nil); err != nil {
+		t.Errorf("checkFamilySize: %v", err)
+	}
+	// Every child counts, not just the parent that carries the items
+	explodeMaxFamilyBytes = 2000
+	if err := checkFamilySize("checkout", batch, nil); !errors.Is(err, errFamilyTooLarge) {
+		t.Errorf("checkFamilySize = %v, want errFamilyTooLarge", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"ingestion-service/watermark"
+)
+
+// Heartbeats write a watermark control message to every partition of
+// raw-events and of each residency region's topic, so downstream windowing
+// can tell an idle partition from a stalled pipeline and close windows on
+// quiet partitions.
+//
+// The watermark is the low watermark of event time accepted by this
+// replica: the oldest event still queued or in flight, or, when nothing is
+// pending, the newest event time produced minus HEARTBEAT_ALLOWED_LATENESS.
+// Event times ahead of the clock count as now, and the watermark never moves
+// backwards. Every topic gets the same watermark, so a region's is held back
+// by events pending for other regions too.
+
+const partitionHeader = "x-partition"
+
+var (
+	heartbeatWriter  *kafka.Writer
+	heartbeatBrokers string
+	producerID       string
+
+	inflightMu      sync.Mutex
+	inflightTimes   = make(map[string]time.Time) // event_id -> event time
+	maxProducedTime time.Time
+	lastWatermark   time.Time
+	allowedLateness time.Duration
+
+	heartbeatsTotal = newCounterVec("heartbeats_sent_total", "Watermark control messages written", "topic", "partition")
+	watermarkGauge  = newGaugeVec("watermark_unix_seconds", "Current low watermark of accepted event time")
+)
+
+// partitionBalancer routes control messages to the partition named in
+// their x-partition header
+type partitionBalancer struct{}
+
+func (partitionBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	for _, h := range msg.Headers {
+		if h.Key == partitionHeader {
+			if p, err := strconv.Atoi(string(h.Value)); err == nil {
+				for _, candidate := range partitions {
+					if candidate == p {
+						return p
+					}
+				}
+			}
+		}
+	}
+	return partitions[0]
+}
+
+func initHeartbeats(brokers string) {
+	if getEnvDuration("HEARTBEAT_INTERVAL", 0) <= 0 {
+		return
+	}
+
+	heartbeatBrokers = brokers
+	heartbeatWriter = newKafkaWriter(brokers, "raw-events")
+	heartbeatWriter.Balancer = partitionBalancer{}
+	allowedLateness = getEnvDuration("HEARTBEAT_ALLOWED_LATENESS", 5*time.Second)
+
+	producerID, _ = os.Hostname()
+	if producerID == "" {
+		producerID = "ingestion"
+	}
+}
+
+// trackInflight records an accepted event until it has been produced
+func trackInflight(event map[string]interface{}, now time.Time) {
+	if heartbeatWriter == nil {
+		return
+	}
+	// A skewed client clock must not hold the watermark in the future
+	t := eventTime(event, now)
+	if t.After(now) {
+		t = now
+	}
+	inflightMu.Lock()
+	inflightTimes[eventString(event, "event_id")] = t
+	inflightMu.Unlock()
+}
+
+// releaseInflight forgets a produced (or failed) batch, including coalesced
+// members and the parent of exploded children
+func releaseInflight(batch []map[string]interface{}, produced bool) {
+	if heartbeatWriter == nil {
+		return
+	}
+	now := time.Now()
+
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	for _, event := range batch {
+		ids := []string{eventString(event, "event_id"), eventString(event, "parent_event_id")}
+		if memberIDs, ok := event["coalesced_event_ids"].([]string); ok {
+			ids = append(ids, memberIDs...)
+		}
+		for _, id := range ids {
+			delete(inflightTimes, id)
+		}
+		if produced {
+			if t := eventTime(event, now); t.After(maxProducedTime) && !t.After(now) {
+				maxProducedTime = t
+			}
+		}
+	}
+}
+
+// currentWatermark computes the low watermark and keeps it monotonic
+func currentWatermark() time.Time {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	var wm time.Time
+	if len(inflightTimes) > 0 {
+		for _, t := range inflightTimes {
+			if wm.IsZero() || t.Before(wm) {
+				wm = t
+			}
+		}
+	} else if !maxProducedTime.IsZero() {
+		wm = maxProducedTime.Add(-allowedLateness)
+	}
+
+	if wm.Before(lastWatermark) {
+		wm = lastWatermark
+	}
+	lastWatermark = wm
+	return wm
+}
+
+// heartbeatTarget is a topic that gets watermarks
+type heartbeatTarget struct {
+	brokers string
+	topic   string
+	writer  *kafka.Writer
+}
+
+// heartbeatTargets lists raw-events and every region's topic, each once
+func heartbeatTargets() []heartbeatTarget {
+	names := make([]string, 0, len(residencyRegions))
+	for name := range residencyRegions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := []heartbeatTarget{{heartbeatBrokers, "raw-events", heartbeatWriter}}
+	seen := map[string]bool{heartbeatBrokers + "/raw-events": true}
+	for _, name := range names {
+		region := residencyRegions[name]
+		if key := region.Brokers + "/" + region.Topic; !seen[key] {
+			seen[key] = true
+			targets = append(targets, heartbeatTarget{region.Brokers, region.Topic, region.heartbeatWriter})
+		}
+	}
+	return targets
+}
+
+// heartbeatLoop writes one control message per partition of every target
+// every interval
+func heartbeatLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	targets := heartbeatTargets()
+	partitions := make([][]int, len(targets))
+	var refreshed time.Time
+
+	for now := range ticker.C {
+		if refreshed.IsZero() || now.Sub(refreshed) > time.Minute {
+			refreshed = now
+			for i, target := range targets {
+				if p, err := readPartitions(target.brokers, target.topic); err != nil {
+					log.Printf("Heartbeat: failed to read partitions of %s: %v", target.topic, err)
+					refreshed = time.Time{}
+				} else {
+					partitions[i] = p
+				}
+			}
+		}
+
+		wm := currentWatermark()
+		watermarkGauge.Set(float64(wm.Unix()))
+		for i, target := range targets {
+			sendHeartbeats(target, partitions[i], wm, now)
+		}
+	}
+}
+
+// sendHeartbeats writes the watermark to each of a topic's partitions
+func sendHeartbeats(target heartbeatTarget, partitions []int, wm, now time.Time) {
+	messages := make([]kafka.Message, 0, len(partitions))
+	for _, p := range partitions {
+		msg, err := watermark.Encode(watermark.Message{
+			Producer:  producerID,
+			Partition: p,
+			Watermark: wm,
+			EmittedAt: now.UTC(),
+		})
+		if err != nil {
+			log.Printf("Heartbeat: %v", err)
+			continue
+		}
+		msg.Headers = append(msg.Headers, kafka.Header{Key: partitionHeader, Value: []byte(strconv.Itoa(p))})
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	if err := target.writer.WriteMessages(ctx, messages...); err != nil {
+		log.Printf("Heartbeat: failed to write watermarks to %s: %v", target.topic, err)
+		return
+	}
+	for _, p := range partitions {
+		heartbeatsTotal.Inc(target.topic, strconv.Itoa(p))
+	}
+}
+
+// readPartitions lists the partition IDs of a topic
+func readPartitions(brokers, topic string) ([]int, error) {
+	conn, err := kafka.Dial("tcp", brokers)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	parts, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(parts))
+	for i, p := range parts {
+		ids[i] = p.ID
+	}
+	return ids, nil
+}
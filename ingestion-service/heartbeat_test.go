@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// resetInflight enables in-flight tracking with empty state
+func resetInflight(t *testing.T) {
+	t.Helper()
+	saved := heartbeatWriter
+	heartbeatWriter = &kafka.Writer{}
+	inflightTimes = make(map[string]time.Time)
+	maxProducedTime, lastWatermark, allowedLateness = time.Time{}, time.Time{}, 5*time.Second
+	t.Cleanup(func() { heartbeatWriter = saved })
+}
+
+func inflightEvent(id string, ts time.Time) map[string]interface{} {
+	return map[string]interface{}{"event_id": id, "timestamp": ts.Format(time.RFC3339)}
+}
+
+func TestWatermarkFollowsInflight(t *testing.T) {
+	resetInflight(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	first := inflightEvent("e1", now.Add(-time.Minute))
+	second := inflightEvent("e2", now.Add(-30*time.Second))
+	trackInflight(first, now)
+	trackInflight(second, now)
+
+	// Held back by the oldest pending event
+	if wm := currentWatermark(); !wm.Equal(now.Add(-time.Minute)) {
+		t.Errorf("watermark = %s, want %s", wm, now.Add(-time.Minute))
+	}
+
+	releaseInflight([]map[string]interface{}{first}, true)
+	if wm := currentWatermark(); !wm.Equal(now.Add(-30 * time.Second)) {
+		t.Errorf("watermark = %s, want %s", wm, now.Add(-30*time.Second))
+	}
+
+	// With nothing pending it follows the newest produced event less the
+	// allowed lateness, but never moves back
+	releaseInflight([]map[string]interface{}{second}, true)
+	if wm := currentWatermark(); !wm.Equal(now.Add(-30 * time.Second)) {
+		t.Errorf("watermark = %s, want %s", wm, now.Add(-30*time.Second))
+	}
+	trackInflight(inflightEvent("e3", now.Add(-time.Hour)), now)
+	if wm := currentWatermark(); !wm.Equal(now.Add(-30 * time.Second)) {
+		t.Errorf("watermark moved back to %s", wm)
+	}
+	releaseInflight([]map[string]interface{}{inflightEvent("e3", now)}, true)
+	if wm := currentWatermark(); !wm.Equal(now.Add(-allowedLateness)) {
+		t.Errorf("watermark = %s, want %s", wm, now.Add(-allowedLateness))
+	}
+}
+
+func TestReleaseAfterFailedWrite(t *testing.T) {
+	resetInflight(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	event := inflightEvent("e1", now.Add(-time.Minute))
+	trackInflight(event, now)
+	currentWatermark()
+
+	releaseInflight([]map[string]interface{}{event}, false)
+	if len(inflightTimes) != 0 {
+		t.Errorf("%d events still in flight after a failed write", len(inflightTimes))
+	}
+	if !maxProducedTime.IsZero() {
+		t.Errorf("failed write counted as produced at %s", maxProducedTime)
+	}
+
+	// A later event moves the watermark on instead of being held back
+	later := inflightEvent("e2", now)
+	trackInflight(later, now)
+	if wm := currentWatermark(); !wm.Equal(now) {
+		t.Errorf("watermark = %s, want %s", wm, now)
+	}
+}
+
+func TestReleaseCoalescedMembers(t *testing.T) {
+	resetInflight(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	members := make([]string, coalesceMaxMembers)
+	for i := range members {
+		members[i] = fmt.Sprintf("m%d", i)
+		trackInflight(inflightEvent(members[i], now.Add(-time.Minute)), now)
+	}
+
+	merged := inflightEvent(members[0], now.Add(-time.Minute))
+	merged["coalesced_event_ids"] = members
+	releaseInflight([]map[string]interface{}{merged}, true)
+	if len(inflightTimes) != 0 {
+		t.Errorf("%d coalesced members still in flight", len(inflightTimes))
+	}
+}
+
+func TestReleaseExplodedFamily(t *testing.T) {
+	resetInflight(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	parent := inflightEvent("p1", now.Add(-time.Minute))
+	trackInflight(parent, now)
+
+	children := []map[string]interface{}{
+		{"event_id": "c0", "parent_event_id": "p1", "timestamp": parent["timestamp"]},
+		{"event_id": "c1", "parent_event_id": "p1", "timestamp": parent["timestamp"]},
+	}
+	releaseInflight(children, false)
+	if len(inflightTimes) != 0 {
+		t.Errorf("parent still in flight after its children's write failed")
+	}
+}
+
+func TestInflightFutureEventTime(t *testing.T) {
+	resetInflight(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	skewed := inflightEvent("e1", now.Add(time.Hour))
+	trackInflight(skewed, now)
+
+	// The watermark stops at the clock instead of the client's hour ahead
+	if wm := currentWatermark(); wm.After(now) {
+		t.Errorf("watermark = %s, ahead of %s", wm, now)
+	}
+	releaseInflight([]map[string]interface{}{skewed}, true)
+	if !maxProducedTime.IsZero() {
+		t.Errorf("future event time counted as produced at %s", maxProducedTime)
+	}
+	trackInflight(inflightEvent("e2", now.Add(time.Second)), now.Add(time.Second))
+	if wm := currentWatermark(); !wm.Equal(now.Add(time.Second)) {
+		t.Errorf("watermark = %s, want %s", wm, now.Add(time.Second))
+	}
+}
+
+func TestHeartbeatTargets(t *testing.T) {
+	saved, savedBrokers := residencyRegions, heartbeatBrokers
+	t.Cleanup(func() { residencyRegions, heartbeatBrokers = saved, savedBrokers })
+	heartbeatBrokers = "kafka:9092"
+	residencyRegions = map[string]*residencyRegion{
+		"us": {Brokers: "kafka:9092", Topic: "raw-events"},
+		"eu": {Brokers: "kafka-eu:9092", Topic: "raw-events-eu"},
+		"ch": {Brokers: "kafka-eu:9092", Topic: "raw-events-eu"},
+	}
+
+	var got []string
+	for _, target := range heartbeatTargets() {
+		got = append(got, target.brokers+"/"+target.topic)
+	}
+	want := []string{"kafka:9092/raw-events", "kafka-eu:9092/raw-events-eu"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("heartbeatTargets = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The lag exporter computes per-partition offset lag and time lag for the
+// consumer groups in LAG_CONSUMER_GROUPS (e.g. feature-computation-group-v2)
+// and exports them as kafka_consumergroup_lag{,_seconds} gauges, the names
+// the Grafana dashboard already queries.
+//
+// Time lag is the age of the oldest unconsumed message: now minus the
+// timestamp of the record at the committed offset.
+//
+// When lag exceeds LAG_READY_MAX_MESSAGES or LAG_READY_MAX_SECONDS, /ready
+// returns 503, and with LAG_THROTTLE_INTAKE=true /events sheds load too.
+
+type lagTarget struct {
+	group string
+	topic string
+}
+
+// lagStatus is the last computed lag for one group and topic
+type lagStatus struct {
+	Group       string  `json:"group"`
+	Topic       string  `json:"topic"`
+	Lag         int64   `json:"lag"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	Partitions  int     `json:"partitions"`
+	Error       string  `json:"error,omitempty"`
+	Exceeded    bool    `json:"exceeded"`
+	CollectedAt string  `json:"collected_at"`
+}
+
+var (
+	lagClient     *kafka.Client
+	lagTargets    []lagTarget
+	lagMaxMsgs    int64
+	lagMaxSeconds float64
+	lagThrottle   bool
+
+	lagMu       sync.RWMutex
+	lagStatuses = make(map[string]*lagStatus)
+
+	lagGauge        = newGaugeVec("kafka_consumergroup_lag", "Messages behind the latest offset", "consumergroup", "topic", "partition")
+	lagSecondsGauge = newGaugeVec("kafka_consumergroup_lag_seconds", "Age of the oldest unconsumed message", "consumergroup", "topic", "partition")
+	lagTotalGauge   = newGaugeVec("kafka_consumergroup_lag_sum", "Messages behind across all partitions", "consumergroup", "topic")
+	lagThrottled    = newCounterVec("lag_throttled_requests_total", "Events rejected because consumers are lagging")
+)
+
+func initLagExporter(brokers string) {
+	groups := getEnv("LAG_CONSUMER_GROUPS", "")
+	if groups == "" {
+		return
+	}
+
+	topics := strings.Split(getEnv("LAG_TOPICS", "raw-events"), ",")
+	for _, group := range strings.Split(groups, ",") {
+		for _, topic := range topics {
+			lagTargets = append(lagTargets, lagTarget{group: strings.TrimSpace(group), topic: strings.TrimSpace(topic)})
+		}
+	}
+
+	lagClient = &kafka.Client{Addr: kafka.TCP(brokers), Timeout: 10 * time.Second}
+	lagMaxMsgs = int64(getEnvInt("LAG_READY_MAX_MESSAGES", 0))
+	lagMaxSeconds = float64(getEnvInt("LAG_READY_MAX_SECONDS", 0))
+	lagThrottle = getEnvBool("LAG_THROTTLE_INTAKE", false)
+	log.Printf("Lag exporter enabled for %d group/topic pairs", len(lagTargets))
+}
+
+// lagLoop refreshes lag for every target
+func lagLoop(interval time.Duration) {
+	for {
+		for _, target := range lagTargets {
+			status := collectLag(target)
+			lagMu.Lock()
+			lagStatuses[target.group+"/"+target.topic] = status
+			lagMu.Unlock()
+			if status.Error != "" {
+				log.Printf("Lag exporter: %s/%s: %s", target.group, target.topic, status.Error)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func collectLag(target lagTarget) *lagStatus {
+	now := time.Now()
+	status := &lagStatus{Group: target.group, Topic: target.topic, CollectedAt: now.UTC().Format(time.RFC3339)}
+	fail := func(err error) *lagStatus {
+		status.Error = err.Error()
+		return status
+	}
+
+	meta, err := lagClient.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{target.topic}})
+	if err != nil {
+		return fail(err)
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return fail(fmt.Errorf("topic %s not found", target.topic))
+	}
+	var partitions []int
+	var offsetRequests []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+		offsetRequests = append(offsetRequests, kafka.LastOffsetOf(p.ID))
+	}
+
+	committed, err := lagClient.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: target.group,
+		Topics:  map[string][]int{target.topic: partitions},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if committed.Error != nil {
+		return fail(committed.Error)
+	}
+
+	latest, err := lagClient.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{target.topic: offsetRequests},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	endOffsets := make(map[int]int64)
+	for _, p := range latest.Topics[target.topic] {
+		if p.Error == nil {
+			endOffsets[p.Partition] = p.LastOffset
+		}
+	}
+
+	// No commit yet: the group will start from the oldest retained record
+	startOffsets, err := firstOffsets(target.topic, committed.Topics[target.topic])
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, p := range committed.Topics[target.topic] {
+		end, ok := endOffsets[p.Partition]
+		if !ok || p.Error != nil {
+			continue
+		}
+		offset := p.CommittedOffset
+		if offset < 0 {
+			if offset, ok = startOffsets[p.Partition]; !ok {
+				continue
+			}
+		}
+		lag := end - offset
+		if lag < 0 {
+			lag = 0
+		}
+
+		lagSeconds := 0.0
+		if lag > 0 {
+			if ts, err := recordTime(target.topic, p.Partition, offset); err == nil {
+				lagSeconds = now.Sub(ts).Seconds()
+			}
+		}
+
+		partition := strconv.Itoa(p.Partition)
+		lagGauge.Set(float64(lag), target.group, target.topic, partition)
+		lagSecondsGauge.Set(lagSeconds, target.group, target.topic, partition)
+
+		status.Lag += lag
+		status.Partitions++
+		if lagSeconds > status.LagSeconds {
+			status.LagSeconds = lagSeconds
+		}
+	}
+
+	lagTotalGauge.Set(float64(status.Lag), target.group, target.topic)
+	status.Exceeded = (lagMaxMsgs > 0 && status.Lag > lagMaxMsgs) ||
+		(lagMaxSeconds > 0 && status.LagSeconds > lagMaxSeconds)
+	return status
+}
+
+// recordTime returns the timestamp of the record at an offset
+// firstOffsets returns the first retained offset of each partition without
+// a committed offset. It is its own request: responses are matched to
+// requests by partition, so one request cannot ask for both ends.
+func firstOffsets(topic string, partitions []kafka.OffsetFetchPartition) (map[int]int64, error) {
+	var requests []kafka.OffsetRequest
+	for _, p := range partitions {
+		if p.Error == nil && p.CommittedOffset < 0 {
+			requests = append(requests, kafka.FirstOffsetOf(p.Partition))
+		}
+	}
+	offsets := make(map[int]int64)
+	if len(requests) == 0 {
+		return offsets, nil
+	}
+
+	first, err := lagClient.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range first.Topics[topic] {
+		if p.Error == nil {
+			offsets[p.Partition] = p.FirstOffset
+		}
+	}
+	return offsets, nil
+}
+
+func recordTime(topic string, partition int, offset int64) (time.Time, error) {
+	resp, err := lagClient.Fetch(ctx, &kafka.FetchRequest{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		MaxBytes:  64 * 1024,
+		MaxWait:   100 * time.Millisecond,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.Error != nil {
+		return time.Time{}, resp.Error
+	}
+
+	// Batches may start before the requested offset
+	for {
+		record, err := resp.Records.ReadRecord()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if record.Offset >= offset {
+			return record.Time, nil
+		}
+	}
+}
+
+// lagExceeded reports whether any consumer group is over its lag budget
+func lagExceeded() bool {
+	lagMu.RLock()
+	defer lagMu.RUnlock()
+	for _, status := range lagStatuses {
+		if status.Exceeded {
+			return true
+		}
+	}
+	return false
+}
+
+// lagSnapshot returns the last collected status per group and topic
+func lagSnapshot() []*lagStatus {
+	lagMu.RLock()
+	defer lagMu.RUnlock()
+	out := make([]*lagStatus, 0, len(lagStatuses))
+	for _, status := range lagStatuses {
+		out = append(out, status)
+	}
+	return out
+}
+
+// readyHandler reports not-ready while downstream consumers are lagging
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ready := !lagExceeded()
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":     ready,
+		"consumers": lagSnapshot(),
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Lineage records what touched each event on its way through ingestion: the
+// stages it passed, the rules that matched (dedup policy, explode and
+// coalesce rules, lookup tables, tenant, residency region), the versions of
+// the enrichment tables, a hash of the service configuration and the build.
+// With LINEAGE_ENABLED the trail is sent as the "lineage" header of every
+// produced Kafka message and kept in the event's status record, where
+// GET /events/lineage?event_id=<id> serves it.
+//
+// The trail travels in the queued batch, not in the event map, so workers
+// never write to an event the handler may still be reading. Exploded
+// children share their parent's trail and a coalesced event carries its
+// first member's.
+
+const lineageHeader = "lineage"
+
+// buildVersion can be set with -ldflags "-X main.buildVersion=..."; it
+// defaults to the VCS revision embedded by the Go toolchain
+var buildVersion string
+
+// Re-read at runtime, so not part of the config hash; the enrichment tables
+// among them are versioned per event instead
+var reloadedFiles = map[string]bool{"FX_RATES_FILE": true, "HOLIDAY_CALENDAR_FILE": true, "ANOMALY_MUTE_FILE": true, "RECEIPT_KEYS_FILE": true}
+
+var (
+	lineageEnabled bool
+	configVersion  string
+
+	buildInfoGauge = newGaugeVec("build_info", "Build and configuration of the running service", "version", "config_version", "go_version")
+)
+
+// eventLineage is the trail of one event
+type eventLineage struct {
+	Build  string            `json:"build"`
+	Config string            `json:"config"`
+	Route  string            `json:"route"`
+	Stages []string          `json:"stages"`
+	Rules  []string          `json:"rules,omitempty"`
+	Tables map[string]string `json:"tables,omitempty"`
+}
+
+// initLineage runs after every other stage so the config hash covers all
+// settings read at startup
+func initLineage() {
+	lineageEnabled = getEnvBool("LINEAGE_ENABLED", false)
+	if buildVersion == "" {
+		buildVersion = vcsBuild()
+	}
+	configVersion = hashConfig()
+	buildInfoGauge.Set(1, buildVersion, configVersion, runtime.Version())
+	log.Printf("Build %s, config version %s", buildVersion, configVersion)
+}
+
+// vcsBuild returns the short VCS revision, or "dev" outside a checkout
+func vcsBuild() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return "dev"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// hashConfig hashes every setting with the contents of the rule files they
+// name
+func hashConfig() string {
+	hash := sha256.New()
+	for _, s := range effectiveConfig() {
+		hash.Write([]byte(s.Name + "=" + s.Value + "\n"))
+		if strings.HasSuffix(s.Name, "_FILE") && s.Value != "" && !reloadedFiles[s.Name] {
+			if data, err := os.ReadFile(s.Value); err == nil {
+				hash.Write(data)
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// newLineage starts the trail of an event received on route, or returns nil
+// when lineage is off; every method is a no-op on nil
+func newLineage(route string) *eventLineage {
+	if !lineageEnabled {
+		return nil
+	}
+	return &eventLineage{Build: buildVersion, Config: configVersion, Route: route}
+}
+
+// add records a stage and, if set, the rule it applied
+func (l *eventLineage) add(stage, rule string) {
+	if l == nil {
+		return
+	}
+	l.Stages = append(l.Stages, stage)
+	if rule != "" {
+		l.Rules = append(l.Rules, stage+":"+rule)
+	}
+}
+
+// table records the version of an enrichment table
+func (l *eventLineage) table(name, version string) {
+	if l == nil || version == "" {
+		return
+	}
+	if l.Tables == nil {
+		l.Tables = make(map[string]string)
+	}
+	l.Tables[name] = version
+}
+
+// recordLineage stores the trail of a produced batch in its status record,
+// under the parent's ID for exploded children
+func recordLineage(event map[string]interface{}, data []byte) {
+	eventID := eventString(event, "event_id")
+	if parentID := eventString(event, "parent_event_id"); parentID != "" {
+		eventID = parentID
+	}
+	recordStatus(event, eventID, map[string]interface{}{"lineage": string(data)})
+}
+
+// lineageHandler serves the trail of an event, following coalesced members
+// to the event they were merged into
+func lineageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	eventID := r.URL.Query().Get("event_id")
+	if eventID == "" {
+		http.Error(w, "event_id is required", http.StatusBadRequest)
+		return
+	}
+
+	client, prefix := regionRedis(map[string]interface{}{"residency_region": r.URL.Query().Get("region")})
+	response := map[string]interface{}{"event_id": eventID}
+	id := eventID
+	for hops := 0; hops < 2; hops++ {
+		fields, err := client.HMGet(ctx, prefix+statusPrefix+id, "lineage", "coalesced_into").Result()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if data, ok := fields[0].(string); ok {
+			var trail eventLineage
+			json.Unmarshal([]byte(data), &trail)
+			response["lineage"] = trail
+			break
+		}
+		into, ok := fields[1].(string)
+		if !ok {
+			break
+		}
+		response["coalesced_into"] = into
+		id = into
+	}
+	if response["lineage"] == nil {
+		http.Error(w, "No lineage recorded for event_id", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
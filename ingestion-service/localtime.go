@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // the alpine runtime image ships without zoneinfo
+)
+
+// Local time enrichment resolves each user's timezone and attaches local
+// calendar fields so temporal features reflect the user's day, not UTC.
+//
+// Resolution order, recorded in timezone_source:
+//   event   - an IANA "timezone" field on the event
+//   profile - the field a lookup table attached (TZ_PROFILE_FIELD)
+//   geo     - the event's "country" mapped to its primary timezone
+//   default - TZ_DEFAULT
+
+var (
+	localTimeEnabled bool
+	tzProfileField   string
+	tzDefault        *time.Location
+	tzLocations      sync.Map // name -> *time.Location, valid names only
+
+	// Primary timezone per ISO 3166 country, extended by TZ_GEO_FILE
+	tzByCountry = map[string]string{
+		"US": "America/New_York", "CA": "America/Toronto", "MX": "America/Mexico_City",
+		"BR": "America/Sao_Paulo", "AR": "America/Argentina/Buenos_Aires",
+		"GB": "Europe/London", "IE": "Europe/Dublin", "FR": "Europe/Paris",
+		"DE": "Europe/Berlin", "ES": "Europe/Madrid", "IT": "Europe/Rome",
+		"NL": "Europe/Amsterdam", "PL": "Europe/Warsaw", "SE": "Europe/Stockholm",
+		"TR": "Europe/Istanbul", "RU": "Europe/Moscow", "ZA": "Africa/Johannesburg",
+		"NG": "Africa/Lagos", "EG": "Africa/Cairo", "KE": "Africa/Nairobi",
+		"AE": "Asia/Dubai", "IN": "Asia/Kolkata", "PK": "Asia/Karachi",
+		"BD": "Asia/Dhaka", "TH": "Asia/Bangkok", "VN": "Asia/Ho_Chi_Minh",
+		"ID": "Asia/Jakarta", "SG": "Asia/Singapore", "MY": "Asia/Kuala_Lumpur",
+		"PH": "Asia/Manila", "CN": "Asia/Shanghai", "HK": "Asia/Hong_Kong",
+		"TW": "Asia/Taipei", "KR": "Asia/Seoul", "JP": "Asia/Tokyo",
+		"AU": "Australia/Sydney", "NZ": "Pacific/Auckland",
+	}
+
+	holidays = &holidayCalendar{}
+
+	tzSourceTotal = newCounterVec("timezone_resolved_total", "Events by timezone resolution source", "source")
+)
+
+// holidayCalendar holds local dates from HOLIDAY_CALENDAR_FILE, keyed by
+// "<country>|<YYYY-MM-DD>" where country "*" applies everywhere
+type holidayCalendar struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	version string
+	days    map[string]string
+}
+
+func initLocalTime() {
+	if !getEnvBool("LOCAL_TIME_ENABLED", false) {
+		return
+	}
+
+	tzProfileField = getEnv("TZ_PROFILE_FIELD", "user_timezone")
+	name := getEnv("TZ_DEFAULT", "UTC")
+	tzDefault = loadLocation(name)
+	if tzDefault == nil {
+		log.Fatalf("Invalid TZ_DEFAULT %q", name)
+	}
+
+	if path := getEnv("TZ_GEO_FILE", ""); path != "" {
+		if err := loadGeoTimezones(path); err != nil {
+			log.Fatalf("Failed to load %s: %v", path, err)
+		}
+	}
+
+	if path := getEnv("HOLIDAY_CALENDAR_FILE", ""); path != "" {
+		holidays.path = path
+		if err := holidays.reload(); err != nil {
+			log.Fatalf("Failed to load holiday calendar %s: %v", path, err)
+		}
+		go holidays.refreshLoop(getEnvDuration("HOLIDAY_RELOAD_INTERVAL", 10*time.Minute))
+	}
+
+	localTimeEnabled = true
+	log.Printf("Local time enrichment enabled (default %s)", name)
+}
+
+// loadLocation caches time.LoadLocation, returning nil for unknown names.
+// Only valid zones are cached, so the cache is bounded by the zone database
+// however many distinct invalid names clients send.
+func loadLocation(name string) *time.Location {
+	if cached, ok := tzLocations.Load(name); ok {
+		return cached.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	tzLocations.Store(name, loc)
+	return loc
+}
+
+// loadGeoTimezones reads "country,timezone" rows overriding the built-ins
+func loadGeoTimezones(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if len(record) < 2 || record[0] == "country" {
+			continue
+		}
+		tzByCountry[strings.ToUpper(record[0])] = record[1]
+	}
+	return nil
+}
+
+// reload reads "date,country,name" rows if the file changed
+func (c *holidayCalendar) reload() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	days := make(map[string]string)
+	reader := csv.NewReader(io.TeeReader(f, hash))
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 || record[0] == "date" {
+			continue
+		}
+		name := ""
+		if len(record) > 2 {
+			name = record[2]
+		}
+		days[strings.ToUpper(record[1])+"|"+record[0]] = name
+	}
+
+	c.mu.Lock()
+	c.days = days
+	c.modTime = info.ModTime()
+	c.version = hex.EncodeToString(hash.Sum(nil))[:12]
+	c.mu.Unlock()
+	log.Printf("Loaded holiday calendar: %d entries (version %s)", len(days), c.version)
+	return nil
+}
+
+// Version identifies the loaded calendar contents
+func (c *holidayCalendar) Version() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+func (c *holidayCalendar) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := c.reload(); err != nil {
+			log.Printf("Failed to reload holiday calendar: %v", err)
+		}
+	}
+}
+
+// lookup returns the holiday name for a local date in a country
+func (c *holidayCalendar) lookup(country string, local time.Time) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	date := local.Format("2006-01-02")
+	if country != "" {
+		if name, ok := c.days[country+"|"+date]; ok {
+			return name, true
+		}
+	}
+	name, ok := c.days["*|"+date]
+	return name, ok
+}
+
+// resolveTimezone picks the event's timezone and reports where it came from
+func resolveTimezone(event map[string]interface{}) (*time.Location, string) {
+	if name := eventString(event, "timezone"); name != "" {
+		if loc := loadLocation(name); loc != nil {
+			return loc, "event"
+		}
+	}
+	if name := eventString(event, tzProfileField); name != "" {
+		if loc := loadLocation(name); loc != nil {
+			return loc, "profile"
+		}
+	}
+	if name, ok := tzByCountry[strings.ToUpper(eventString(event, "country"))]; ok {
+		if loc := loadLocation(name); loc != nil {
+			return loc, "geo"
+		}
+	}
+	return tzDefault, "default"
+}
+
+// applyLocalTime attaches local calendar fields derived from the event time
+func applyLocalTime(event map[string]interface{}, now time.Time) {
+	loc, source := resolveTimezone(event)
+	local := eventTime(event, now).In(loc)
+
+	// Monday=0 to match Python's datetime.weekday() used by the processor
+	weekday := (int(local.Weekday()) + 6) % 7
+	holidayName, isHoliday := holidays.lookup(strings.ToUpper(eventString(event, "country")), local)
+
+	// The client's own timezone field is left as sent
+	event["local_timezone"] = loc.String()
+	event["timezone_source"] = source
+	event["local_timestamp"] = local.Format(time.RFC3339)
+	event["local_hour"] = local.Hour()
+	event["local_day_of_week"] = weekday
+	event["local_is_weekend"] = weekday >= 5
+	event["local_is_holiday"] = isHoliday
+	if isHoliday && holidayName != "" {
+		event["local_holiday_name"] = holidayName
+	}
+
+	tzSourceTotal.Inc(source)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"ingestion-service/parquet"
+)
+
+// Lookup enrichment joins slowly changing dimensions (plan tier, cohort,
+// region, item category) onto events at ingest. Each table joins on one
+// event field against either a Redis hash per key or a local CSV or Parquet
+// file that is reloaded when it changes.
+
+const (
+	lookupMissSkip    = "skip"    // leave the event untouched
+	lookupMissDefault = "default" // attach the table's defaults
+	lookupMissReject  = "reject"  // refuse the event with 422
+)
+
+var (
+	lookupTables []*lookupTable
+
+	lookupHitsTotal      = newCounterVec("lookup_hits_total", "Lookups that found a row", "table")
+	lookupMissesTotal    = newCounterVec("lookup_misses_total", "Lookups that found no row", "table")
+	lookupCacheHitsTotal = newCounterVec("lookup_cache_hits_total", "Lookups answered from the LRU cache", "table")
+	lookupErrorsTotal    = newCounterVec("lookup_errors_total", "Lookups that failed against the source", "table")
+	lookupRowsGauge      = newGaugeVec("lookup_table_rows", "Rows loaded for file-backed tables", "table")
+)
+
+// errLookupMiss is returned when a table with the reject policy has no row
+var errLookupMiss = errors.New("lookup miss")
+
+// lookupTable is one entry of LOOKUP_TABLES_FILE
+type lookupTable struct {
+	Name       string            `json:"name"`
+	JoinField  string            `json:"join_field"`
+	Source     string            `json:"source"`     // "redis", "csv" or "parquet"
+	KeyPrefix  string            `json:"key_prefix"` // redis: hash key is prefix + join value
+	Path       string            `json:"path"`       // csv: file with a header row; parquet: flat file
+	KeyColumn  string            `json:"key_column"` // csv, parquet: column matched against the join value
+	Fields     []string          `json:"fields"`     // columns to attach, empty means all
+	Prefix     string            `json:"prefix"`     // prepended to attached field names
+	MissPolicy string            `json:"miss_policy"`
+	Defaults   map[string]string `json:"defaults"`
+	CacheSize  int               `json:"cache_size"`
+	CacheTTL   string            `json:"cache_ttl"`
+	Refresh    string            `json:"refresh"` // csv, parquet: how often to check for changes
+
+	cache *lruCache
+
+	mu      sync.RWMutex
+	rows    map[string]map[string]string
+	modTime time.Time
+	version string
+}
+
+func initLookups() {
+	path := getEnv("LOOKUP_TABLES_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var tables []*lookupTable
+	if err := loadJSONFile(path, &tables); err != nil {
+		log.Fatalf("Failed to load lookup tables from %s: %v", path, err)
+	}
+	for _, t := range tables {
+		if err := t.init(); err != nil {
+			log.Fatalf("Invalid lookup table %q: %v", t.Name, err)
+		}
+	}
+
+	lookupTables = tables
+	log.Printf("Lookup enrichment enabled with %d tables", len(tables))
+}
+
+func (t *lookupTable) init() error {
+	if t.Name == "" || t.JoinField == "" {
+		return errors.New("name and join_field are required")
+	}
+	if t.MissPolicy == "" {
+		t.MissPolicy = lookupMissSkip
+	}
+	if t.MissPolicy != lookupMissSkip && t.MissPolicy != lookupMissDefault && t.MissPolicy != lookupMissReject {
+		return fmt.Errorf("unknown miss_policy %q", t.MissPolicy)
+	}
+
+	switch t.Source {
+	case "redis":
+		if t.CacheSize <= 0 {
+			t.CacheSize = 10000
+		}
+		ttl, err := time.ParseDuration(t.CacheTTL)
+		if err != nil {
+			ttl = 5 * time.Minute
+		}
+		t.cache = newLRUCache(t.CacheSize, ttl)
+		t.version = "redis:" + t.KeyPrefix
+	case "csv", "parquet":
+		if t.Path == "" || t.KeyColumn == "" {
+			return fmt.Errorf("%s tables need path and key_column", t.Source)
+		}
+		if err := t.reload(); err != nil {
+			return err
+		}
+		refresh, err := time.ParseDuration(t.Refresh)
+		if err != nil {
+			refresh = time.Minute
+		}
+		go t.refreshLoop(refresh)
+	default:
+		return fmt.Errorf("unknown source %q", t.Source)
+	}
+	return nil
+}
+
+// reload re-reads the file if its modification time changed
+func (t *lookupTable) reload() error {
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	unchanged := info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	read := t.readCSV
+	if t.Source == "parquet" {
+		read = t.readParquet
+	}
+	rows, version, err := read()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.rows = rows
+	t.modTime = info.ModTime()
+	t.version = version
+	t.mu.Unlock()
+
+	lookupRowsGauge.Set(float64(len(rows)), t.Name)
+	log.Printf("Loaded lookup table %s: %d rows (version %s)", t.Name, len(rows), version)
+	return nil
+}
+
+// readCSV reads the rows of a CSV table and the hash of its contents
+func (t *lookupTable) readCSV() (map[string]map[string]string, string, error) {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	reader := csv.NewReader(io.TeeReader(f, hash))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading header: %w", err)
+	}
+	keyIndex := -1
+	for i, col := range header {
+		if col == t.KeyColumn {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		return nil, "", fmt.Errorf("key column %q not in header", t.KeyColumn)
+	}
+
+	rows := make(map[string]map[string]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		row := make(map[string]string)
+		for i, col := range header {
+			if i != keyIndex && t.wants(col) {
+				row[col] = record[i]
+			}
+		}
+		rows[record[keyIndex]] = row
+	}
+	return rows, hex.EncodeToString(hash.Sum(nil))[:12], nil
+}
+
+// readParquet reads the rows of a Parquet table and the hash of its
+// contents. Null values are left out of a row, and rows without a key
+// cannot be joined and are skipped.
+func (t *lookupTable) readParquet() (map[string]map[string]string, string, error) {
+	data, err := os.ReadFile(t.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	table, err := parquet.Parse(data)
+	if err != nil {
+		return nil, "", err
+	}
+	key := table.Column(t.KeyColumn)
+	if key == nil {
+		return nil, "", fmt.Errorf("key column %q not in schema", t.KeyColumn)
+	}
+
+	rows := make(map[string]map[string]string, table.NumRows)
+	for i := 0; i < table.NumRows; i++ {
+		if key.Null != nil && key.Null[i] {
+			continue
+		}
+		row := make(map[string]string)
+		for _, col := range table.Columns {
+			if col != key && t.wants(col.Name) && (col.Null == nil || !col.Null[i]) {
+				row[col.Name] = col.Values[i]
+			}
+		}
+		rows[key.Values[i]] = row
+	}
+	hash := sha256.Sum256(data)
+	return rows, hex.EncodeToString(hash[:])[:12], nil
+}
+
+func (t *lookupTable) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := t.reload(); err != nil {
+			log.Printf("Failed to reload lookup table %s: %v", t.Name, err)
+		}
+	}
+}
+
+func (t *lookupTable) wants(field string) bool {
+	if len(t.Fields) == 0 {
+		return true
+	}
+	for _, f := range t.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Version identifies the loaded table contents
+func (t *lookupTable) Version() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version
+}
+
+// get returns the row for key, or nil if there is none
+func (t *lookupTable) get(key string) (map[string]string, error) {
+	if t.Source != "redis" {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		return t.rows[key], nil
+	}
+
+	if row, ok := t.cache.Get(key); ok {
+		lookupCacheHitsTotal.Inc(t.Name)
+		return row, nil
+	}
+
+	var row map[string]string
+	if len(t.Fields) == 0 {
+		all, err := redisClient.HGetAll(ctx, t.KeyPrefix+key).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(all) > 0 {
+			row = all
+		}
+	} else {
+		values, err := redisClient.HMGet(ctx, t.KeyPrefix+key, t.Fields...).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				if row == nil {
+					row = make(map[string]string)
+				}
+				row[t.Fields[i]] = s
+			}
+		}
+	}
+
+	// Cache misses too so unknown keys don't hammer Redis
+	t.cache.Put(key, row)
+	return row, nil
+}
+
+// applyLookups enriches an event from every configured table
+func applyLookups(event map[string]interface{}) error {
+	for _, t := range lookupTables {
+		var row map[string]string
+		key, ok := event[t.JoinField]
+		if ok && key != nil {
+			var err error
+			row, err = t.get(fmt.Sprint(key))
+			if err != nil {
+				// Source outages degrade to unenriched events, never rejections
+				lookupErrorsTotal.Inc(t.Name)
+				log.Printf("Lookup %s failed: %v", t.Name, err)
+				continue
+			}
+		}
+
+		if row != nil {
+			lookupHitsTotal.Inc(t.Name)
+			for field, value := range row {
+				event[t.Prefix+field] = value
+			}
+			continue
+		}
+
+		lookupMissesTotal.Inc(t.Name)
+		switch t.MissPolicy {
+		case lookupMissDefault:
+			for field, value := range t.Defaults {
+				event[t.Prefix+field] = value
+			}
+		case lookupMissReject:
+			return fmt.Errorf("%w in table %s for %v", errLookupMiss, t.Name, key)
+		}
+	}
+	return nil
+}
@@ -2,47 +2,77 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
+
+	"ingestion-service/audit"
+	"ingestion-service/redisconf"
 )
 
 var (
-	redisClient  *redis.Client
+	redisClient  redis.UniversalClient
+	redisConfig  redisconf.Config
 	kafkaWriter  *kafka.Writer
-	eventChannel chan map[string]interface{}
+	eventChannel chan queuedBatch
 	workerPool   = 10 // Number of worker goroutines
 	ctx          = context.Background()
 )
 
 func init() {
-	// Initialize Redis client
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "redis:6379"
-	}
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:         redisAddr,
-		PoolSize:     20,
-		MinIdleConns: 5,
-	})
+	// Initialize Redis client (standalone, Sentinel or Cluster)
+	var err error
+	if redisConfig, err = redisconf.FromEnv(); err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	if redisClient, err = redisConfig.NewClient(); err != nil {
+		log.Fatalf("Failed to create Redis client: %v", err)
+	}
 
 	// Initialize optimized Kafka writer (reusable connection)
-	kafkaBrokers := os.Getenv("KAFKA_BROKERS")
-	if kafkaBrokers == "" {
-		kafkaBrokers = "kafka:9092"
-	}
-	kafkaWriter = &kafka.Writer{
-		Addr:         kafka.TCP(kafkaBrokers),
-		Topic:        "raw-events",
+	kafkaBrokers := getEnv("KAFKA_BROKERS", "kafka:9092")
+	kafkaWriter = newKafkaWriter(kafkaBrokers, "raw-events")
+
+	// Initialize event channel for async processing, bounded by count and bytes
+	initQueue()
+	initClientLabels()
+
+	// Optional pipeline stages (disabled unless configured)
+	initCEP(kafkaBrokers)
+	initCoalescing()
+	initLookups()
+	initLocalTime()
+	initCurrency()
+	initExplode(kafkaBrokers)
+	initSequence()
+	initHeartbeats(kafkaBrokers)
+	initLagExporter(kafkaBrokers)
+	initCanary()
+	initAudit()
+	initAnomaly(kafkaBrokers)
+	initTenants()
+	initUsage()
+	initResidency(kafkaBrokers)
+	initDedup()
+	initAdmin(kafkaBrokers)
+	initNearDuplicates()
+	initStatus()
+	initReceipts()
+	initLineage()
+}
+
+// newKafkaWriter creates a writer with the service's batching and ack settings
+func newKafkaWriter(brokers, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers),
+		Topic:        topic,
 		Balancer:     &kafka.LeastBytes{},
 		BatchSize:    100,                   // Batch up to 100 messages
 		BatchTimeout: 10 * time.Millisecond, // Wait max 10ms for batching
@@ -50,9 +80,6 @@ func init() {
 		Async:        false,                 // Synchronous for reliability
 		RequiredAcks: kafka.RequireOne,      // Wait for leader acknowledgment
 	}
-
-	// Initialize event channel for async processing
-	eventChannel = make(chan map[string]interface{}, 1000)
 }
 
 func main() {
@@ -72,9 +99,60 @@ func main() {
 		go eventWorker(i, &wg)
 	}
 
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/events", eventsHandler)
+	if len(cepPatterns) > 0 {
+		go cepTimerLoop(getEnvDuration("CEP_TIMER_INTERVAL", time.Second))
+	}
+	if coalesceRules != nil {
+		go coalesceLoop(getEnvDuration("COALESCE_FLUSH_INTERVAL", 50*time.Millisecond))
+	}
+	if heartbeatWriter != nil {
+		go heartbeatLoop(getEnvDuration("HEARTBEAT_INTERVAL", 0))
+	}
+	if sequenceEnabled {
+		go sequenceReportLoop(getEnvDuration("CLIENT_REPORT_INTERVAL", 30*time.Second))
+	}
+	if nearDuplicatesEnabled {
+		go nearDuplicateReportLoop(getEnvDuration("CLIENT_REPORT_INTERVAL", 30*time.Second))
+	}
+	if lagClient != nil {
+		go lagLoop(getEnvDuration("LAG_POLL_INTERVAL", 15*time.Second))
+	}
+	if canaryUsers != nil {
+		go canaryLoop(getEnvDuration("CANARY_INTERVAL", 30*time.Second))
+	}
+	if auditEnabled {
+		go auditReportLoop(time.Minute)
+	}
+	if anomalyEnabled {
+		go anomalyLoop(getEnvDuration("ANOMALY_GRACE", 30*time.Second))
+	}
+	if usageDB != nil {
+		go usageRollupLoop(getEnvDuration("USAGE_ROLLUP_INTERVAL", time.Minute))
+	}
+	if interval := getEnvDuration("MEMORY_STATS_INTERVAL", 10*time.Second); interval > 0 {
+		go memoryLoop(interval)
+	}
+	if interval := getEnvDuration("DEDUP_STATS_INTERVAL", time.Minute); interval > 0 {
+		go dedupStatsLoop(interval)
+	}
+	if interval := getEnvDuration("INTAKE_POLL_INTERVAL", 2*time.Second); interval > 0 {
+		go intakeLoop(interval)
+	}
+
+	http.HandleFunc("/health", countRoute("/health", healthHandler))
+	http.HandleFunc("/events", countRoute("/events", eventsHandler))
+	http.HandleFunc("/events/status", countRoute("/events/status", statusHandler))
+	http.HandleFunc("/events/lineage", countRoute("/events/lineage", lineageHandler))
+	http.HandleFunc("/receipts/keys", countRoute("/receipts/keys", receiptKeysHandler))
+	http.HandleFunc("/receipts/verify", countRoute("/receipts/verify", receiptVerifyHandler))
 	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/metrics/prometheus", prometheusHandler)
+	http.HandleFunc("/ready", readyHandler)
+	http.HandleFunc("/usage/report", countRoute("/usage/report", usageReportHandler))
+
+	if adminEnabled {
+		go serveAdmin(getEnv("ADMIN_ADDR", ":8082"))
+	}
 
 	log.Println("Worker pool started with", workerPool, "workers")
 	log.Fatal(http.ListenAndServe(":8081", nil))
@@ -94,6 +172,9 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		"time":        time.Now().UTC().Format(time.RFC3339),
 		"redis":       redisStatus,
 		"queue_depth": len(eventChannel),
+		"queue_bytes": queueBytes.Load(),
+		"build":       buildVersion,
+		"config":      configVersion,
 	})
 }
 
@@ -104,17 +185,84 @@ func eventsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var event map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+	var eventType string
+	env := acquireEnvelope()
+	defer releaseEnvelope(env)
+
+	// Meter every request, whatever its outcome, against the caller's tenant
+	var owner *tenant
+	var body *countingReader
+	var quotaReserved bool
+	if tenants != nil {
+		owner = resolveTenant(r)
+		body = &countingReader{r: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = recorder
+		defer func() {
+			meterUsage(owner, eventType, max(body.n, r.ContentLength), recorder.status, quotaReserved)
+		}()
+	}
+
+	// Refuse events while an operator has paused intake
+	if intakePaused() {
+		intakePausedTotal.Inc()
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Intake paused, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Shed load while downstream consumers are over their lag budget
+	if lagThrottle && lagExceeded() {
+		lagThrottled.Inc()
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Consumers lagging, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Refuse early while queued events already fill the memory budget
+	if queueFull() {
+		queueRejectedTotal.Inc("bytes")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service overloaded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := env.decode(http.MaxBytesReader(w, r.Body, maxEventBytes)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			queueRejectedTotal.Inc("event_size")
+			http.Error(w, "Event too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	event = env.Fields
+	eventType = env.EventType
+
+	// Derive the event ID under the event's dedup policy
+	policy := dedupPolicyFor(event, r.URL.Path)
+	eventID := policy.eventID(env)
+	trail := newLineage(r.URL.Path)
+	if owner != nil {
+		trail.add("tenant", owner.ID)
+	}
+
+	// Pin the event to its residency region before anything is stored
+	if residencyEnabled {
+		if err := applyResidency(event, owner); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		trail.add("residency", eventString(event, "residency_region"))
+	}
 
-	// Check for duplicate events using Redis
-	eventID := generateEventID(event)
-	isDuplicate, err := checkDuplicate(eventID)
+	isDuplicate, err := checkDuplicate(event, policy, eventID)
 	if err != nil {
 		log.Printf("Redis check failed: %v", err)
 	} else if isDuplicate {
+		tailRecord(event, eventID, "duplicate")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":  "duplicate",
@@ -123,24 +271,224 @@ func eventsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if policy.enabled {
+		trail.add("dedup", policy.Name)
+	}
+
+	// Suppress double-fired events that differ only in client timestamps
+	near, claim, err := checkNearDuplicate(event, policy, eventID, time.Now())
+	if err != nil {
+		log.Printf("Near-duplicate check failed: %v", err)
+	} else if near != nil {
+		tailRecord(event, eventID, "near_duplicate")
+		recordStatus(event, eventID, map[string]interface{}{
+			"status":            "suppressed",
+			"reason":            "near_duplicate",
+			"original_event_id": near.OriginalID,
+			"delta_ms":          near.DeltaMs,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":            "duplicate",
+			"reason":            "near_duplicate",
+			"message":           "Near-duplicate of a recent event",
+			"event_id":          eventID,
+			"original_event_id": near.OriginalID,
+		})
+		return
+	}
+
+	if policy.NearDuplicateMs > 0 {
+		trail.add("near_duplicate", policy.Name)
+	}
+
+	// Give the claims back on every refusal below
+	accepted := false
+	var sequenced *seqClaim
+	defer func() {
+		if !accepted {
+			claim.release()
+			sequenced.release()
+			return
+		}
+		sequenced.commit()
+	}()
+
+	// Enforce the tenant's daily and monthly quotas
+	if owner != nil {
+		warning, blocked, reserved, err := checkQuota(owner, max(body.n, r.ContentLength))
+		quotaReserved = reserved
+		if err != nil {
+			log.Printf("Quota check failed: %v", err)
+		}
+		if blocked != "" {
+			w.Header().Set("Retry-After", strconv.Itoa(quotaResetSeconds(blocked)))
+			http.Error(w, "Quota exceeded: "+blocked, http.StatusTooManyRequests)
+			return
+		}
+		if warning != "" {
+			w.Header().Set("X-Quota-Warning", warning)
+		}
+	}
+
 	// Enrich event with metadata
-	event["ingested_at"] = time.Now().UTC().Format(time.RFC3339)
+	now := time.Now()
+	event["ingested_at"] = now.UTC().Format(time.RFC3339)
 	event["service"] = "ingestion"
 	event["event_id"] = eventID
+	if dedupPolicies != nil {
+		event["dedup_policy"] = policy.Name
+	}
+	if owner != nil {
+		event["tenant_id"] = owner.ID
+	}
 
-	// Send to async worker pool (non-blocking)
-	select {
-	case eventChannel <- event:
-		// Event queued successfully
+	// Join slowly changing dimensions onto the event
+	if len(lookupTables) > 0 {
+		if err := applyLookups(event); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		for _, t := range lookupTables {
+			trail.add("lookup", t.Name)
+			trail.table(t.Name, t.Version())
+		}
+	}
+
+	// Attach the user's local calendar fields (after lookups, which may supply the timezone)
+	if localTimeEnabled {
+		applyLocalTime(event, now)
+		trail.add("local_time", eventString(event, "timezone_source"))
+		trail.table("holidays", holidays.Version())
+	}
+
+	// Validate purchase amounts and convert them to the base currency
+	if currencyEventTypes != nil {
+		if err := normalizeCurrency(event, now); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if _, ok := event["fx_rate"]; ok {
+			trail.add("currency", eventString(event, "currency"))
+			trail.table("fx_rates", fxRates.Version())
+		}
+	}
+
+	// Stamp the per-user server sequence and check the client's device sequence
+	if sequenceEnabled {
+		if sequenced, err = applySequence(event); errors.Is(err, errInvalidSeq) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Sequence tracking failed: %v", err)
+		}
+		trail.add("sequence", "")
+	}
+
+	// Split composite payloads into item-level child events
+	batch := []map[string]interface{}{event}
+	if explodeRules != nil {
+		if batch, err = explodeEvent(event); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if len(batch) > 1 || eventString(batch[0], "parent_event_id") != "" {
+			trail.add("explode", eventString(event, "event_type"))
+			if err := checkFamilySize(eventString(event, "event_type"), batch, trail); err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+	}
+
+	// Count the event against the watermark until it has been produced
+	trackInflight(event, now)
+
+	// Hold high-frequency events back to merge them with their neighbours
+	exploded := len(batch) > 1 || eventString(batch[0], "parent_event_id") != ""
+	coalesced := false
+	if coalesceRules != nil && !exploded {
+		if coalesced, err = coalesceAdd(event, int64(env.Body.Len()), trail); err != nil {
+			releaseInflight(batch, false)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service overloaded, try again later", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if coalesced {
+		accepted = true
+		anomalyObserve(event, r, now)
+		auditAccepted(event, audit.RouteCoalesced)
+		if statusEnabled {
+			recordStatus(event, eventID, map[string]interface{}{"status": "accepted", "accepted_at": event["ingested_at"]})
+		}
+		tailRecord(event, eventID, "coalesced")
+		response := map[string]interface{}{
+			"status":    "accepted",
+			"message":   "Event coalesced for processing",
+			"event_id":  eventID,
+			"coalesced": true,
+		}
+		if rec := issueReceipt(w, env, eventID, owner, now); rec != nil {
+			response["receipt"] = rec
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Charge the batch against the queue's byte budget
+	charge := int64(env.Body.Len()) * int64(len(batch))
+	if !reserveQueue(charge) {
+		releaseInflight(batch, false)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service overloaded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// A queued event belongs to its worker, so keep what the response and
+	// the accounting below read
+	summary := eventSummary(event)
+	childCount, hasChildren := event["child_count"]
+
+	// Send to async worker pool (non-blocking); the worker shares the
+	// envelope the event map belongs to
+	env.retain()
+	select {
+	case eventChannel <- queuedBatch{events: batch, bytes: charge, lineage: trail, envelope: env}:
+		// Event queued successfully
+		accepted = true
+		anomalyObserve(summary, r, now)
+		route := audit.RouteDirect
+		if exploded {
+			route = audit.RouteExploded
+		}
+		auditAccepted(summary, route)
+		if statusEnabled {
+			recordStatus(summary, eventID, map[string]interface{}{"status": "accepted", "accepted_at": summary["ingested_at"]})
+		}
+		tailRecord(summary, eventID, "accepted")
+		response := map[string]interface{}{
 			"status":   "accepted",
 			"message":  "Event queued for processing",
 			"event_id": eventID,
-		})
+		}
+		if hasChildren {
+			response["child_count"] = childCount
+		}
+		if rec := issueReceipt(w, env, eventID, owner, now); rec != nil {
+			response["receipt"] = rec
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
 	default:
 		// Channel full, reject with backpressure
+		releaseEnvelope(env)
+		releaseQueue(charge)
+		queueRejectedTotal.Inc("count")
+		releaseInflight(batch, false)
 		http.Error(w, "Service overloaded, try again later", http.StatusServiceUnavailable)
 	}
 }
@@ -157,12 +505,28 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 		cacheMisses = val
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	metrics := map[string]interface{}{
 		"queue_depth":  len(eventChannel),
+		"queue_bytes":  queueBytes.Load(),
+		"queue_budget": queueBudget,
 		"cache_hits":   cacheHits,
 		"cache_misses": cacheMisses,
+		"pipeline":     metricsSnapshot(),
 		"timestamp":    time.Now().UTC().Format(time.RFC3339),
-	})
+	}
+	if sequenceEnabled {
+		metrics["sequence_loss"] = sequenceLossSnapshot()
+	}
+	if nearDuplicatesEnabled {
+		metrics["near_duplicates"] = nearDuplicateSnapshot()
+	}
+	if lagClient != nil {
+		metrics["consumer_lag"] = lagSnapshot()
+	}
+	if report := latestAuditReport(); report != nil {
+		metrics["audit"] = report
+	}
+	json.NewEncoder(w).Encode(metrics)
 }
 
 // Worker goroutine for async event processing
@@ -170,54 +534,123 @@ func eventWorker(id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	log.Printf("Worker %d started", id)
 
-	for event := range eventChannel {
-		if err := processEvent(event); err != nil {
+	for batch := range eventChannel {
+		workerBusy(id, batch.events)
+		err := processEvent(batch)
+		if err != nil {
 			log.Printf("Worker %d: Failed to process event: %v", id, err)
 		}
+		workerDone(id, err)
+		if batch.envelope != nil {
+			releaseEnvelope(batch.envelope)
+		}
+		releaseQueue(batch.bytes)
 	}
 }
 
-func processEvent(event map[string]interface{}) error {
-	eventID, _ := event["event_id"].(string)
+// processEvent produces one queued event, or an exploded parent with its
+// children as one atomic batch (see explode.go). Members still holding what
+// the entry's envelope decoded are copied from its canonical bytes; there is
+// no envelope for events that were not decoded from a request, such as
+// coalesced merges.
+func processEvent(queued queuedBatch) error {
+	batch, trail, env := queued.events, queued.lineage, queued.envelope
+	messages := make([]kafka.Message, 0, len(batch))
+	dedupIDs := make([]string, 0, 1)
+	buffers := make([]*messageBuffer, 0, len(batch))
+	defer func() {
+		for _, buf := range buffers {
+			releaseMessage(buf)
+		}
+	}()
+	var headers []kafka.Header // lineage, shared by an exploded family
+	var lineage []byte
+	if trail != nil {
+		lineage, _ = json.Marshal(trail)
+		headers = []kafka.Header{{Key: lineageHeader, Value: lineage}}
+	}
+	for _, event := range batch {
+		eventID, _ := event["event_id"].(string)
+
+		// Children are keyed (and deduplicated) by their parent
+		key := eventID
+		if parentID, ok := event["parent_event_id"].(string); ok {
+			key = parentID
+		}
+		if len(dedupIDs) == 0 || dedupIDs[len(dedupIDs)-1] != key {
+			dedupIDs = append(dedupIDs, key)
+		}
+
+		buf, err := encodeEvent(event, env)
+		if err != nil {
+			return err
+		}
+		buffers = append(buffers, buf)
+		messages = append(messages, kafka.Message{
+			Key:     []byte(key),
+			Value:   buf.Bytes(),
+			Headers: headers,
+		})
+	}
 
 	// Send to Kafka
-	jsonData, err := json.Marshal(event)
+	var err error
+	if eventString(batch[len(batch)-1], "parent_event_id") != "" {
+		err = regionFamilies(batch[0]).produce(messages)
+	} else {
+		err = regionWriter(batch[0]).WriteMessages(ctx, messages...)
+	}
+	releaseInflight(batch, err == nil)
 	if err != nil {
 		return err
 	}
+	auditProduced(batch, queued.accepted)
+	if statusEnabled {
+		statusProduced(batch)
+	}
+	if lineage != nil {
+		recordLineage(batch[0], lineage)
+	}
+	if residencyEnabled {
+		countResidency(eventString(batch[0], "residency_region"), "produced", len(messages))
+	}
 
-	err = kafkaWriter.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(eventID),
-		Value: jsonData,
-	})
-
-	if err != nil {
-		return err
+	// Mark as processed for deduplication
+	for _, event := range batch {
+		if memberIDs, ok := event["coalesced_event_ids"].([]string); ok {
+			dedupIDs = append(dedupIDs, memberIDs...)
+		}
+	}
+	if policy := dedupPolicyOf(batch[0]); policy.enabled {
+		dedupClient, prefix := regionRedis(batch[0])
+		markDedup(dedupClient, prefix, policy, dedupIDs)
 	}
 
-	// Mark as processed in Redis (TTL 1 hour for deduplication)
-	redisClient.Set(ctx, "event:"+eventID, "1", time.Hour)
+	if len(cepPatterns) > 0 {
+		for _, event := range batch {
+			cepObserve(event)
+		}
+	}
 
-	log.Printf("Event processed: %s", eventID)
+	log.Printf("Event processed: %s (%d messages)", dedupIDs[0], len(messages))
 	return nil
 }
 
-// Generate unique event ID from event content
-func generateEventID(event map[string]interface{}) string {
-	data, _ := json.Marshal(event)
-	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:])
-}
-
 // Check if event was already processed (deduplication)
-func checkDuplicate(eventID string) (bool, error) {
-	exists, err := redisClient.Exists(ctx, "event:"+eventID).Result()
+func checkDuplicate(event map[string]interface{}, policy *dedupPolicy, eventID string) (bool, error) {
+	if !policy.enabled {
+		dedupChecksTotal.Inc(dedup.Name(), policy.Name, "skipped")
+		return false, nil
+	}
+
+	dedupClient, prefix := regionRedis(event)
+	seen, err := checkDedup(dedupClient, prefix, policy, eventID)
 	if err != nil {
 		redisClient.Incr(ctx, "metrics:cache_misses")
 		return false, err
 	}
 
-	if exists > 0 {
+	if seen {
 		redisClient.Incr(ctx, "metrics:cache_hits")
 		return true, nil
 	}
@@ -225,3 +658,25 @@ func checkDuplicate(eventID string) (bool, error) {
 	redisClient.Incr(ctx, "metrics:cache_misses")
 	return false, nil
 }
+
+// scanKeys lists keys matching a pattern on every Redis node
+func scanKeys(pattern string) ([]string, error) {
+	return scanClientKeys(redisClient, pattern)
+}
+
+// scanClientKeys does the same on another client, such as a residency
+// region's
+func scanClientKeys(client redis.UniversalClient, pattern string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	err := redisconf.ForEachNode(ctx, client, func(ctx context.Context, node *redis.Client) error {
+		iter := node.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	})
+	return keys, err
+}
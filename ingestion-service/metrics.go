@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// metricVec is an in-process labelled counter or gauge reported by /metrics.
+// Values are per replica; cross-replica totals stay in Redis (metrics:*).
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu      sync.Mutex
+	samples map[string]*metricSample
+}
+
+type metricSample struct {
+	labelValues []string
+	value       float64
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry []*metricVec
+)
+
+func newMetricVec(kind, name, help string, labels []string) *metricVec {
+	m := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*metricSample),
+	}
+	metricsMu.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+// newCounterVec registers a monotonically increasing metric
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, labels)
+}
+
+// newGaugeVec registers a metric that can go up and down
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, labels)
+}
+
+func (m *metricVec) sample(labelValues []string) *metricSample {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &metricSample{labelValues: append([]string(nil), labelValues...)}
+		m.samples[key] = s
+	}
+	return s
+}
+
+// Add increments the sample for the given label values
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	m.sample(labelValues).value += delta
+	m.mu.Unlock()
+}
+
+// Inc increments the sample for the given label values by one
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set overwrites the sample for the given label values
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	m.sample(labelValues).value = value
+	m.mu.Unlock()
+}
+
+// snapshot returns samples keyed by "label=value,..." for the JSON endpoint
+func (m *metricVec) snapshot() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]float64, len(m.samples))
+	for _, s := range m.samples {
+		pairs := make([]string, len(s.labelValues))
+		for i, v := range s.labelValues {
+			pairs[i] = m.labels[i] + "=" + v
+		}
+		out[strings.Join(pairs, ",")] = s.value
+	}
+	return out
+}
+
+// metricsSnapshot returns every registered metric for /metrics
+func metricsSnapshot() map[string]map[string]float64 {
+	metricsMu.Lock()
+	registry := append([]*metricVec(nil), metricsRegistry...)
+	metricsMu.Unlock()
+
+	out := make(map[string]map[string]float64, len(registry))
+	for _, m := range registry {
+		out[m.name] = m.snapshot()
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Near-duplicate suppression catches clients that double-fire the same
+// action a few milliseconds apart with different client timestamps, which
+// the content hash can't see. A policy with near_duplicate_ms claims a key
+// per user_id, event_type and near_duplicate_fields for that long; a second
+// event arriving while the claim is held is suppressed and its status points
+// at the event holding the claim. An event refused after claiming (quota,
+// validation, a full queue) gives its claim back so the client's retry is
+// not suppressed against an event that was never produced.
+
+// Returns the existing claim, or false after claiming the key
+var nearDuplicateScript = redis.NewScript(`
+local prev = redis.call('GET', KEYS[1])
+if prev then
+	return prev
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return false
+`)
+
+// Deletes a claim only while it is still the one this event took
+var nearReleaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+const nearStatsPrefix = "metrics:near:"
+
+var (
+	nearDuplicatesEnabled bool
+
+	nearReportMu sync.RWMutex
+	nearReport   map[string]interface{} // latest nearDuplicateReport
+
+	nearDuplicatesTotal = newCounterVec("near_duplicates_total", "Events suppressed as near-duplicates", "policy", "platform", "sdk_version")
+)
+
+// nearDuplicate is the event an incoming event was suppressed against
+type nearDuplicate struct {
+	OriginalID string
+	DeltaMs    int64
+}
+
+// nearClaim is the near-duplicate key an event holds while it is admitted
+type nearClaim struct {
+	client redis.UniversalClient
+	key    string
+	value  string
+}
+
+// release gives up the claim of an event that was not accepted
+func (c *nearClaim) release() {
+	if c == nil {
+		return
+	}
+	if err := nearReleaseScript.Run(ctx, c.client, []string{c.key}, c.value).Err(); err != nil {
+		log.Printf("Failed to release near-duplicate claim %s: %v", c.key, err)
+	}
+}
+
+// initNearDuplicates applies NEAR_DUPLICATE_MS to the default policy when
+// the policies file doesn't set it
+func initNearDuplicates() {
+	p := dedupDefaultPolicy
+	if p.NearDuplicateMs == 0 {
+		p.NearDuplicateMs = getEnvInt("NEAR_DUPLICATE_MS", 0)
+		if fields := getEnv("NEAR_DUPLICATE_FIELDS", ""); fields != "" {
+			p.NearDuplicateFields = strings.Split(fields, ",")
+		}
+	}
+	for _, p := range dedupPolicyList() {
+		if p.NearDuplicateMs < 0 {
+			log.Fatalf("Invalid near_duplicate_ms for dedup policy %q", p.Name)
+		}
+		if p.NearDuplicateMs > 0 {
+			nearDuplicatesEnabled = true
+			log.Printf("Near-duplicate suppression within %dms for dedup policy %s", p.NearDuplicateMs, p.Name)
+		}
+	}
+}
+
+// checkNearDuplicate claims the event's near-duplicate key, returning the
+// claim holder if another event got there first, or the claim taken
+func checkNearDuplicate(event map[string]interface{}, policy *dedupPolicy, eventID string, now time.Time) (*nearDuplicate, *nearClaim, error) {
+	userID := eventString(event, "user_id")
+	if policy.NearDuplicateMs <= 0 || userID == "" {
+		return nil, nil, nil
+	}
+
+	values := make(map[string]interface{}, len(policy.NearDuplicateFields))
+	for _, field := range policy.NearDuplicateFields {
+		values[field] = event[field]
+	}
+	data, _ := json.Marshal(values)
+	hash := sha256.Sum256(append([]byte(eventString(event, "event_type")+"\x00"), data...))
+
+	client, prefix := regionRedis(event)
+	key := prefix + "near:" + policy.Name + ":" + redisConfig.Tag(userID) + ":" + hex.EncodeToString(hash[:8])
+	claim := eventID + "|" + strconv.FormatInt(now.UnixMilli(), 10)
+
+	platform := clientLabel(event, "platform", clientPlatforms)
+	sdk := clientLabel(event, "sdk_version", clientSDKVersions)
+	stats := nearStatsPrefix + platform + "|" + sdk
+	pipe := redisClient.Pipeline()
+	pipe.HIncrBy(ctx, stats, "checked", 1)
+	defer pipe.Exec(ctx)
+
+	prev, err := nearDuplicateScript.Run(ctx, client, []string{key}, claim, policy.NearDuplicateMs).Text()
+	if err == redis.Nil {
+		return nil, &nearClaim{client: client, key: key, value: claim}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	originalID, sentMs, _ := strings.Cut(prev, "|")
+	ms, _ := strconv.ParseInt(sentMs, 10, 64)
+	nearDuplicatesTotal.Inc(policy.Name, platform, sdk)
+	pipe.HIncrBy(ctx, stats, "suppressed", 1)
+	return &nearDuplicate{OriginalID: originalID, DeltaMs: now.UnixMilli() - ms}, nil, nil
+}
+
+// nearDuplicateReportLoop refreshes the suppression report, so /metrics
+// does not scan Redis on every request
+func nearDuplicateReportLoop(interval time.Duration) {
+	for {
+		report := nearDuplicateReport()
+		nearReportMu.Lock()
+		nearReport = report
+		nearReportMu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// nearDuplicateSnapshot returns the latest suppression report
+func nearDuplicateSnapshot() map[string]interface{} {
+	nearReportMu.RLock()
+	defer nearReportMu.RUnlock()
+	return nearReport
+}
+
+// nearDuplicateReport gives the suppression rate per platform and SDK
+// version across replicas
+func nearDuplicateReport() map[string]interface{} {
+	report := make(map[string]interface{})
+	keys, err := scanKeys(nearStatsPrefix + "*")
+	if err != nil {
+		log.Printf("Near-duplicate report failed: %v", err)
+	}
+	for _, key := range keys {
+		fields, err := redisClient.HGetAll(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		checked, _ := strconv.ParseInt(fields["checked"], 10, 64)
+		suppressed, _ := strconv.ParseInt(fields["suppressed"], 10, 64)
+		rate := 0.0
+		if checked > 0 {
+			rate = float64(suppressed) / float64(checked)
+		}
+
+		platform, sdk, _ := strings.Cut(strings.TrimPrefix(key, nearStatsPrefix), "|")
+		report[platform+"/"+sdk] = map[string]interface{}{
+			"platform":         platform,
+			"sdk_version":      sdk,
+			"checked":          checked,
+			"suppressed":       suppressed,
+			"suppression_rate": rate,
+		}
+	}
+	return report
+}
@@ -0,0 +1,536 @@
+// Package parquet reads flat Parquet files into memory, enough for the
+// ingestion service's lookup tables. It reads schemas of top-level required
+// or optional columns, data pages v1 and v2 in PLAIN or dictionary encoding,
+// and UNCOMPRESSED, SNAPPY, GZIP or ZSTD compression. Anything else (nested
+// or repeated columns, DELTA encodings, other codecs) is refused with an
+// error instead of being read partially.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Physical types
+const (
+	typeBoolean = iota
+	typeInt32
+	typeInt64
+	typeInt96
+	typeFloat
+	typeDouble
+	typeByteArray
+	typeFixedLenByteArray
+)
+
+// Converted types that change how a value is written out
+const (
+	convertedDate            = 6
+	convertedTimestampMillis = 9
+	convertedTimestampMicros = 10
+)
+
+// Repetition types
+const (
+	repetitionRequired = 0
+	repetitionOptional = 1
+)
+
+// Page types
+const (
+	pageData       = 0
+	pageDictionary = 2
+	pageDataV2     = 3
+)
+
+// Encodings
+const (
+	encodingPlain           = 0
+	encodingPlainDictionary = 2
+	encodingRLE             = 3
+	encodingRLEDictionary   = 8
+)
+
+// Compression codecs
+const (
+	codecUncompressed = 0
+	codecSnappy       = 1
+	codecGzip         = 2
+	codecZstd         = 6
+)
+
+// Julian day of the Unix epoch, for INT96 timestamps
+const julianUnixEpoch = 2440588
+
+var (
+	magic = []byte("PAR1")
+
+	errCorrupt = errors.New("parquet: corrupt file")
+
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// Table is a file's contents by column
+type Table struct {
+	NumRows int
+	Columns []*Column
+}
+
+// Column holds one column's values as text. Strings are taken as they are,
+// numbers and booleans as Go formats them, DATE as 2006-01-02, and
+// TIMESTAMP_MILLIS, TIMESTAMP_MICROS and INT96 as RFC 3339 in UTC. Other
+// logical types, such as decimals and nanosecond timestamps, come through
+// as their stored value.
+type Column struct {
+	Name   string
+	Values []string
+	Null   []bool // rows without a value, nil for required columns
+
+	typ       int64
+	length    int // FIXED_LEN_BYTE_ARRAY width
+	converted int64
+	optional  bool
+}
+
+// Column returns the named column, or nil
+func (t *Table) Column(name string) *Column {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Parse reads a whole Parquet file
+func Parse(data []byte) (*Table, error) {
+	if len(data) < 12 || !bytes.Equal(data[:4], magic) || !bytes.Equal(data[len(data)-4:], magic) {
+		return nil, errors.New("parquet: not a Parquet file")
+	}
+	footer := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	end := len(data) - 8
+	if footer > end-4 {
+		return nil, errCorrupt
+	}
+	meta, err := (&compact{data: data[end-footer : end]}).readStruct(0)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := readSchema(meta.list(2))
+	if err != nil {
+		return nil, err
+	}
+	table := &Table{Columns: columns}
+	for _, v := range meta.list(4) {
+		group, _ := v.(thriftFields)
+		if err := table.readRowGroup(group, data[:end-footer]); err != nil {
+			return nil, err
+		}
+	}
+	if int64(table.NumRows) != meta.int(3) {
+		return nil, fmt.Errorf("parquet: read %d rows, footer says %d", table.NumRows, meta.int(3))
+	}
+	return table, nil
+}
+
+// readSchema turns the flattened schema tree into columns. The first
+// element is the root and every other one must be a leaf under it.
+func readSchema(schema []interface{}) ([]*Column, error) {
+	if len(schema) == 0 {
+		return nil, errCorrupt
+	}
+	root, _ := schema[0].(thriftFields)
+	if root == nil || root.int(5) != int64(len(schema)-1) {
+		return nil, errors.New("parquet: nested columns are not supported")
+	}
+
+	columns := make([]*Column, 0, len(schema)-1)
+	for _, v := range schema[1:] {
+		element, _ := v.(thriftFields)
+		if element == nil || element.int(5) != 0 || !element.has(1) {
+			return nil, errors.New("parquet: nested columns are not supported")
+		}
+		c := &Column{
+			Name:      element.string(4),
+			typ:       element.int(1),
+			length:    int(element.int(2)),
+			converted: -1,
+		}
+		if element.has(6) {
+			c.converted = element.int(6)
+		}
+		switch element.int(3) {
+		case repetitionRequired:
+		case repetitionOptional:
+			c.optional = true
+		default:
+			return nil, fmt.Errorf("parquet: repeated column %s is not supported", c.Name)
+		}
+		if c.typ < typeBoolean || c.typ > typeFixedLenByteArray || (c.typ == typeFixedLenByteArray && c.length <= 0) {
+			return nil, fmt.Errorf("parquet: column %s has unknown type %d", c.Name, c.typ)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// readRowGroup appends one row group's values to every column
+func (t *Table) readRowGroup(group thriftFields, data []byte) error {
+	chunks := group.list(1)
+	if group == nil || len(chunks) != len(t.Columns) {
+		return errCorrupt
+	}
+	rows := group.int(3)
+	if rows < 0 {
+		return errCorrupt
+	}
+
+	for i, v := range chunks {
+		chunk, _ := v.(thriftFields)
+		meta := chunk.child(3)
+		if meta == nil || chunk.string(1) != "" {
+			return errors.New("parquet: column chunks in other files are not supported")
+		}
+		c := t.Columns[i]
+		if path := meta.list(3); len(path) != 1 || string(asBytes(path[0])) != c.Name {
+			return errCorrupt
+		}
+
+		start := meta.int(9)
+		if dictionary := meta.int(11); meta.has(11) && dictionary > 0 && dictionary < start {
+			start = dictionary
+		}
+		size := meta.int(7)
+		if start < 4 || size < 0 || start > int64(len(data)) || size > int64(len(data))-start {
+			return errCorrupt
+		}
+		if err := c.readChunk(data[start:start+size], meta.int(4), meta.int(5)); err != nil {
+			return err
+		}
+		if int64(len(c.Values)) != int64(t.NumRows)+rows {
+			return fmt.Errorf("parquet: column %s has %d values in a row group of %d rows", c.Name, len(c.Values)-t.NumRows, rows)
+		}
+	}
+	t.NumRows += int(rows)
+	return nil
+}
+
+// readChunk reads a column chunk's pages until it has numValues values
+func (c *Column) readChunk(chunk []byte, codec, numValues int64) error {
+	var dictionary []string
+	r := &compact{data: chunk}
+	for read := int64(0); read < numValues; {
+		header, err := r.readStruct(0)
+		if err != nil {
+			return err
+		}
+		size, uncompressed := header.int(3), header.int(2)
+		if size < 0 || size > int64(len(chunk)-r.pos) || uncompressed < 0 {
+			return errCorrupt
+		}
+		page := chunk[r.pos : r.pos+int(size)]
+		r.pos += int(size)
+
+		var defs []uint32
+		var values []byte
+		var count, encoding int64
+		switch header.int(1) {
+		case pageDictionary:
+			raw, err := decompress(codec, page, uncompressed)
+			if err != nil {
+				return err
+			}
+			if dictionary, err = c.decodePlain(raw, int(header.child(7).int(1))); err != nil {
+				return err
+			}
+			continue
+		case pageData:
+			dh := header.child(5)
+			count, encoding = dh.int(1), dh.int(2)
+			if count < 0 || count > numValues-read {
+				return errCorrupt
+			}
+			raw, err := decompress(codec, page, uncompressed)
+			if err != nil {
+				return err
+			}
+			if c.optional {
+				// Levels are prefixed with their length in v1 pages
+				if len(raw) < 4 || dh.int(3) != encodingRLE {
+					return errCorrupt
+				}
+				n := int(binary.LittleEndian.Uint32(raw))
+				if n < 0 || n > len(raw)-4 {
+					return errCorrupt
+				}
+				if defs, err = decodeHybrid(raw[4:4+n], 1, count); err != nil {
+					return err
+				}
+				raw = raw[4+n:]
+			}
+			values = raw
+		case pageDataV2:
+			dh := header.child(8)
+			count, encoding = dh.int(1), dh.int(4)
+			levels := dh.int(5)
+			if count < 0 || count > numValues-read || dh.int(6) != 0 || levels < 0 || levels > size {
+				return errCorrupt
+			}
+			if c.optional {
+				if defs, err = decodeHybrid(page[:levels], 1, count); err != nil {
+					return err
+				}
+			}
+			values = page[levels:]
+			if dh.bool(7, true) {
+				if values, err = decompress(codec, values, uncompressed-levels); err != nil {
+					return err
+				}
+			}
+		default:
+			// Index pages carry nothing to read
+			continue
+		}
+		present := count
+		if defs != nil {
+			present = 0
+			for _, d := range defs {
+				present += int64(d)
+			}
+		}
+		decoded, err := c.decodeValues(encoding, values, present, dictionary)
+		if err != nil {
+			return err
+		}
+		for i := int64(0); i < count; i++ {
+			if defs != nil && defs[i] == 0 {
+				c.Values = append(c.Values, "")
+				c.Null = append(c.Null, true)
+				continue
+			}
+			c.Values = append(c.Values, decoded[0])
+			decoded = decoded[1:]
+			if c.optional {
+				c.Null = append(c.Null, false)
+			}
+		}
+		read += count
+	}
+	return nil
+}
+
+// decodeValues decodes a data page's count non-null values
+func (c *Column) decodeValues(encoding int64, raw []byte, count int64, dictionary []string) ([]string, error) {
+	switch encoding {
+	case encodingPlain:
+		return c.decodePlain(raw, int(count))
+	case encodingPlainDictionary, encodingRLEDictionary:
+		if dictionary == nil || len(raw) < 1 {
+			return nil, errCorrupt
+		}
+		indexes, err := decodeHybrid(raw[1:], int(raw[0]), count)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, len(indexes))
+		for i, index := range indexes {
+			if int(index) >= len(dictionary) {
+				return nil, errCorrupt
+			}
+			values[i] = dictionary[index]
+		}
+		return values, nil
+	case encodingRLE:
+		// Booleans in v2 pages, prefixed with their length
+		if c.typ != typeBoolean || len(raw) < 4 {
+			break
+		}
+		bits, err := decodeHybrid(raw[4:], 1, count)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, len(bits))
+		for i, b := range bits {
+			values[i] = strconv.FormatBool(b == 1)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("parquet: column %s uses unsupported encoding %d", c.Name, encoding)
+}
+
+// decodePlain decodes count PLAIN values of the column's type
+func (c *Column) decodePlain(raw []byte, count int) ([]string, error) {
+	width := map[int64]int{typeInt32: 4, typeInt64: 8, typeInt96: 12, typeFloat: 4, typeDouble: 8, typeFixedLenByteArray: c.length}[c.typ]
+	switch {
+	case count < 0:
+		return nil, errCorrupt
+	case c.typ == typeBoolean && count > len(raw)*8:
+		return nil, errCorrupt
+	case c.typ == typeByteArray && count > len(raw)/4:
+		return nil, errCorrupt
+	case width > 0 && count > len(raw)/width:
+		return nil, errCorrupt
+	}
+
+	values := make([]string, count)
+	for i := range values {
+		switch c.typ {
+		case typeBoolean:
+			values[i] = strconv.FormatBool(raw[i/8]>>(i%8)&1 == 1)
+			continue
+		case typeByteArray:
+			if len(raw) < 4 {
+				return nil, errCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(raw))
+			if n < 0 || n > len(raw)-4 {
+				return nil, errCorrupt
+			}
+			values[i] = string(raw[4 : 4+n])
+			raw = raw[4+n:]
+			continue
+		}
+
+		v := raw[:width]
+		raw = raw[width:]
+		switch c.typ {
+		case typeInt32:
+			n := int32(binary.LittleEndian.Uint32(v))
+			if c.converted == convertedDate {
+				values[i] = time.Unix(int64(n)*86400, 0).UTC().Format(time.DateOnly)
+			} else {
+				values[i] = strconv.FormatInt(int64(n), 10)
+			}
+		case typeInt64:
+			n := int64(binary.LittleEndian.Uint64(v))
+			switch c.converted {
+			case convertedTimestampMillis:
+				values[i] = time.UnixMilli(n).UTC().Format(time.RFC3339Nano)
+			case convertedTimestampMicros:
+				values[i] = time.UnixMicro(n).UTC().Format(time.RFC3339Nano)
+			default:
+				values[i] = strconv.FormatInt(n, 10)
+			}
+		case typeInt96:
+			// Nanoseconds into the day, then the Julian day
+			nanos := int64(binary.LittleEndian.Uint64(v))
+			day := int64(binary.LittleEndian.Uint32(v[8:]))
+			values[i] = time.Unix((day-julianUnixEpoch)*86400, nanos).UTC().Format(time.RFC3339Nano)
+		case typeFloat:
+			values[i] = strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(v))), 'g', -1, 32)
+		case typeDouble:
+			values[i] = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(v)), 'g', -1, 64)
+		case typeFixedLenByteArray:
+			values[i] = string(v)
+		}
+	}
+	return values, nil
+}
+
+// decodeHybrid decodes count values of the RLE/bit-packed hybrid encoding
+// used for levels and dictionary indexes
+func decodeHybrid(raw []byte, bitWidth int, count int64) ([]uint32, error) {
+	if bitWidth > 32 {
+		return nil, errCorrupt
+	}
+	// Runs can be far longer than their bytes, so count is not preallocated
+	values := make([]uint32, 0, min(count, int64(len(raw))*8))
+	byteWidth := (bitWidth + 7) / 8
+	for int64(len(values)) < count {
+		header, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errCorrupt
+		}
+		raw = raw[n:]
+
+		if header&1 == 0 {
+			// A run of one value
+			if len(raw) < byteWidth {
+				return nil, errCorrupt
+			}
+			var v uint32
+			for i := 0; i < byteWidth; i++ {
+				v |= uint32(raw[i]) << (8 * i)
+			}
+			raw = raw[byteWidth:]
+			for run := header >> 1; run > 0 && int64(len(values)) < count; run-- {
+				values = append(values, v)
+			}
+			continue
+		}
+
+		// Groups of eight bit-packed values, least significant bit first
+		groups := header >> 1
+		size := uint64(len(raw))
+		if groups <= size/uint64(max(bitWidth, 1)) {
+			size = groups * uint64(bitWidth)
+		}
+		packed := raw[:size]
+		raw = raw[size:]
+		for i := uint64(0); i < groups*8 && int64(len(values)) < count; i++ {
+			var v uint32
+			for b := 0; b < bitWidth; b++ {
+				bit := i*uint64(bitWidth) + uint64(b)
+				if bit/8 >= uint64(len(packed)) {
+					return nil, errCorrupt
+				}
+				v |= uint32(packed[bit/8]>>(bit%8)&1) << b
+			}
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// decompress returns a page's data, which must come to size bytes
+func decompress(codec int64, data []byte, size int64) ([]byte, error) {
+	var out []byte
+	var err error
+	switch codec {
+	case codecUncompressed:
+		out = data
+	case codecSnappy:
+		if n, err := snappy.DecodedLen(data); err != nil || int64(n) != size {
+			return nil, errCorrupt
+		}
+		out, err = snappy.Decode(nil, data)
+	case codecGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			out, err = io.ReadAll(io.LimitReader(r, size+1))
+		}
+	case codecZstd:
+		zstdOnce.Do(func() {
+			zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		})
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		out, err = zstdDecoder.DecodeAll(data, make([]byte, 0, min(size, int64(len(data))*64)))
+	default:
+		return nil, fmt.Errorf("parquet: unsupported compression codec %d", codec)
+	}
+	if err != nil || int64(len(out)) != size {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+func asBytes(v interface{}) []byte {
+	b, _ := v.([]byte)
+	return b
+}
@@ -0,0 +1,361 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The tests write files with a small encoder that follows the format
+// specification, since the module has no Parquet writer to compare with.
+
+// thriftWriter writes the Thrift compact protocol
+type thriftWriter struct {
+	bytes.Buffer
+	last []int16 // last field ID of each open struct
+}
+
+func (w *thriftWriter) uvarint(v uint64) {
+	w.Write(binary.AppendUvarint(nil, v))
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.uvarint(uint64(int64(id)<<1 ^ int64(id)>>63))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) int(id int16, typ byte, v int64) {
+	w.field(id, typ)
+	w.uvarint(uint64(v<<1 ^ v>>63))
+}
+
+func (w *thriftWriter) i32(id int16, v int64) { w.int(id, thriftI32, v) }
+func (w *thriftWriter) i64(id int16, v int64) { w.int(id, thriftI64, v) }
+
+func (w *thriftWriter) string(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	w.WriteByte(byte(n)<<4 | elem)
+}
+
+// begin opens a struct, as field id or as a list element when id is 0
+func (w *thriftWriter) begin(id int16) {
+	if id != 0 {
+		w.field(id, thriftStruct)
+	}
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) end() {
+	w.WriteByte(thriftStop)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// testColumn describes one column of a test file; nil values are nulls
+type testColumn struct {
+	name       string
+	typ        int64
+	converted  int64 // -1 for none
+	codec      int64
+	dictionary bool
+	v2         bool
+	values     []interface{}
+}
+
+func plain(typ int64, values []interface{}) []byte {
+	var out []byte
+	for i, v := range values {
+		switch typ {
+		case typeBoolean:
+			if i%8 == 0 {
+				out = append(out, 0)
+			}
+			if v.(bool) {
+				out[len(out)-1] |= 1 << (i % 8)
+			}
+		case typeInt32:
+			out = binary.LittleEndian.AppendUint32(out, uint32(v.(int32)))
+		case typeInt64:
+			out = binary.LittleEndian.AppendUint64(out, uint64(v.(int64)))
+		case typeDouble:
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(v.(float64)))
+		case typeByteArray:
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(v.(string))))
+			out = append(out, v.(string)...)
+		}
+	}
+	return out
+}
+
+// bitPacked encodes values as one bit-packed run of the hybrid encoding
+func bitPacked(values []uint32, width int) []byte {
+	groups := (len(values) + 7) / 8
+	out := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+	packed := make([]byte, groups*width)
+	for i, v := range values {
+		for b := 0; b < width; b++ {
+			bit := i*width + b
+			packed[bit/8] |= byte(v>>b&1) << (bit % 8)
+		}
+	}
+	return append(out, packed...)
+}
+
+func compress(t *testing.T, codec int64, data []byte) []byte {
+	switch codec {
+	case codecSnappy:
+		return snappy.Encode(nil, data)
+	case codecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	case codecZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc.EncodeAll(data, nil)
+	}
+	return data
+}
+
+// pageHeader writes a page header; fill adds the type-specific header
+func pageHeader(typ int64, uncompressed, compressed int, fill func(w *thriftWriter)) []byte {
+	w := &thriftWriter{last: []int16{0}}
+	w.i32(1, typ)
+	w.i32(2, int64(uncompressed))
+	w.i32(3, int64(compressed))
+	fill(w)
+	w.end()
+	return w.Bytes()
+}
+
+// writeChunk returns a column chunk of c's values and where its data pages
+// start within it
+func writeChunk(t *testing.T, c testColumn) ([]byte, int) {
+	var chunk []byte
+	present := make([]interface{}, 0, len(c.values))
+	defs := make([]uint32, len(c.values))
+	for i, v := range c.values {
+		if v != nil {
+			present = append(present, v)
+			defs[i] = 1
+		}
+	}
+
+	encoding := int64(encodingPlain)
+	values := plain(c.typ, present)
+	if c.dictionary {
+		var dictionary []interface{}
+		indexes := make([]uint32, len(present))
+		for i, v := range present {
+			index := slices.Index(dictionary, v)
+			if index < 0 {
+				index = len(dictionary)
+				dictionary = append(dictionary, v)
+			}
+			indexes[i] = uint32(index)
+		}
+		raw := plain(c.typ, dictionary)
+		data := compress(t, c.codec, raw)
+		chunk = append(chunk, pageHeader(pageDictionary, len(raw), len(data), func(w *thriftWriter) {
+			w.begin(7)
+			w.i32(1, int64(len(dictionary)))
+			w.i32(2, encodingPlain)
+			w.end()
+		})...)
+		chunk = append(chunk, data...)
+		encoding = encodingRLEDictionary
+		values = append([]byte{2}, bitPacked(indexes, 2)...)
+	}
+	dataStart := len(chunk)
+
+	levels := bitPacked(defs, 1)
+	if c.v2 {
+		data := append(slices.Clip(levels), compress(t, c.codec, values)...)
+		chunk = append(chunk, pageHeader(pageDataV2, len(levels)+len(values), len(data), func(w *thriftWriter) {
+			w.begin(8)
+			w.i32(1, int64(len(c.values)))
+			w.i32(2, int64(len(c.values)-len(present)))
+			w.i32(3, int64(len(c.values)))
+			w.i32(4, encoding)
+			w.i32(5, int64(len(levels)))
+			w.i32(6, 0)
+			w.end()
+		})...)
+		return append(chunk, data...), dataStart
+	}
+
+	raw := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	raw = append(append(raw, levels...), values...)
+	data := compress(t, c.codec, raw)
+	chunk = append(chunk, pageHeader(pageData, len(raw), len(data), func(w *thriftWriter) {
+		w.begin(5)
+		w.i32(1, int64(len(c.values)))
+		w.i32(2, encoding)
+		w.i32(3, encodingRLE)
+		w.i32(4, encodingRLE)
+		w.end()
+	})...)
+	return append(chunk, data...), dataStart
+}
+
+// writeFile writes one row group of optional columns
+func writeFile(t *testing.T, columns []testColumn) []byte {
+	file := slices.Clone(magic)
+	type placed struct{ start, data, size int }
+	chunks := make([]placed, len(columns))
+	for i, c := range columns {
+		chunk, data := writeChunk(t, c)
+		chunks[i] = placed{len(file), len(file) + data, len(chunk)}
+		file = append(file, chunk...)
+	}
+	rows := len(columns[0].values)
+
+	w := &thriftWriter{last: []int16{0}}
+	w.i32(1, 1)
+	w.list(2, thriftStruct, len(columns)+1)
+	w.begin(0)
+	w.string(4, "schema")
+	w.i32(5, int64(len(columns)))
+	w.end()
+	for _, c := range columns {
+		w.begin(0)
+		w.i32(1, c.typ)
+		w.i32(3, repetitionOptional)
+		w.string(4, c.name)
+		if c.converted >= 0 {
+			w.i32(6, c.converted)
+		}
+		w.end()
+	}
+	w.i64(3, int64(rows))
+	w.list(4, thriftStruct, 1)
+	w.begin(0)
+	w.list(1, thriftStruct, len(columns))
+	for i, c := range columns {
+		w.begin(0)
+		w.i64(2, int64(chunks[i].start))
+		w.begin(3)
+		w.i32(1, c.typ)
+		w.list(2, thriftI32, 1)
+		w.uvarint(0)
+		w.list(3, thriftBinary, 1)
+		w.uvarint(uint64(len(c.name)))
+		w.WriteString(c.name)
+		w.i32(4, c.codec)
+		w.i64(5, int64(len(c.values)))
+		w.i64(6, int64(chunks[i].size))
+		w.i64(7, int64(chunks[i].size))
+		w.i64(9, int64(chunks[i].data))
+		if c.dictionary {
+			w.i64(11, int64(chunks[i].start))
+		}
+		w.end()
+		w.end()
+	}
+	w.i64(2, int64(len(file)))
+	w.i64(3, int64(rows))
+	w.end()
+	w.string(6, "ingestion-service test")
+	w.end()
+
+	file = append(file, w.Bytes()...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(w.Len()))
+	return append(file, magic...)
+}
+
+var testColumns = []testColumn{
+	{name: "item_id", typ: typeByteArray, converted: 0, values: []interface{}{"i1", "i2", "i3", "i4", "i5"}},
+	{name: "category", typ: typeByteArray, converted: 0, codec: codecSnappy, dictionary: true,
+		values: []interface{}{"shoes", nil, "shoes", "hats", "socks"}},
+	{name: "price", typ: typeDouble, converted: -1, codec: codecGzip, v2: true,
+		values: []interface{}{12.5, 3.0, nil, 0.1, -7.25}},
+	{name: "stock", typ: typeInt64, converted: -1, codec: codecZstd, dictionary: true, v2: true,
+		values: []interface{}{int64(3), int64(3), int64(1 << 40), nil, int64(-1)}},
+	{name: "active", typ: typeBoolean, converted: -1,
+		values: []interface{}{true, false, true, true, nil}},
+	{name: "launched", typ: typeInt32, converted: convertedDate,
+		values: []interface{}{int32(19723), nil, int32(0), int32(-1), int32(20000)}},
+	{name: "updated", typ: typeInt64, converted: convertedTimestampMillis,
+		values: []interface{}{int64(1704067200123), nil, nil, nil, int64(0)}},
+}
+
+func TestParse(t *testing.T) {
+	table, err := Parse(writeFile(t, testColumns))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if table.NumRows != 5 || len(table.Columns) != len(testColumns) {
+		t.Fatalf("read %d rows of %d columns", table.NumRows, len(table.Columns))
+	}
+
+	want := map[string][]string{
+		"item_id":  {"i1", "i2", "i3", "i4", "i5"},
+		"category": {"shoes", "", "shoes", "hats", "socks"},
+		"price":    {"12.5", "3", "", "0.1", "-7.25"},
+		"stock":    {"3", "3", "1099511627776", "", "-1"},
+		"active":   {"true", "false", "true", "true", ""},
+		"launched": {"2024-01-01", "", "1970-01-01", "1969-12-31", "2024-10-04"},
+		"updated":  {"2024-01-01T00:00:00.123Z", "", "", "", "1970-01-01T00:00:00Z"},
+	}
+	for i, c := range testColumns {
+		column := table.Column(c.name)
+		if column != table.Columns[i] {
+			t.Fatalf("Column(%q) is not column %d", c.name, i)
+		}
+		if !slices.Equal(column.Values, want[c.name]) {
+			t.Errorf("%s = %q, want %q", c.name, column.Values, want[c.name])
+		}
+		for row, v := range c.values {
+			if column.Null[row] != (v == nil) {
+				t.Errorf("%s row %d null = %v", c.name, row, column.Null[row])
+			}
+		}
+	}
+	if table.Column("missing") != nil {
+		t.Error("Column found a column that is not in the file")
+	}
+}
+
+// TestParseCorrupt checks that damaged files are refused, never a panic
+func TestParseCorrupt(t *testing.T) {
+	file := writeFile(t, testColumns)
+	for n := 0; n < len(file); n++ {
+		if _, err := Parse(file[:n]); err == nil {
+			t.Errorf("Parse accepted the first %d bytes", n)
+		}
+	}
+	for i := 4; i < len(file)-8; i++ {
+		damaged := slices.Clone(file)
+		damaged[i] ^= 0xff
+		Parse(damaged)
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	lz4 := slices.Clone(testColumns[:1])
+	lz4[0].codec = 7
+	if _, err := Parse(writeFile(t, lz4)); err == nil {
+		t.Error("Parse read an LZ4_RAW column")
+	}
+}
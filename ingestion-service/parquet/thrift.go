@@ -0,0 +1,229 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Parquet metadata and page headers are Thrift structs in the compact
+// protocol. They are decoded generically into field ID maps and the reader
+// picks out the fields it needs, so fields added by newer writers are
+// skipped without a schema.
+
+// Compact protocol type IDs
+const (
+	thriftStop   = 0
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// Deepest nesting accepted, far beyond what Parquet metadata uses
+const maxThriftDepth = 64
+
+// thriftFields maps a struct's field IDs to int64, float64, bool, []byte,
+// []interface{} or thriftFields values
+type thriftFields map[int16]interface{}
+
+func (s thriftFields) has(id int16) bool {
+	_, ok := s[id]
+	return ok
+}
+
+func (s thriftFields) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftFields) bool(id int16, def bool) bool {
+	if v, ok := s[id].(bool); ok {
+		return v
+	}
+	return def
+}
+
+func (s thriftFields) string(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s thriftFields) child(id int16) thriftFields {
+	v, _ := s[id].(thriftFields)
+	return v
+}
+
+func (s thriftFields) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+// compact reads one compact protocol message from data
+type compact struct {
+	data []byte
+	pos  int
+}
+
+func (c *compact) byte() (byte, error) {
+	if c.pos >= len(c.data) {
+		return 0, errCorrupt
+	}
+	b := c.data[c.pos]
+	c.pos++
+	return b, nil
+}
+
+func (c *compact) varint() (uint64, error) {
+	v, n := binary.Uvarint(c.data[c.pos:])
+	if n <= 0 {
+		return 0, errCorrupt
+	}
+	c.pos += n
+	return v, nil
+}
+
+func (c *compact) zigzag() (int64, error) {
+	v, err := c.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+// size reads a collection size, bounded by the bytes left since every
+// element takes at least one
+func (c *compact) size(v uint64) (int, error) {
+	if v > uint64(len(c.data)-c.pos) {
+		return 0, errCorrupt
+	}
+	return int(v), nil
+}
+
+func (c *compact) readStruct(depth int) (thriftFields, error) {
+	if depth > maxThriftDepth {
+		return nil, errCorrupt
+	}
+	s := make(thriftFields)
+	var last int16
+	for {
+		header, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		typ := header & 0x0f
+		if typ == thriftStop {
+			return s, nil
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			v, err := c.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		if s[id], err = c.readValue(typ, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *compact) readValue(typ byte, depth int) (interface{}, error) {
+	switch typ {
+	case thriftTrue:
+		return true, nil
+	case thriftFalse:
+		return false, nil
+	case thriftByte:
+		b, err := c.byte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return c.zigzag()
+	case thriftDouble:
+		if len(c.data)-c.pos < 8 {
+			return nil, errCorrupt
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(c.data[c.pos:]))
+		c.pos += 8
+		return v, nil
+	case thriftBinary:
+		v, err := c.varint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := c.size(v)
+		if err != nil {
+			return nil, err
+		}
+		b := c.data[c.pos : c.pos+n]
+		c.pos += n
+		return b, nil
+	case thriftList, thriftSet:
+		header, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		v := uint64(header >> 4)
+		if v == 15 {
+			if v, err = c.varint(); err != nil {
+				return nil, err
+			}
+		}
+		n, err := c.size(v)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			value, err := c.readElement(header&0x0f, depth)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case thriftMap:
+		// Parquet metadata has no maps; read past them
+		v, err := c.varint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := c.size(v)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		types, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < 2*n; i++ {
+			elem := types >> 4
+			if i%2 == 1 {
+				elem = types & 0x0f
+			}
+			if _, err := c.readElement(elem, depth); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftStruct:
+		return c.readStruct(depth + 1)
+	}
+	return nil, errCorrupt
+}
+
+// readElement reads a list, set or map element. Booleans there take a byte
+// each instead of living in the type ID.
+func (c *compact) readElement(typ byte, depth int) (interface{}, error) {
+	if typ == thriftTrue || typ == thriftFalse {
+		b, err := c.byte()
+		return b == thriftTrue, err
+	}
+	return c.readValue(typ, depth+1)
+}
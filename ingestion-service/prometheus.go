@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prometheusHandler renders the in-process metrics registry in the
+// Prometheus text exposition format
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP ingestion_queue_depth Events waiting for a worker\n")
+	fmt.Fprintf(w, "# TYPE ingestion_queue_depth gauge\n")
+	fmt.Fprintf(w, "ingestion_queue_depth %d\n", len(eventChannel))
+
+	metricsMu.Lock()
+	registry := append([]*metricVec(nil), metricsRegistry...)
+	metricsMu.Unlock()
+	sort.Slice(registry, func(i, j int) bool { return registry[i].name < registry[j].name })
+
+	for _, m := range registry {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+		m.mu.Lock()
+		lines := make([]string, 0, len(m.samples))
+		for _, s := range m.samples {
+			lines = append(lines, m.name+formatLabels(m.labels, s.labelValues)+" "+
+				strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+		m.mu.Unlock()
+
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
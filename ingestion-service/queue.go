@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The event queue is bounded by bytes as well as count. Each queued batch
+// is charged its request body size once per event it produces, and
+// eventsHandler refuses events that would take the charged total over the
+// budget. Decoded events take several times their JSON size, so the budget
+// defaults to QUEUE_MEMORY_FRACTION of the container memory limit read from
+// the cgroup, or QUEUE_MAX_BYTES when set.
+
+const defaultQueueBudget = 64 << 20 // without a memory limit
+
+var errQueueFull = errors.New("event queue byte budget exhausted")
+
+// Memory limit files, cgroup v2 then v1
+var cgroupMemoryFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+var (
+	queueBytes       atomic.Int64
+	queueBudget      int64
+	queueSize        int
+	memoryLimitBytes int64
+	maxEventBytes    int64
+
+	queueBytesGauge    = newGaugeVec("ingestion_queue_bytes", "Bytes charged for events waiting for a worker")
+	queueBudgetGauge   = newGaugeVec("ingestion_queue_budget_bytes", "Byte budget of the event queue")
+	queueRejectedTotal = newCounterVec("ingestion_queue_rejected_total", "Events refused by queue admission", "reason")
+	memoryLimitGauge   = newGaugeVec("memory_limit_bytes", "Container memory limit from the cgroup, 0 if unlimited")
+	heapInuseGauge     = newGaugeVec("go_heap_inuse_bytes", "Bytes in in-use heap spans")
+	heapObjectsGauge   = newGaugeVec("go_heap_objects", "Allocated heap objects")
+	goMemoryLimitGauge = newGaugeVec("go_memory_limit_bytes", "Go runtime soft memory limit")
+)
+
+// queuedBatch is one queue entry with the bytes it was charged, the
+// lineage trail its messages carry and the envelope its events were decoded
+// into, released by the worker
+type queuedBatch struct {
+	events   []map[string]interface{}
+	bytes    int64
+	lineage  *eventLineage
+	envelope *eventEnvelope
+	accepted []string // coalesced: ingested_at of each member
+}
+
+func initQueue() {
+	queueSize = getEnvInt("QUEUE_MAX_EVENTS", 1000)
+	if queueSize <= 0 {
+		log.Fatalf("QUEUE_MAX_EVENTS must be positive")
+	}
+	eventChannel = make(chan queuedBatch, queueSize)
+
+	// Bodies are read before they are charged, so one must not be able to
+	// take more than the budget
+	maxEventBytes = int64(getEnvInt("EVENT_MAX_BYTES", 1<<20))
+	if maxEventBytes <= 0 {
+		log.Fatalf("EVENT_MAX_BYTES must be positive")
+	}
+
+	memoryLimitBytes = cgroupMemoryLimit()
+	memoryLimitGauge.Set(float64(memoryLimitBytes))
+
+	fraction, err := strconv.ParseFloat(getEnv("QUEUE_MEMORY_FRACTION", "0.1"), 64)
+	if err != nil || fraction <= 0 || fraction > 1 {
+		log.Fatalf("QUEUE_MEMORY_FRACTION must be in (0, 1]")
+	}
+	queueBudget = int64(getEnvInt("QUEUE_MAX_BYTES", 0))
+	switch {
+	case queueBudget > 0:
+	case memoryLimitBytes > 0:
+		queueBudget = int64(float64(memoryLimitBytes) * fraction)
+	default:
+		queueBudget = defaultQueueBudget
+	}
+	queueBudgetGauge.Set(float64(queueBudget))
+
+	// Let the GC work harder before the container is OOM-killed, unless
+	// GOMEMLIMIT says otherwise
+	if memoryLimitBytes > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(memoryLimitBytes * 9 / 10)
+	}
+
+	log.Printf("Event queue bounded at %d events and %d bytes (memory limit %d)", queueSize, queueBudget, memoryLimitBytes)
+}
+
+// cgroupMemoryLimit returns the container memory limit, or 0 if unlimited
+func cgroupMemoryLimit() int64 {
+	for _, path := range cgroupMemoryFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		// cgroup v1 reports an unset limit as a huge page-aligned number
+		if err != nil || limit <= 0 || limit >= math.MaxInt64/2 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+// queueFull reports whether the byte budget is already used up, so a
+// request can be refused before its body is read
+func queueFull() bool {
+	return queueBytes.Load() >= queueBudget
+}
+
+// reserveQueue charges a batch against the byte budget. A batch larger than
+// the whole budget is still admitted into an empty queue.
+func reserveQueue(charge int64) bool {
+	total := queueBytes.Add(charge)
+	if total > queueBudget && total != charge {
+		queueBytes.Add(-charge)
+		queueRejectedTotal.Inc("bytes")
+		return false
+	}
+	queueBytesGauge.Set(float64(total))
+	return true
+}
+
+// releaseQueue returns a batch's charge once it has left the queue
+func releaseQueue(charge int64) {
+	queueBytesGauge.Set(float64(queueBytes.Add(-charge)))
+}
+
+// enqueue blocks until a batch that has already been charged and
+// acknowledged fits in the channel
+func enqueue(batch queuedBatch) {
+	eventChannel <- batch
+}
+
+// memoryLoop exports Go heap usage next to the queue accounting, and
+// resyncs the queue gauge after racing updates
+func memoryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var stats runtime.MemStats
+	for range ticker.C {
+		queueBytesGauge.Set(float64(queueBytes.Load()))
+		runtime.ReadMemStats(&stats)
+		heapInuseGauge.Set(float64(stats.HeapInuse))
+		heapObjectsGauge.Set(float64(stats.HeapObjects))
+		goMemoryLimitGauge.Set(float64(debug.SetMemoryLimit(-1)))
+	}
+}
@@ -0,0 +1,189 @@
+// Package receipt defines the signed ingestion receipts the ingestion
+// service returns for accepted events, and what partners and auditors need
+// to check them offline: the signed payload, the header encoding, the
+// published key document and the event fingerprint.
+//
+// A receipt is an Ed25519 signature by the key named in key_id over
+//
+//	ingest-receipt/v1\n<event_id>\n<fingerprint>\n<received_at>\n<tenant>
+//
+// where fingerprint is the hex SHA-256 of the event body in canonical form
+// (see Fingerprint), received_at is RFC 3339 in UTC and tenant is empty
+// without tenants. None of the fields may contain a newline.
+package receipt
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// HeaderKey is the response header carrying the encoded receipt
+	HeaderKey = "X-Ingest-Receipt"
+	// Algorithm names the signature scheme in published keys
+	Algorithm = "Ed25519"
+	// Version prefixes the signed payload
+	Version = "ingest-receipt/v1"
+)
+
+var (
+	// ErrUnknownKey is returned by Verify when key_id is not in the key set
+	ErrUnknownKey = errors.New("receipt signed by an unknown key")
+	// ErrBadSignature is returned by Verify when the signature does not match
+	ErrBadSignature = errors.New("receipt signature is invalid")
+	// ErrFingerprint is returned by VerifyBody when the body does not match
+	ErrFingerprint = errors.New("event body does not match the receipt fingerprint")
+)
+
+// Receipt is the proof that the service accepted an event
+type Receipt struct {
+	EventID     string `json:"event_id"`
+	Fingerprint string `json:"fingerprint"`
+	ReceivedAt  string `json:"received_at"`
+	Tenant      string `json:"tenant"`
+	KeyID       string `json:"key_id"`
+	Signature   string `json:"signature"` // base64
+}
+
+// Payload returns the bytes that are signed
+func (r Receipt) Payload() ([]byte, error) {
+	fields := []string{Version, r.EventID, r.Fingerprint, r.ReceivedAt, r.Tenant}
+	for _, f := range fields {
+		if strings.ContainsAny(f, "\r\n") {
+			return nil, fmt.Errorf("receipt field %q contains a newline", f)
+		}
+	}
+	return []byte(strings.Join(fields, "\n")), nil
+}
+
+// Sign signs the receipt with key, recording keyID
+func (r *Receipt) Sign(keyID string, key ed25519.PrivateKey) error {
+	r.KeyID = keyID
+	payload, err := r.Payload()
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// Verify checks the signature against the key set
+func (r Receipt) Verify(keys KeySet) error {
+	key, ok := keys[r.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+	payload, err := r.Payload()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(key, payload, signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// VerifyBody checks the signature and that body is the event the receipt
+// was issued for
+func (r Receipt) VerifyBody(keys KeySet, body []byte) error {
+	if err := r.Verify(keys); err != nil {
+		return err
+	}
+	fingerprint, err := Fingerprint(body)
+	if err != nil {
+		return err
+	}
+	if fingerprint != r.Fingerprint {
+		return ErrFingerprint
+	}
+	return nil
+}
+
+// Encode returns the header form of the receipt: its JSON in unpadded
+// base64url
+func (r Receipt) Encode() string {
+	data, _ := json.Marshal(r)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses the header form of a receipt
+func Decode(s string) (Receipt, error) {
+	var r Receipt
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return r, fmt.Errorf("decode receipt: %v", err)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("decode receipt: %v", err)
+	}
+	return r, nil
+}
+
+// Fingerprint hashes an event body in canonical form: what json.Marshal
+// gives for the decoded object (sorted keys, Go's float formatting and
+// string escaping). Whitespace and key order in body do not matter.
+func Fingerprint(body []byte) (string, error) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", err
+	}
+	if event == nil {
+		return "", errors.New("event must be a JSON object")
+	}
+	canon, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(canon)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// PublishedKey is one public key as served by /receipts/keys
+type PublishedKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // base64
+	Status    string `json:"status"`     // current or retired
+}
+
+// KeyDocument is the body of /receipts/keys; saved, it lets receipts be
+// verified without the service
+type KeyDocument struct {
+	Current string         `json:"current"`
+	Keys    []PublishedKey `json:"keys"`
+}
+
+// KeySet maps key IDs to public keys
+type KeySet map[string]ed25519.PublicKey
+
+// KeySet decodes the published keys
+func (d KeyDocument) KeySet() (KeySet, error) {
+	keys := make(KeySet, len(d.Keys))
+	for _, k := range d.Keys {
+		if k.Algorithm != "" && k.Algorithm != Algorithm {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %s", k.ID, k.Algorithm)
+		}
+		public, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s: invalid public key", k.ID)
+		}
+		keys[k.ID] = public
+	}
+	return keys, nil
+}
+
+// ParseKeys decodes a saved /receipts/keys document
+func ParseKeys(data []byte) (KeySet, error) {
+	var doc KeyDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.KeySet()
+}
@@ -0,0 +1,198 @@
+package receipt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testBody = []byte(`{"user_id": "user_1", "event_type": "purchase", "amount": 12.5, "items": [1, 2]}`)
+
+// testKey derives a fixed key so failures are reproducible
+func testKey(seed byte) (ed25519.PrivateKey, ed25519.PublicKey) {
+	private := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return private, private.Public().(ed25519.PublicKey)
+}
+
+// signed returns a receipt for testBody signed with key "k1", and the key
+// set that verifies it
+func signed(t *testing.T) (Receipt, KeySet) {
+	t.Helper()
+	private, public := testKey(1)
+	fingerprint, err := Fingerprint(testBody)
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	r := Receipt{
+		EventID:     "3f1c0a",
+		Fingerprint: fingerprint,
+		ReceivedAt:  "2026-10-01T12:00:00.123Z",
+		Tenant:      "acme",
+	}
+	if err := r.Sign("k1", private); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return r, KeySet{"k1": public}
+}
+
+func TestSignVerify(t *testing.T) {
+	r, keys := signed(t)
+	if r.KeyID != "k1" {
+		t.Errorf("KeyID = %q, want k1", r.KeyID)
+	}
+	if err := r.Verify(keys); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := r.VerifyBody(keys, testBody); err != nil {
+		t.Errorf("VerifyBody: %v", err)
+	}
+
+	decoded, err := Decode(r.Encode())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded != r {
+		t.Errorf("Decode(Encode()) = %+v, want %+v", decoded, r)
+	}
+	if err := decoded.Verify(keys); err != nil {
+		t.Errorf("Verify after Decode: %v", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*Receipt)
+	}{
+		{"event_id", func(r *Receipt) { r.EventID = "3f1c0b" }},
+		{"fingerprint", func(r *Receipt) { r.Fingerprint, _ = Fingerprint([]byte(`{}`)) }},
+		{"received_at", func(r *Receipt) { r.ReceivedAt = "2026-10-01T12:00:01.123Z" }},
+		{"tenant", func(r *Receipt) { r.Tenant = "other" }},
+		{"signature", func(r *Receipt) {
+			sig, _ := base64.StdEncoding.DecodeString(r.Signature)
+			sig[0] ^= 1
+			r.Signature = base64.StdEncoding.EncodeToString(sig)
+		}},
+		{"signature encoding", func(r *Receipt) { r.Signature = "not base64!" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, keys := signed(t)
+			tt.tamper(&r)
+			if err := r.Verify(keys); !errors.Is(err, ErrBadSignature) {
+				t.Errorf("Verify = %v, want ErrBadSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifyOtherBody(t *testing.T) {
+	r, keys := signed(t)
+	other := []byte(`{"user_id": "user_1", "event_type": "purchase", "amount": 125, "items": [1, 2]}`)
+	if err := r.VerifyBody(keys, other); !errors.Is(err, ErrFingerprint) {
+		t.Errorf("VerifyBody = %v, want ErrFingerprint", err)
+	}
+}
+
+func TestVerifyUnknownKey(t *testing.T) {
+	r, _ := signed(t)
+	_, other := testKey(2)
+	if err := r.Verify(KeySet{"k2": other}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Verify = %v, want ErrUnknownKey", err)
+	}
+
+	// A known ID with a different key is a bad signature, not an unknown key
+	if err := r.Verify(KeySet{"k1": other}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verify with the wrong key = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestNewlineInField(t *testing.T) {
+	private, public := testKey(1)
+	for _, r := range []Receipt{
+		{EventID: "a\nb", Fingerprint: "f", ReceivedAt: "t"},
+		{EventID: "a", Fingerprint: "f", ReceivedAt: "t", Tenant: "acme\r"},
+	} {
+		if err := r.Sign("k1", private); err == nil {
+			t.Errorf("Sign accepted %+v", r)
+		}
+	}
+
+	// Moving a field boundary must not keep a signature valid
+	r := Receipt{EventID: "a", Fingerprint: "b\nc", ReceivedAt: "d"}
+	shifted := Receipt{EventID: "a\nb", Fingerprint: "c", ReceivedAt: "d"}
+	payload := []byte(Version + "\na\nb\nc\nd\n")
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, payload))
+	for _, rec := range []Receipt{r, shifted} {
+		rec.KeyID, rec.Signature = "k1", signature
+		if err := rec.Verify(KeySet{"k1": public}); err == nil {
+			t.Errorf("Verify accepted %+v", rec)
+		}
+	}
+}
+
+func TestFingerprintCanonical(t *testing.T) {
+	want, err := Fingerprint(testBody)
+	if err != nil {
+		t.Fatalf("Fingerprint: %v", err)
+	}
+	for _, body := range []string{
+		`{"items":[1,2],"amount":12.5,"event_type":"purchase","user_id":"user_1"}`,
+		"\n{ \"event_type\" : \"purchase\",\n\t\"user_id\":\"user_1\", \"items\": [ 1, 2 ], \"amount\": 1.25e1 }\n",
+	} {
+		got, err := Fingerprint([]byte(body))
+		if err != nil {
+			t.Errorf("Fingerprint(%s): %v", body, err)
+		} else if got != want {
+			t.Errorf("Fingerprint(%s) = %s, want %s", body, got, want)
+		}
+	}
+
+	if got, _ := Fingerprint([]byte(`{"user_id":"user_2","event_type":"purchase","amount":12.5,"items":[1,2]}`)); got == want {
+		t.Error("different bodies have the same fingerprint")
+	}
+	for _, body := range []string{`null`, `[1]`, `{"a":`} {
+		if _, err := Fingerprint([]byte(body)); err == nil {
+			t.Errorf("Fingerprint(%s) accepted a non-object", body)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	_, public := testKey(1)
+	encoded := base64.StdEncoding.EncodeToString(public)
+
+	doc, _ := json.Marshal(KeyDocument{Current: "k1", Keys: []PublishedKey{
+		{ID: "k1", Algorithm: Algorithm, PublicKey: encoded, Status: "current"},
+	}})
+	keys, err := ParseKeys(doc)
+	if err != nil {
+		t.Fatalf("ParseKeys: %v", err)
+	}
+	if !public.Equal(keys["k1"]) {
+		t.Errorf("ParseKeys returned %v for k1, want %v", keys["k1"], public)
+	}
+
+	tests := []struct {
+		name string
+		key  PublishedKey
+	}{
+		{"not base64", PublishedKey{ID: "k1", PublicKey: "%%%"}},
+		{"short key", PublishedKey{ID: "k1", PublicKey: base64.StdEncoding.EncodeToString(public[:16])}},
+		{"algorithm", PublishedKey{ID: "k1", Algorithm: "RSA", PublicKey: encoded}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, _ := json.Marshal(KeyDocument{Keys: []PublishedKey{tt.key}})
+			if _, err := ParseKeys(doc); err == nil {
+				t.Error("ParseKeys accepted a bad key")
+			}
+		})
+	}
+	if _, err := ParseKeys([]byte(`{"keys": [`)); err == nil {
+		t.Error("ParseKeys accepted invalid JSON")
+	}
+}
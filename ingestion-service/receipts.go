@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"ingestion-service/receipt"
+)
+
+// Signed receipts give partners proof that an event was accepted: with
+// RECEIPT_KEYS_FILE set, every accepted event's response carries an Ed25519
+// receipt over its event ID, content fingerprint, receipt time and tenant,
+// in the body and in the X-Ingest-Receipt header.
+//
+// The key file names the current signing key and lists older keys, with or
+// without their private halves, so receipts they signed still verify:
+//
+//	{"current": "2026-10", "keys": [
+//	  {"id": "2026-10", "private_key": "<base64 seed>"},
+//	  {"id": "2026-07", "public_key": "<base64>"}]}
+//
+// It is re-read when it changes, so keys rotate without a restart. Public
+// keys are published at /receipts/keys and receipts are checked at
+// /receipts/verify or offline with the receipt package.
+
+var (
+	receiptsEnabled bool
+	receiptKeys     = &receiptKeyring{}
+
+	receiptsIssuedTotal       = newCounterVec("receipts_issued_total", "Signed receipts returned for accepted events", "key_id")
+	receiptVerificationsTotal = newCounterVec("receipt_verifications_total", "Receipts checked by /receipts/verify", "result")
+)
+
+// receiptKeyFile is the RECEIPT_KEYS_FILE format
+type receiptKeyFile struct {
+	Current string `json:"current"`
+	Keys    []struct {
+		ID         string `json:"id"`
+		PrivateKey string `json:"private_key"` // base64 32-byte seed
+		PublicKey  string `json:"public_key"`  // base64, for keys kept only to verify
+	} `json:"keys"`
+}
+
+// receiptKeyring holds the signing key and every published public key
+type receiptKeyring struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	current string
+	signing ed25519.PrivateKey
+	doc     receipt.KeyDocument
+	keys    receipt.KeySet
+}
+
+func initReceipts() {
+	path := getEnv("RECEIPT_KEYS_FILE", "")
+	if path == "" {
+		return
+	}
+
+	receiptKeys.path = path
+	if err := receiptKeys.reload(); err != nil {
+		log.Fatalf("Failed to load receipt keys from %s: %v", path, err)
+	}
+	go receiptKeys.refreshLoop(getEnvDuration("RECEIPT_KEYS_RELOAD_INTERVAL", time.Minute))
+	receiptsEnabled = true
+	log.Printf("Signed receipts enabled (key %s)", receiptKeys.currentID())
+}
+
+// reload re-reads the key file if it changed
+func (k *receiptKeyring) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var file receiptKeyFile
+	if err := loadJSONFile(k.path, &file); err != nil {
+		return err
+	}
+	doc := receipt.KeyDocument{Current: file.Current}
+	keys := make(receipt.KeySet, len(file.Keys))
+	var signing ed25519.PrivateKey
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return errors.New("key without an id")
+		}
+		if _, ok := keys[entry.ID]; ok {
+			return fmt.Errorf("duplicate key %s", entry.ID)
+		}
+		var public ed25519.PublicKey
+		switch {
+		case entry.PrivateKey != "":
+			seed, err := base64.StdEncoding.DecodeString(entry.PrivateKey)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return fmt.Errorf("key %s: private_key must be a base64 %d-byte seed", entry.ID, ed25519.SeedSize)
+			}
+			private := ed25519.NewKeyFromSeed(seed)
+			public = private.Public().(ed25519.PublicKey)
+			if entry.ID == file.Current {
+				signing = private
+			}
+		case entry.PublicKey != "":
+			decoded, err := base64.StdEncoding.DecodeString(entry.PublicKey)
+			if err != nil || len(decoded) != ed25519.PublicKeySize {
+				return fmt.Errorf("key %s: invalid public_key", entry.ID)
+			}
+			public = decoded
+		default:
+			return fmt.Errorf("key %s has neither private_key nor public_key", entry.ID)
+		}
+		keys[entry.ID] = public
+		status := "retired"
+		if entry.ID == file.Current {
+			status = "current"
+		}
+		doc.Keys = append(doc.Keys, receipt.PublishedKey{
+			ID:        entry.ID,
+			Algorithm: receipt.Algorithm,
+			PublicKey: base64.StdEncoding.EncodeToString(public),
+			Status:    status,
+		})
+	}
+	if signing == nil {
+		return fmt.Errorf("current key %q has no private_key", file.Current)
+	}
+
+	k.mu.Lock()
+	previous := k.current
+	k.current, k.signing, k.doc, k.keys = file.Current, signing, doc, keys
+	k.modTime = info.ModTime()
+	k.mu.Unlock()
+	if previous != "" && previous != file.Current {
+		log.Printf("Receipt signing key rotated from %s to %s", previous, file.Current)
+	}
+	return nil
+}
+
+func (k *receiptKeyring) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := k.reload(); err != nil {
+			log.Printf("Failed to reload receipt keys: %v", err)
+		}
+	}
+}
+
+func (k *receiptKeyring) currentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// sign issues a receipt with the current key
+func (k *receiptKeyring) sign(r *receipt.Receipt) error {
+	k.mu.RLock()
+	id, key := k.current, k.signing
+	k.mu.RUnlock()
+	return r.Sign(id, key)
+}
+
+// issueReceipt signs the receipt for an accepted event and sets the header;
+// it returns nil when receipts are off or signing fails
+func issueReceipt(w http.ResponseWriter, env *eventEnvelope, eventID string, owner *tenant, received time.Time) *receipt.Receipt {
+	if !receiptsEnabled {
+		return nil
+	}
+	r := &receipt.Receipt{
+		EventID:     eventID,
+		Fingerprint: env.id(),
+		ReceivedAt:  received.UTC().Format(time.RFC3339Nano),
+	}
+	if owner != nil {
+		r.Tenant = owner.ID
+	}
+	if err := receiptKeys.sign(r); err != nil {
+		log.Printf("Failed to sign receipt for %s: %v", eventID, err)
+		return nil
+	}
+	receiptsIssuedTotal.Inc(r.KeyID)
+	w.Header().Set(receipt.HeaderKey, r.Encode())
+	return r
+}
+
+// receiptKeysHandler publishes the public keys receipts are signed with
+func receiptKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !receiptsEnabled {
+		http.Error(w, "Receipts are not enabled", http.StatusNotFound)
+		return
+	}
+	receiptKeys.mu.RLock()
+	doc := receiptKeys.doc
+	receiptKeys.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// verifyRequest is the body of /receipts/verify: a receipt, either as JSON
+// or in its header form, and optionally the event body it was issued for
+type verifyRequest struct {
+	Receipt *receipt.Receipt `json:"receipt"`
+	Encoded string           `json:"encoded"`
+	Event   json.RawMessage  `json:"event"`
+}
+
+// receiptVerifyHandler checks a receipt against the published keys
+func receiptVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !receiptsEnabled {
+		http.Error(w, "Receipts are not enabled", http.StatusNotFound)
+		return
+	}
+	var req verifyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	var rec receipt.Receipt
+	switch {
+	case req.Receipt != nil:
+		rec = *req.Receipt
+	case req.Encoded != "":
+		var err error
+		if rec, err = receipt.Decode(req.Encoded); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "receipt or encoded is required", http.StatusBadRequest)
+		return
+	}
+
+	receiptKeys.mu.RLock()
+	keys := receiptKeys.keys
+	receiptKeys.mu.RUnlock()
+
+	var err error
+	if len(req.Event) > 0 {
+		err = rec.VerifyBody(keys, req.Event)
+	} else {
+		err = rec.Verify(keys)
+	}
+	response := map[string]interface{}{"valid": err == nil, "receipt": rec}
+	result := "valid"
+	if err != nil {
+		response["error"] = err.Error()
+		result = "invalid"
+	}
+	receiptVerificationsTotal.Inc(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
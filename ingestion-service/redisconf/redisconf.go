@@ -0,0 +1,186 @@
+// Package redisconf builds the Redis client shared by the ingestion service
+// and its commands from environment variables. It supports standalone,
+// Sentinel and Cluster deployments, TLS, and ACL users.
+//
+// Failovers are absorbed by bounded retries: a command is retried up to
+// REDIS_MAX_RETRIES times with exponential backoff, and Sentinel/Cluster
+// clients re-resolve the master or slot owner between attempts. After that
+// the error is returned to the caller.
+package redisconf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Modes supported by REDIS_MODE
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
+// Config describes how to reach Redis
+type Config struct {
+	Mode       string
+	Addrs      []string // node, sentinel or cluster seed addresses
+	MasterName string   // Sentinel only
+
+	Username         string
+	Password         string
+	SentinelUsername string
+	SentinelPassword string
+
+	TLS           bool
+	TLSCAFile     string
+	TLSSkipVerify bool
+
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+	DialTimeout     time.Duration
+	PoolSize        int
+	MinIdleConns    int
+
+	// HashTags wraps per-user key parts in {...} so all of a user's keys
+	// map to one cluster slot
+	HashTags bool
+}
+
+// FromEnv reads REDIS_* variables
+func FromEnv() (Config, error) {
+	c := Config{
+		Mode:             getEnv("REDIS_MODE", ModeStandalone),
+		Addrs:            splitAddrs(getEnv("REDIS_ADDR", "redis:6379")),
+		MasterName:       getEnv("REDIS_MASTER_NAME", ""),
+		Username:         getEnv("REDIS_USERNAME", ""),
+		Password:         getEnv("REDIS_PASSWORD", ""),
+		SentinelUsername: getEnv("REDIS_SENTINEL_USERNAME", ""),
+		SentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+		TLS:              getEnv("REDIS_TLS", "false") == "true",
+		TLSCAFile:        getEnv("REDIS_TLS_CA_FILE", ""),
+		TLSSkipVerify:    getEnv("REDIS_TLS_SKIP_VERIFY", "false") == "true",
+		PoolSize:         20,
+		MinIdleConns:     5,
+	}
+
+	var err error
+	if c.MaxRetries, err = strconv.Atoi(getEnv("REDIS_MAX_RETRIES", "3")); err != nil {
+		return c, fmt.Errorf("REDIS_MAX_RETRIES: %w", err)
+	}
+	if c.MinRetryBackoff, err = time.ParseDuration(getEnv("REDIS_MIN_RETRY_BACKOFF", "8ms")); err != nil {
+		return c, fmt.Errorf("REDIS_MIN_RETRY_BACKOFF: %w", err)
+	}
+	if c.MaxRetryBackoff, err = time.ParseDuration(getEnv("REDIS_MAX_RETRY_BACKOFF", "512ms")); err != nil {
+		return c, fmt.Errorf("REDIS_MAX_RETRY_BACKOFF: %w", err)
+	}
+	if c.DialTimeout, err = time.ParseDuration(getEnv("REDIS_DIAL_TIMEOUT", "5s")); err != nil {
+		return c, fmt.Errorf("REDIS_DIAL_TIMEOUT: %w", err)
+	}
+	c.HashTags = getEnv("REDIS_HASH_TAGS", strconv.FormatBool(c.Mode == ModeCluster)) == "true"
+
+	switch c.Mode {
+	case ModeStandalone, ModeCluster:
+	case ModeSentinel:
+		if c.MasterName == "" {
+			return c, fmt.Errorf("REDIS_MODE=sentinel needs REDIS_MASTER_NAME")
+		}
+	default:
+		return c, fmt.Errorf("unknown REDIS_MODE %q", c.Mode)
+	}
+	return c, nil
+}
+
+// WithAddrs returns a copy of the config pointing at other addresses
+func (c Config) WithAddrs(addrs string) Config {
+	c.Addrs = splitAddrs(addrs)
+	return c
+}
+
+// NewClient connects according to the config's mode
+func (c Config) NewClient() (redis.UniversalClient, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            c.Addrs,
+		MasterName:       c.MasterName,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		MaxRetries:       c.MaxRetries,
+		MinRetryBackoff:  c.MinRetryBackoff,
+		MaxRetryBackoff:  c.MaxRetryBackoff,
+		DialTimeout:      c.DialTimeout,
+		PoolSize:         c.PoolSize,
+		MinIdleConns:     c.MinIdleConns,
+		// Redirects are how the cluster client follows a failover
+		MaxRedirects: 8,
+	}
+	if c.TLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.TLSSkipVerify}
+		if c.TLSCAFile != "" {
+			pem, err := os.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", c.TLSCAFile)
+			}
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	switch c.Mode {
+	case ModeCluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case ModeSentinel:
+		return redis.NewFailoverClient(opts.Failover()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
+	}
+}
+
+// Tag wraps a key part in a hash tag when hash tags are enabled
+func (c Config) Tag(part string) string {
+	if c.HashTags {
+		return "{" + part + "}"
+	}
+	return part
+}
+
+// ForEachNode runs fn against every master, so SCAN-style commands see the
+// whole keyspace in cluster mode
+func ForEachNode(ctx context.Context, client redis.UniversalClient, fn func(context.Context, *redis.Client) error) error {
+	switch c := client.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(ctx, fn)
+	case *redis.Client:
+		return fn(ctx, c)
+	}
+	return fmt.Errorf("unsupported Redis client %T", client)
+}
+
+func splitAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Data residency pins each event to a region and keeps it there: the event
+// is produced to the region's Kafka cluster and topic, and its dedup,
+// sequence and CEP keys live in the region's Redis under the region's prefix.
+//
+// The region is resolved, in order of precedence, from:
+//   tenant  - the region the event's tenant is pinned to (TENANTS_FILE)
+//   field   - an explicit region field on the event
+//   geo     - the event's "country" mapped to a region
+//   default - default_region, if configured
+//
+// Events whose region can't be determined are blocked (422) or produced to
+// the quarantine topic for review, per the "undetermined" policy.
+
+const residencyCountsPrefix = "residency:"
+
+var errResidencyUnknown = errors.New("residency region could not be determined")
+
+var (
+	residencyEnabled   bool
+	residencyCfg       residencyConfig
+	residencyRegions   map[string]*residencyRegion
+	residencyByCountry map[string]string
+	quarantineWriter   *kafka.Writer
+	quarantineFamilies *familyProducer
+
+	residencyEventsTotal = newCounterVec("residency_events_total", "Events by residency region and outcome", "region", "outcome")
+)
+
+// residencyConfig is loaded from RESIDENCY_FILE
+type residencyConfig struct {
+	Field             string                      `json:"field"`          // default "region"
+	DefaultRegion     string                      `json:"default_region"` // empty = undetermined
+	Undetermined      string                      `json:"undetermined"`   // "block" (default) or "quarantine"
+	QuarantineBrokers string                      `json:"quarantine_brokers"`
+	QuarantineTopic   string                      `json:"quarantine_topic"` // default "raw-events-quarantine"
+	Regions           map[string]*residencyRegion `json:"regions"`
+}
+
+type residencyRegion struct {
+	Brokers     string   `json:"brokers"`    // default KAFKA_BROKERS
+	Topic       string   `json:"topic"`      // default "raw-events"
+	RedisAddr   string   `json:"redis_addr"` // same REDIS_MODE and credentials as the default
+	RedisPrefix string   `json:"redis_prefix"`
+	Countries   []string `json:"countries"`
+
+	writer    *kafka.Writer
+	families  *familyProducer // exploded families, to the region's topic
+	cepWriter *kafka.Writer   // pattern matches, to CEP_OUTPUT_TOPIC
+	redis     redis.UniversalClient
+
+	heartbeatWriter *kafka.Writer // watermarks, to the region's topic
+}
+
+func initResidency(brokers string) {
+	path := getEnv("RESIDENCY_FILE", "")
+	if path == "" {
+		return
+	}
+	if err := loadJSONFile(path, &residencyCfg); err != nil {
+		log.Fatalf("Failed to load residency config from %s: %v", path, err)
+	}
+	cfg := &residencyCfg
+	if len(cfg.Regions) == 0 {
+		log.Fatalf("Residency config %s has no regions", path)
+	}
+	if cfg.Field == "" {
+		cfg.Field = "region"
+	}
+	if cfg.Undetermined == "" {
+		cfg.Undetermined = "block"
+	}
+	if cfg.Undetermined != "block" && cfg.Undetermined != "quarantine" {
+		log.Fatalf("Unknown residency policy %q for undetermined events", cfg.Undetermined)
+	}
+	if cfg.DefaultRegion != "" && cfg.Regions[cfg.DefaultRegion] == nil {
+		log.Fatalf("Default residency region %q is not configured", cfg.DefaultRegion)
+	}
+
+	residencyByCountry = make(map[string]string)
+	for name, region := range cfg.Regions {
+		if region.Brokers == "" {
+			region.Brokers = brokers
+		}
+		if region.Topic == "" {
+			region.Topic = "raw-events"
+		}
+		region.writer = newKafkaWriter(region.Brokers, region.Topic)
+		if explodeFamilies != nil {
+			region.families = newFamilyProducer(region.Brokers, region.Topic)
+		}
+		if cepWriter != nil {
+			region.cepWriter = newKafkaWriter(region.Brokers, cepWriter.Topic)
+		}
+		if heartbeatWriter != nil {
+			region.heartbeatWriter = newKafkaWriter(region.Brokers, region.Topic)
+			region.heartbeatWriter.Balancer = partitionBalancer{}
+		}
+		region.redis = redisClient
+		if region.RedisAddr != "" {
+			client, err := redisConfig.WithAddrs(region.RedisAddr).NewClient()
+			if err != nil {
+				log.Fatalf("Residency region %s: %v", name, err)
+			}
+			region.redis = client
+		}
+		for _, country := range region.Countries {
+			country = strings.ToUpper(country)
+			if other, ok := residencyByCountry[country]; ok {
+				log.Fatalf("Country %s assigned to both %s and %s", country, other, name)
+			}
+			residencyByCountry[country] = name
+		}
+	}
+
+	for _, t := range tenantsByID {
+		if t.Region != "" && cfg.Regions[t.Region] == nil {
+			log.Fatalf("Tenant %s is pinned to unknown region %q", t.ID, t.Region)
+		}
+	}
+
+	if cfg.Undetermined == "quarantine" {
+		if cfg.QuarantineBrokers == "" {
+			cfg.QuarantineBrokers = brokers
+		}
+		if cfg.QuarantineTopic == "" {
+			cfg.QuarantineTopic = "raw-events-quarantine"
+		}
+		quarantineWriter = newKafkaWriter(cfg.QuarantineBrokers, cfg.QuarantineTopic)
+		if explodeFamilies != nil {
+			quarantineFamilies = newFamilyProducer(cfg.QuarantineBrokers, cfg.QuarantineTopic)
+		}
+	}
+
+	// Probes carry no country, so they need a region of their own
+	if canaryUsers != nil {
+		if canaryRegion != "" && cfg.Regions[canaryRegion] == nil {
+			log.Fatalf("CANARY_REGION %q is not a configured residency region", canaryRegion)
+		}
+		owner := tenants[canaryAPIKey]
+		if canaryRegion == "" && cfg.DefaultRegion == "" && (owner == nil || owner.Region == "") {
+			log.Printf("Canary probes resolve to no residency region and will be %s; set CANARY_REGION", map[string]string{"block": "blocked", "quarantine": "quarantined"}[cfg.Undetermined])
+		}
+	}
+
+	residencyRegions = cfg.Regions
+	residencyEnabled = true
+	log.Printf("Data residency enabled for %d regions (undetermined: %s)", len(cfg.Regions), cfg.Undetermined)
+}
+
+// applyResidency stamps residency_region and residency_source. Undetermined
+// events are marked quarantined, or rejected with errResidencyUnknown.
+func applyResidency(event map[string]interface{}, owner *tenant) error {
+	region, source := "", ""
+	explicit := strings.ToLower(eventString(event, residencyCfg.Field))
+	switch {
+	case owner != nil && owner.Region != "":
+		region, source = owner.Region, "tenant"
+	case explicit != "" && residencyRegions[explicit] != nil:
+		region, source = explicit, "field"
+	case residencyByCountry[strings.ToUpper(eventString(event, "country"))] != "":
+		region, source = residencyByCountry[strings.ToUpper(eventString(event, "country"))], "geo"
+	case residencyCfg.DefaultRegion != "":
+		region, source = residencyCfg.DefaultRegion, "default"
+	}
+
+	if region == "" {
+		if quarantineWriter == nil {
+			countResidency("", "blocked", 1)
+			return errResidencyUnknown
+		}
+		event["residency_status"] = "quarantined"
+		countResidency("", "quarantined", 1)
+		return nil
+	}
+	event["residency_region"] = region
+	event["residency_source"] = source
+	countResidency(region, "resolved", 1)
+	return nil
+}
+
+// eventRegion returns the region of a resolved event, or nil
+func eventRegion(event map[string]interface{}) *residencyRegion {
+	return residencyRegions[eventString(event, "residency_region")]
+}
+
+// regionRedis returns the Redis client and key prefix for an event
+func regionRedis(event map[string]interface{}) (redis.UniversalClient, string) {
+	if region := eventRegion(event); region != nil {
+		return region.redis, region.RedisPrefix
+	}
+	return redisClient, ""
+}
+
+// regionWriter picks the writer for an event: the event's region, the
+// quarantine topic, or the default writer
+func regionWriter(event map[string]interface{}) *kafka.Writer {
+	if region := eventRegion(event); region != nil {
+		return region.writer
+	}
+	if eventString(event, "residency_status") == "quarantined" {
+		return quarantineWriter
+	}
+	return kafkaWriter
+}
+
+// regionFamilies picks the producer for an exploded family the same way
+func regionFamilies(event map[string]interface{}) *familyProducer {
+	if region := eventRegion(event); region != nil {
+		return region.families
+	}
+	if eventString(event, "residency_status") == "quarantined" {
+		return quarantineFamilies
+	}
+	return explodeFamilies
+}
+
+// countResidency keeps auditable per-hour counts in residency:<yyyymmddhh>
+func countResidency(region, outcome string, n int) {
+	if region == "" {
+		region = "undetermined"
+	}
+	residencyEventsTotal.Add(float64(n), region, outcome)
+
+	key := residencyCountsPrefix + time.Now().UTC().Format("2006010215")
+	pipe := redisClient.Pipeline()
+	pipe.HIncrBy(ctx, key, region+"|"+outcome, int64(n))
+	pipe.Expire(ctx, key, 35*24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Residency counting failed: %v", err)
+	}
+}
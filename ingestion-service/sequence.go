@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Sequence tracking detects client-side event loss. Clients may send a
+// per-device "seq"; the highest value seen per device_id is kept in Redis and
+// each event is classified against it:
+//
+//	first     - first event seen from the device
+//	in_order  - seq is exactly one past the highest seen
+//	gap       - seq skipped ahead; seq_gap events are presumed lost
+//	late      - seq is below the highest seen (reordered, fills an earlier gap)
+//	duplicate - seq equals the highest seen
+//
+// Every event, with or without seq, is stamped with a server_seq that
+// increases per user. Exploded children are stamped before the split and
+// carry their parent's server_seq and seq_status, so server_seq orders
+// requests rather than child events.
+//
+// Both are assigned before queue admission and given back if the event is
+// refused, so a retry after 503 is classified as the first attempt would
+// have been. Only admitted events count towards the loss stats.
+
+// Returns the previous highest seq for the device, or -1 if none
+var seqScript = redis.NewScript(`
+local prev = tonumber(redis.call('HGET', KEYS[1], 'max') or '-1')
+local seq = tonumber(ARGV[1])
+if seq > prev then
+	redis.call('HSET', KEYS[1], 'max', ARGV[1])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return prev
+`)
+
+// Takes back a refused event's server_seq unless a later event has one
+var seqUserReleaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+// Restores the device's previous highest seq unless it has moved on
+var seqDeviceReleaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'max') == ARGV[1] then
+	if tonumber(ARGV[2]) < 0 then
+		redis.call('HDEL', KEYS[1], 'max')
+	else
+		redis.call('HSET', KEYS[1], 'max', ARGV[2])
+	end
+end
+return 0
+`)
+
+const seqStatsPrefix = "metrics:seq:"
+
+var errInvalidSeq = errors.New("invalid seq")
+
+var (
+	sequenceEnabled bool
+	seqDeviceTTL    time.Duration
+
+	seqReportMu sync.RWMutex
+	seqReport   map[string]interface{} // latest sequenceLossReport
+
+	seqStatusTotal = newCounterVec("sequence_events_total", "Events by client sequence classification", "status")
+)
+
+func initSequence() {
+	if !getEnvBool("SEQUENCE_TRACKING_ENABLED", false) {
+		return
+	}
+	seqDeviceTTL = getEnvDuration("SEQ_DEVICE_TTL", 30*24*time.Hour)
+	sequenceEnabled = true
+	log.Println("Sequence tracking enabled")
+}
+
+// parseSeq accepts JSON numbers and numeric strings
+func parseSeq(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), v >= 0 && v == float64(int64(v))
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil && n >= 0
+	}
+	return 0, false
+}
+
+// seqClaim is what sequencing an event changed, held while it is admitted
+type seqClaim struct {
+	client    redis.UniversalClient
+	userKey   string
+	serverSeq int64
+	deviceKey string // empty without a device seq
+	seq       int64
+	prev      int64
+	statsKey  string
+	status    string
+	missing   int64
+}
+
+// commit counts an admitted event in the loss stats
+func (c *seqClaim) commit() {
+	if c == nil || c.status == "" {
+		return
+	}
+	seqStatusTotal.Inc(c.status)
+
+	// Cross-replica loss counters per SDK version and platform
+	stats := redisClient.Pipeline()
+	stats.HIncrBy(ctx, c.statsKey, "received", 1)
+	if c.missing > 0 {
+		stats.HIncrBy(ctx, c.statsKey, "missing", c.missing)
+	}
+	if c.status == "late" {
+		stats.HIncrBy(ctx, c.statsKey, "late", 1)
+	}
+	if _, err := stats.Exec(ctx); err != nil {
+		log.Printf("Failed to record sequence stats: %v", err)
+	}
+}
+
+// release gives back the server_seq and device seq of a refused event
+func (c *seqClaim) release() {
+	if c == nil {
+		return
+	}
+	if c.userKey != "" {
+		if err := seqUserReleaseScript.Run(ctx, c.client, []string{c.userKey}, c.serverSeq).Err(); err != nil {
+			log.Printf("Failed to release server_seq %s: %v", c.userKey, err)
+		}
+	}
+	if c.deviceKey != "" && c.seq > c.prev {
+		if err := seqDeviceReleaseScript.Run(ctx, c.client, []string{c.deviceKey}, c.seq, c.prev).Err(); err != nil {
+			log.Printf("Failed to release device seq %s: %v", c.deviceKey, err)
+		}
+	}
+}
+
+// applySequence stamps server_seq and classifies the client seq if present.
+// The returned claim is committed once the event is admitted and released
+// if it is refused.
+func applySequence(event map[string]interface{}) (*seqClaim, error) {
+	userID := eventString(event, "user_id")
+	deviceID := eventString(event, "device_id")
+	seq, hasSeq := parseSeq(event["seq"])
+	if !hasSeq && event["seq"] != nil {
+		return nil, fmt.Errorf("%w %v", errInvalidSeq, event["seq"])
+	}
+
+	client, prefix := regionRedis(event)
+	claim := &seqClaim{client: client}
+	pipe := client.Pipeline()
+	var userSeq *redis.IntCmd
+	if userID != "" {
+		claim.userKey = prefix + "seq:user:" + redisConfig.Tag(userID)
+		userSeq = pipe.Incr(ctx, claim.userKey)
+	}
+	var prevCmd *redis.Cmd
+	if hasSeq && deviceID != "" {
+		prevCmd = seqScript.Eval(ctx, pipe, []string{prefix + "seq:device:" + deviceID},
+			seq, int64(seqDeviceTTL.Seconds()))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	if userSeq != nil {
+		claim.serverSeq = userSeq.Val()
+		event["server_seq"] = claim.serverSeq
+	}
+	if prevCmd == nil {
+		return claim, nil
+	}
+
+	prev, err := prevCmd.Int64()
+	if err != nil {
+		return claim, err
+	}
+	claim.deviceKey = prefix + "seq:device:" + deviceID
+	claim.seq, claim.prev = seq, prev
+
+	var status string
+	var missing int64
+	switch {
+	case prev < 0:
+		status = "first"
+	case seq == prev+1:
+		status = "in_order"
+	case seq > prev+1:
+		status = "gap"
+		missing = seq - prev - 1
+		event["seq_gap"] = missing
+	case seq == prev:
+		status = "duplicate"
+	default:
+		status = "late"
+	}
+	event["seq_status"] = status
+	claim.status, claim.missing = status, missing
+	claim.statsKey = seqStatsPrefix + seqStatsLabel(event)
+	return claim, nil
+}
+
+// seqStatsLabel bounds the stats keys to the configured platforms and SDK
+// versions, so clients cannot create new keys
+func seqStatsLabel(event map[string]interface{}) string {
+	return clientLabel(event, "platform", clientPlatforms) + "|" +
+		clientLabel(event, "sdk_version", clientSDKVersions)
+}
+
+// sequenceReportLoop refreshes the loss report, so /metrics does not scan
+// Redis on every request
+func sequenceReportLoop(interval time.Duration) {
+	for {
+		report := sequenceLossReport()
+		seqReportMu.Lock()
+		seqReport = report
+		seqReportMu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// sequenceLossSnapshot returns the latest loss report
+func sequenceLossSnapshot() map[string]interface{} {
+	seqReportMu.RLock()
+	defer seqReportMu.RUnlock()
+	return seqReport
+}
+
+// sequenceLossReport estimates loss per platform and SDK version as
+// (missing - late) / (received + missing - late)
+func sequenceLossReport() map[string]interface{} {
+	report := make(map[string]interface{})
+	keys, err := scanKeys(seqStatsPrefix + "*")
+	if err != nil {
+		log.Printf("Sequence loss report failed: %v", err)
+	}
+	for _, key := range keys {
+		fields, err := redisClient.HGetAll(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		received, _ := strconv.ParseInt(fields["received"], 10, 64)
+		missing, _ := strconv.ParseInt(fields["missing"], 10, 64)
+		late, _ := strconv.ParseInt(fields["late"], 10, 64)
+
+		lost := missing - late
+		if lost < 0 {
+			lost = 0
+		}
+		lossRate := 0.0
+		if expected := received + lost; expected > 0 {
+			lossRate = float64(lost) / float64(expected)
+		}
+
+		platform, sdk, _ := strings.Cut(strings.TrimPrefix(key, seqStatsPrefix), "|")
+		report[platform+"/"+sdk] = map[string]interface{}{
+			"platform":    platform,
+			"sdk_version": sdk,
+			"received":    received,
+			"missing":     missing,
+			"late":        late,
+			"loss_rate":   lossRate,
+		}
+	}
+	return report
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event status records let clients look up what happened to an event at
+// GET /events/status?event_id=<id>[&region=<region>]. Suppressed
+// near-duplicates always get a record linking them to the original; with
+// EVENT_STATUS_ENABLED accepted events are recorded too and updated once
+// produced.
+
+const statusPrefix = "status:"
+
+var (
+	statusEnabled bool
+	statusTTL     time.Duration
+)
+
+func initStatus() {
+	statusEnabled = getEnvBool("EVENT_STATUS_ENABLED", false)
+	statusTTL = getEnvDuration("EVENT_STATUS_TTL", 24*time.Hour)
+}
+
+// recordStatus merges fields into an event's status record in the event's
+// region
+func recordStatus(event map[string]interface{}, eventID string, fields map[string]interface{}) {
+	client, prefix := regionRedis(event)
+	key := prefix + statusPrefix + eventID
+	fields["updated_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	pipe := client.Pipeline()
+	pipe.HSet(ctx, key, fields)
+	pipe.Expire(ctx, key, statusTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record status of %s: %v", eventID, err)
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	eventID := r.URL.Query().Get("event_id")
+	if eventID == "" {
+		http.Error(w, "event_id is required", http.StatusBadRequest)
+		return
+	}
+
+	client, prefix := regionRedis(map[string]interface{}{"residency_region": r.URL.Query().Get("region")})
+	fields, err := client.HGetAll(ctx, prefix+statusPrefix+eventID).Result()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(fields) == 0 {
+		http.Error(w, "Unknown event_id", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{"event_id": eventID}
+	for k, v := range fields {
+		response[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// statusProduced marks a produced batch, including coalesced members, as
+// produced
+func statusProduced(batch []map[string]interface{}) {
+	producedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	done := make(map[string]bool)
+	for _, event := range batch {
+		// Exploded children report under their parent
+		eventID := eventString(event, "event_id")
+		if parentID := eventString(event, "parent_event_id"); parentID != "" {
+			eventID = parentID
+		}
+		if done[eventID] {
+			continue
+		}
+		done[eventID] = true
+		recordStatus(event, eventID, map[string]interface{}{"status": "produced", "produced_at": producedAt})
+		if memberIDs, ok := event["coalesced_event_ids"].([]string); ok {
+			for _, id := range memberIDs {
+				if id != eventID {
+					recordStatus(event, id, map[string]interface{}{
+						"status":         "produced",
+						"produced_at":    producedAt,
+						"coalesced_into": eventID,
+					})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Tenants map API keys (X-API-Key) to the teams sharing the pipeline, for
+// usage metering and quotas. Requests without a known key are attributed to
+// the default tenant.
+
+var (
+	tenants       map[string]*tenant // API key -> tenant
+	tenantsByID   map[string]*tenant
+	defaultTenant *tenant
+)
+
+// tenantConfig is loaded from TENANTS_FILE
+type tenantConfig struct {
+	DefaultTenant string    `json:"default_tenant"` // default "unassigned"
+	Tenants       []*tenant `json:"tenants"`
+}
+
+type tenant struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	APIKeys []string     `json:"api_keys"`
+	Quotas  tenantQuotas `json:"quotas"`
+	Policy  string       `json:"policy"`  // "soft" (warn only, default) or "hard" (block)
+	WarnAt  float64      `json:"warn_at"` // share of a quota that triggers warnings, default 0.8
+	Region  string       `json:"region"`  // residency region the tenant's events are pinned to
+}
+
+// tenantQuotas are limits per UTC day and calendar month; 0 = unlimited
+type tenantQuotas struct {
+	DailyEvents   int64 `json:"daily_events"`
+	MonthlyEvents int64 `json:"monthly_events"`
+	DailyBytes    int64 `json:"daily_bytes"`
+	MonthlyBytes  int64 `json:"monthly_bytes"`
+}
+
+func initTenants() {
+	path := getEnv("TENANTS_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var cfg tenantConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		log.Fatalf("Failed to load tenants from %s: %v", path, err)
+	}
+
+	tenants = make(map[string]*tenant)
+	tenantsByID = make(map[string]*tenant)
+	for _, t := range cfg.Tenants {
+		if t.ID == "" || strings.ContainsAny(t.ID, "|:") {
+			log.Fatalf("Invalid tenant id %q", t.ID)
+		}
+		if t.Policy == "" {
+			t.Policy = "soft"
+		}
+		if t.Policy != "soft" && t.Policy != "hard" {
+			log.Fatalf("Tenant %s: unknown quota policy %q", t.ID, t.Policy)
+		}
+		if t.WarnAt <= 0 {
+			t.WarnAt = 0.8
+		}
+		for _, key := range t.APIKeys {
+			if other, ok := tenants[key]; ok {
+				log.Fatalf("API key assigned to both %s and %s", other.ID, t.ID)
+			}
+			tenants[key] = t
+		}
+		tenantsByID[t.ID] = t
+	}
+
+	if cfg.DefaultTenant == "" {
+		cfg.DefaultTenant = "unassigned"
+	}
+	if defaultTenant = tenantsByID[cfg.DefaultTenant]; defaultTenant == nil {
+		defaultTenant = &tenant{ID: cfg.DefaultTenant, Policy: "soft", WarnAt: 0.8}
+		tenantsByID[defaultTenant.ID] = defaultTenant
+	}
+	if canaryUsers != nil && tenants[canaryAPIKey] == nil {
+		log.Printf("CANARY_API_KEY matches no tenant, canary probes are metered as %s", defaultTenant.ID)
+	}
+	log.Printf("Loaded %d tenants", len(cfg.Tenants))
+}
+
+// resolveTenant returns the tenant owning the request's API key
+func resolveTenant(r *http.Request) *tenant {
+	if t, ok := tenants[r.Header.Get("X-API-Key")]; ok {
+		return t
+	}
+	return defaultTenant
+}
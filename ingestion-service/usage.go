@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"ingestion-service/usage"
+)
+
+// Usage metering counts accepted, rejected and duplicate events and request
+// bytes per tenant and event_type in Redis (usage:<YYYY-MM-DD>), rolls the
+// daily totals up into the usage_rollups table, and enforces each tenant's
+// daily and monthly quotas.
+
+const (
+	usagePrefix = "usage:"
+	quotaPrefix = "quota:"
+	usageTTL    = 40 * 24 * time.Hour
+)
+
+var (
+	usageDB *sql.DB
+
+	usageEventsTotal   = newCounterVec("usage_events_total", "Events by tenant and outcome", "tenant", "outcome")
+	usageBytesTotal    = newCounterVec("usage_bytes_total", "Request bytes by tenant", "tenant")
+	quotaWarningsTotal = newCounterVec("quota_warnings_total", "Requests past a quota's warning level", "tenant", "quota")
+	quotaBlockedTotal  = newCounterVec("quota_blocked_total", "Requests rejected by a hard quota", "tenant", "quota")
+)
+
+// Quota names in the order quotaScript checks them
+var quotaNames = [4]string{"daily_events", "daily_bytes", "monthly_events", "monthly_bytes"}
+
+// Adds one request to the daily (KEYS[1]) and monthly (KEYS[2]) counters
+// unless, with ARGV[3] = 1, that takes one past its limit (ARGV[4..7], 0 =
+// none), so concurrent requests cannot overrun a hard quota. ARGV[1] is the
+// request bytes and ARGV[2] the TTL. Returns the 1-based index of the
+// exceeded quota, or 0, followed by the usage including this request.
+var quotaScript = redis.NewScript(`
+local used = {}
+for i = 1, 2 do
+	local v = redis.call('HMGET', KEYS[i], 'events', 'bytes')
+	used[2*i-1] = tonumber(v[1] or '0') + 1
+	used[2*i] = tonumber(v[2] or '0') + tonumber(ARGV[1])
+end
+if ARGV[3] == '1' then
+	for i = 1, 4 do
+		local limit = tonumber(ARGV[3+i])
+		if limit > 0 and used[i] > limit then
+			return {i, used[1], used[2], used[3], used[4]}
+		end
+	end
+end
+for i = 1, 2 do
+	redis.call('HINCRBY', KEYS[i], 'events', 1)
+	redis.call('HINCRBY', KEYS[i], 'bytes', ARGV[1])
+	redis.call('EXPIRE', KEYS[i], ARGV[2])
+end
+return {0, used[1], used[2], used[3], used[4]}
+`)
+
+func initUsage() {
+	if tenants == nil {
+		return
+	}
+	if dsn := getEnv("POSTGRES_DSN", ""); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("Invalid POSTGRES_DSN: %v", err)
+		}
+		db.SetMaxOpenConns(2)
+		usageDB = db
+	}
+	log.Println("Usage metering enabled")
+}
+
+// countingReader counts the request bytes read by the JSON decoder
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func usageOutcome(status int) string {
+	switch {
+	case status == http.StatusAccepted:
+		return "accepted"
+	case status == http.StatusOK:
+		return "duplicates"
+	default:
+		return "rejected"
+	}
+}
+
+func usageField(t *tenant, eventType, metric string) string {
+	if eventType == "" {
+		eventType = "unknown"
+	}
+	return t.ID + "|" + strings.ReplaceAll(eventType, "|", "_") + "|" + metric
+}
+
+// meterUsage records the outcome of one request. A request checkQuota
+// reserved quota for is taken back off the quota counters unless it was
+// accepted; other accepted requests are added to them here.
+func meterUsage(t *tenant, eventType string, bytes int64, status int, reserved bool) {
+	now := time.Now().UTC()
+	outcome := usageOutcome(status)
+	usageEventsTotal.Inc(t.ID, outcome)
+	usageBytesTotal.Add(float64(bytes), t.ID)
+
+	key := usagePrefix + now.Format(usage.DayFormat)
+	pipe := redisClient.Pipeline()
+	pipe.HIncrBy(ctx, key, usageField(t, eventType, outcome), 1)
+	pipe.HIncrBy(ctx, key, usageField(t, eventType, "bytes"), bytes)
+	pipe.Expire(ctx, key, usageTTL)
+	if sign := quotaAdjustment(outcome == "accepted", reserved); sign != 0 {
+		for _, quotaKey := range quotaKeys(t, now) {
+			pipe.HIncrBy(ctx, quotaKey, "events", sign)
+			pipe.HIncrBy(ctx, quotaKey, "bytes", sign*bytes)
+			pipe.Expire(ctx, quotaKey, usageTTL)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Usage metering failed: %v", err)
+	}
+}
+
+// quotaAdjustment is what meterUsage adds to the quota counters: nothing
+// when checkQuota's reservation stands, -1 to take back a reservation for a
+// request that was refused later, +1 for an accepted request without one
+func quotaAdjustment(accepted, reserved bool) int64 {
+	switch {
+	case accepted && !reserved:
+		return 1
+	case !accepted && reserved:
+		return -1
+	}
+	return 0
+}
+
+// quotaKeys returns the daily and monthly counters of a tenant, in one hash
+// slot for quotaScript
+func quotaKeys(t *tenant, now time.Time) [2]string {
+	id := redisConfig.Tag(t.ID)
+	return [2]string{
+		quotaPrefix + id + ":" + now.Format("20060102"),
+		quotaPrefix + id + ":" + now.Format("200601"),
+	}
+}
+
+// checkQuota compares a tenant's usage, including this request, with its
+// quotas and reserves the request against them in the same step. It returns
+// a warning for soft limits, the exceeded quota name when a hard policy
+// blocks the request, and whether quota was reserved.
+func checkQuota(t *tenant, bytes int64) (warning, blocked string, reserved bool, err error) {
+	q := t.Quotas
+	if q == (tenantQuotas{}) {
+		return "", "", false, nil
+	}
+	keys := quotaKeys(t, time.Now().UTC())
+	limits := [4]int64{q.DailyEvents, q.DailyBytes, q.MonthlyEvents, q.MonthlyBytes}
+	hard := 0
+	if t.Policy == "hard" {
+		hard = 1
+	}
+
+	result, err := quotaScript.Run(ctx, redisClient, keys[:], bytes, int64(usageTTL.Seconds()), hard,
+		limits[0], limits[1], limits[2], limits[3]).Int64Slice()
+	if err != nil {
+		return "", "", false, err
+	}
+	if i := result[0]; i > 0 {
+		quotaBlockedTotal.Inc(t.ID, quotaNames[i-1])
+		return "", quotaNames[i-1], false, nil
+	}
+
+	var warnings []string
+	for i, name := range quotaNames {
+		used, limit := result[i+1], limits[i]
+		if limit > 0 && float64(used) >= t.WarnAt*float64(limit) {
+			quotaWarningsTotal.Inc(t.ID, name)
+			warnings = append(warnings, fmt.Sprintf("%s %d/%d", name, used, limit))
+		}
+	}
+	return strings.Join(warnings, ", "), "", true, nil
+}
+
+// quotaResetSeconds is how long until a quota's period ends
+func quotaResetSeconds(quota string) int {
+	now := time.Now().UTC()
+	var reset time.Time
+	if strings.HasPrefix(quota, "monthly") {
+		reset = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	} else {
+		reset = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return int(reset.Sub(now).Seconds()) + 1
+}
+
+// usageRows reads one day's counters from Redis
+func usageRows(day time.Time) ([]usage.Row, error) {
+	fields, err := redisClient.HGetAll(ctx, usagePrefix+day.Format(usage.DayFormat)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[[2]string]*usage.Row)
+	for field, value := range fields {
+		parts := strings.SplitN(field, "|", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		key := [2]string{parts[0], parts[1]}
+		row, ok := byKey[key]
+		if !ok {
+			row = &usage.Row{Period: day.Format(usage.DayFormat), Tenant: parts[0], EventType: parts[1]}
+			byKey[key] = row
+		}
+		switch parts[2] {
+		case "accepted":
+			row.Accepted = n
+		case "rejected":
+			row.Rejected = n
+		case "duplicates":
+			row.Duplicates = n
+		case "bytes":
+			row.Bytes = n
+		}
+	}
+
+	rows := make([]usage.Row, 0, len(byKey))
+	for _, row := range byKey {
+		rows = append(rows, *row)
+	}
+	usage.Sort(rows)
+	return rows, nil
+}
+
+// usageRollupLoop persists today's and yesterday's totals
+func usageRollupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		today := now.UTC().Truncate(24 * time.Hour)
+		for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+			rows, err := usageRows(day)
+			if err != nil {
+				log.Printf("Usage rollup failed: %v", err)
+				continue
+			}
+			for _, r := range rows {
+				if _, err := usageDB.ExecContext(ctx, usage.UpsertSQL,
+					r.Period, r.Tenant, r.EventType, r.Accepted, r.Rejected, r.Duplicates, r.Bytes); err != nil {
+					log.Printf("Usage rollup failed: %v", err)
+					break
+				}
+			}
+		}
+	}
+}
+
+// usageReportHandler exports the calling tenant's usage as CSV, for the
+// tenant named by X-API-Key only:
+// /usage/report?from=2026-01-01&to=2026-01-31&period=month
+func usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	if tenants == nil {
+		http.Error(w, "Usage metering is not enabled", http.StatusNotFound)
+		return
+	}
+	caller, ok := tenants[r.Header.Get("X-API-Key")]
+	if !ok {
+		http.Error(w, "A tenant X-API-Key is required", http.StatusUnauthorized)
+		return
+	}
+	if tenantID := r.URL.Query().Get("tenant"); tenantID != "" && tenantID != caller.ID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	writeUsageReport(w, r, caller.ID)
+}
+
+// adminUsageReportHandler exports usage of every tenant, or of tenant, for
+// chargeback:
+// /admin/api/usage/report?from=2026-01-01&to=2026-01-31&tenant=growth&period=month
+func adminUsageReportHandler(w http.ResponseWriter, r *http.Request) {
+	if tenants == nil {
+		http.Error(w, "Usage metering is not enabled", http.StatusNotFound)
+		return
+	}
+	writeUsageReport(w, r, r.URL.Query().Get("tenant"))
+}
+
+// writeUsageReport writes the CSV report of tenantID, or of every tenant
+func writeUsageReport(w http.ResponseWriter, r *http.Request, tenantID string) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to := today.AddDate(0, 0, -today.Day()+1), today
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(usage.DayFormat, v); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(usage.DayFormat, v); err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+	monthly := r.URL.Query().Get("period") == "month"
+
+	var rows []usage.Row
+	if usageDB != nil {
+		rows, err = usage.Query(ctx, usageDB, from, to, tenantID, monthly)
+	} else {
+		// Without Postgres, report from the Redis counters (last 40 days)
+		if to.Sub(from) > usageTTL {
+			http.Error(w, "Range exceeds Redis retention", http.StatusBadRequest)
+			return
+		}
+		for day := from; !day.After(to) && err == nil; day = day.AddDate(0, 0, 1) {
+			var dayRows []usage.Row
+			dayRows, err = usageRows(day)
+			for _, row := range dayRows {
+				if tenantID == "" || row.Tenant == tenantID {
+					rows = append(rows, row)
+				}
+			}
+		}
+		if monthly {
+			rows = usage.Merge(rows)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv",
+		from.Format(usage.DayFormat), to.Format(usage.DayFormat)))
+	usage.WriteCSV(w, rows)
+}
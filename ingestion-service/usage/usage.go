@@ -0,0 +1,126 @@
+// Package usage holds the per-tenant usage rollups shared by the ingestion
+// service, which meters events into Redis and persists daily rollups to the
+// usage_rollups table, and the usage-report command, which exports them.
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DayFormat is the layout of usage days in keys and reports
+const DayFormat = "2006-01-02"
+
+// Row is one tenant's usage of one event type over a day or month
+type Row struct {
+	Period     string // YYYY-MM-DD or YYYY-MM
+	Tenant     string
+	EventType  string
+	Accepted   int64
+	Rejected   int64
+	Duplicates int64
+	Bytes      int64
+}
+
+// UpsertSQL stores absolute daily totals; GREATEST keeps a replica with an
+// older view from moving a total backwards
+const UpsertSQL = `
+INSERT INTO usage_rollups (day, tenant, event_type, accepted, rejected, duplicates, bytes, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+ON CONFLICT (day, tenant, event_type) DO UPDATE SET
+    accepted   = GREATEST(usage_rollups.accepted, EXCLUDED.accepted),
+    rejected   = GREATEST(usage_rollups.rejected, EXCLUDED.rejected),
+    duplicates = GREATEST(usage_rollups.duplicates, EXCLUDED.duplicates),
+    bytes      = GREATEST(usage_rollups.bytes, EXCLUDED.bytes),
+    updated_at = NOW()`
+
+// Query reads rollups between two days inclusive, optionally for a single
+// tenant, grouped by day or by month
+func Query(ctx context.Context, db *sql.DB, from, to time.Time, tenant string, monthly bool) ([]Row, error) {
+	period := "to_char(day, 'YYYY-MM-DD')"
+	if monthly {
+		period = "to_char(day, 'YYYY-MM')"
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+period+` AS period, tenant, event_type,
+		       SUM(accepted), SUM(rejected), SUM(duplicates), SUM(bytes)
+		FROM usage_rollups
+		WHERE day >= $1 AND day <= $2 AND ($3 = '' OR tenant = $3)
+		GROUP BY 1, 2, 3
+		ORDER BY 1, 2, 3`,
+		from.Format(DayFormat), to.Format(DayFormat), tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Period, &r.Tenant, &r.EventType, &r.Accepted, &r.Rejected, &r.Duplicates, &r.Bytes); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Merge folds daily rows into monthly ones
+func Merge(rows []Row) []Row {
+	merged := make(map[[3]string]*Row)
+	for _, r := range rows {
+		r.Period = r.Period[:7]
+		key := [3]string{r.Period, r.Tenant, r.EventType}
+		if m, ok := merged[key]; ok {
+			m.Accepted += r.Accepted
+			m.Rejected += r.Rejected
+			m.Duplicates += r.Duplicates
+			m.Bytes += r.Bytes
+		} else {
+			row := r
+			merged[key] = &row
+		}
+	}
+	out := make([]Row, 0, len(merged))
+	for _, r := range merged {
+		out = append(out, *r)
+	}
+	Sort(out)
+	return out
+}
+
+// Sort orders rows by period, tenant and event type
+func Sort(rows []Row) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.EventType < b.EventType
+	})
+}
+
+// WriteCSV writes rows with a header line
+func WriteCSV(w io.Writer, rows []Row) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"period", "tenant", "event_type", "accepted", "rejected", "duplicates", "bytes"})
+	for _, r := range rows {
+		out.Write([]string{
+			r.Period, r.Tenant, r.EventType,
+			strconv.FormatInt(r.Accepted, 10),
+			strconv.FormatInt(r.Rejected, 10),
+			strconv.FormatInt(r.Duplicates, 10),
+			strconv.FormatInt(r.Bytes, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
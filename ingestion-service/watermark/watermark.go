@@ -0,0 +1,232 @@
+// Package watermark defines the heartbeat/watermark control messages the
+// ingestion service writes to every raw-events partition, and a Tracker that
+// consumers use to follow event-time progress per partition.
+//
+// Control messages carry the x-control: watermark header and a JSON body
+// with "type": "watermark", so consumers that only parse the body can skip
+// them too. Each ingestion replica emits its own watermark; a partition's
+// watermark is the minimum over the replicas that are still heartbeating.
+package watermark
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// HeaderKey marks control messages on data topics
+	HeaderKey = "x-control"
+	// HeaderValue identifies heartbeat/watermark control messages
+	HeaderValue = "watermark"
+	// MessageType is the "type" field of the control message body
+	MessageType = "watermark"
+)
+
+// ErrNotWatermark is returned by Decode for ordinary data messages
+var ErrNotWatermark = errors.New("not a watermark message")
+
+// Message is the body of a heartbeat/watermark control message
+type Message struct {
+	Type      string    `json:"type"`
+	Producer  string    `json:"producer"`
+	Partition int       `json:"partition"`
+	Watermark time.Time `json:"watermark"`
+	EmittedAt time.Time `json:"emitted_at"`
+}
+
+// IsControl reports whether a Kafka message is a watermark control message
+func IsControl(msg kafka.Message) bool {
+	for _, h := range msg.Headers {
+		if h.Key == HeaderKey && string(h.Value) == HeaderValue {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode builds the Kafka message for a watermark
+func Encode(m Message) (kafka.Message, error) {
+	m.Type = MessageType
+	value, err := json.Marshal(m)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Key:     []byte("__watermark:" + m.Producer),
+		Value:   value,
+		Headers: []kafka.Header{{Key: HeaderKey, Value: []byte(HeaderValue)}},
+	}, nil
+}
+
+// Decode parses a watermark control message
+func Decode(msg kafka.Message) (Message, error) {
+	if !IsControl(msg) {
+		return Message{}, ErrNotWatermark
+	}
+	var m Message
+	if err := json.Unmarshal(msg.Value, &m); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// State describes a partition from the consumer's point of view
+type State string
+
+const (
+	// Active partitions delivered data recently
+	Active State = "active"
+	// Idle partitions are heartbeating but carry no data
+	Idle State = "idle"
+	// Stalled partitions have stopped heartbeating; the pipeline may be down
+	Stalled State = "stalled"
+	// Unknown partitions have not been seen yet
+	Unknown State = "unknown"
+)
+
+type producerState struct {
+	watermark time.Time
+	lastSeen  time.Time
+}
+
+type partitionState struct {
+	producers     map[string]*producerState
+	lastHeartbeat time.Time
+	lastData      time.Time
+}
+
+// Tracker follows watermarks per partition. It is safe for concurrent use.
+type Tracker struct {
+	mu sync.Mutex
+	// Producers silent for longer than this no longer hold watermarks back
+	producerTimeout time.Duration
+	partitions      map[int]*partitionState
+	now             func() time.Time
+}
+
+// NewTracker creates a tracker. producerTimeout should be several heartbeat
+// intervals so a restarting replica does not advance watermarks early.
+func NewTracker(producerTimeout time.Duration) *Tracker {
+	return &Tracker{
+		producerTimeout: producerTimeout,
+		partitions:      make(map[int]*partitionState),
+		now:             time.Now,
+	}
+}
+
+func (t *Tracker) partition(p int) *partitionState {
+	ps, ok := t.partitions[p]
+	if !ok {
+		ps = &partitionState{producers: make(map[string]*producerState)}
+		t.partitions[p] = ps
+	}
+	return ps
+}
+
+// Observe records a consumed message and reports whether it was a control
+// message that the caller should not treat as data
+func (t *Tracker) Observe(msg kafka.Message) bool {
+	now := t.now()
+	m, err := Decode(msg)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps := t.partition(msg.Partition)
+	if err != nil {
+		if err != ErrNotWatermark {
+			// Malformed control message: still a control message
+			return true
+		}
+		ps.lastData = now
+		return false
+	}
+
+	ps.lastHeartbeat = now
+	prod, ok := ps.producers[m.Producer]
+	if !ok {
+		prod = &producerState{}
+		ps.producers[m.Producer] = prod
+	}
+	// Watermarks never move backwards, even if messages are reordered
+	if m.Watermark.After(prod.watermark) {
+		prod.watermark = m.Watermark
+	}
+	prod.lastSeen = now
+	return true
+}
+
+// Watermark returns the low watermark for a partition: no live producer will
+// write data with an event time before it
+func (t *Tracker) Watermark(partition int) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.watermarkLocked(partition, t.now())
+}
+
+func (t *Tracker) watermarkLocked(partition int, now time.Time) (time.Time, bool) {
+	ps, ok := t.partitions[partition]
+	if !ok {
+		return time.Time{}, false
+	}
+	var low time.Time
+	found := false
+	for _, prod := range ps.producers {
+		if now.Sub(prod.lastSeen) > t.producerTimeout {
+			continue
+		}
+		if !found || prod.watermark.Before(low) {
+			low = prod.watermark
+			found = true
+		}
+	}
+	return low, found
+}
+
+// Min returns the lowest watermark across all known partitions, which is
+// where windows spanning partitions may be closed
+func (t *Tracker) Min() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var low time.Time
+	found := false
+	for p := range t.partitions {
+		wm, ok := t.watermarkLocked(p, now)
+		if !ok {
+			// A partition with no live producer blocks closing windows
+			return time.Time{}, false
+		}
+		if !found || wm.Before(low) {
+			low = wm
+			found = true
+		}
+	}
+	return low, found
+}
+
+// State classifies a partition: data within activeWithin is active,
+// heartbeats within stallAfter without data is idle, otherwise stalled
+func (t *Tracker) State(partition int, activeWithin, stallAfter time.Duration) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps, ok := t.partitions[partition]
+	if !ok {
+		return Unknown
+	}
+	now := t.now()
+	switch {
+	case !ps.lastData.IsZero() && now.Sub(ps.lastData) <= activeWithin:
+		return Active
+	case !ps.lastHeartbeat.IsZero() && now.Sub(ps.lastHeartbeat) <= stallAfter:
+		return Idle
+	default:
+		return Stalled
+	}
+}
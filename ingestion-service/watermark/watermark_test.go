@@ -0,0 +1,124 @@
+package watermark
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var start = time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+
+// fakeClock is the tracker's now, moved by the test
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestTracker(timeout time.Duration) (*Tracker, *fakeClock) {
+	clock := &fakeClock{t: start}
+	tracker := NewTracker(timeout)
+	tracker.now = clock.now
+	return tracker, clock
+}
+
+func heartbeat(t *testing.T, producer string, partition int, wm time.Time) kafka.Message {
+	t.Helper()
+	msg, err := Encode(Message{Producer: producer, Partition: partition, Watermark: wm, EmittedAt: start})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	msg.Partition = partition
+	return msg
+}
+
+func wantWatermark(t *testing.T, tracker *Tracker, partition int, want time.Time) {
+	t.Helper()
+	got, ok := tracker.Watermark(partition)
+	if !ok || !got.Equal(want) {
+		t.Errorf("Watermark(%d) = %s, %v; want %s", partition, got, ok, want)
+	}
+}
+
+func TestWatermarkAdvances(t *testing.T) {
+	tracker, clock := newTestTracker(time.Minute)
+	if _, ok := tracker.Watermark(0); ok {
+		t.Error("unseen partition has a watermark")
+	}
+
+	for i := 0; i < 3; i++ {
+		wm := start.Add(time.Duration(i) * 5 * time.Second)
+		if !tracker.Observe(heartbeat(t, "a", 0, wm)) {
+			t.Fatal("heartbeat not reported as a control message")
+		}
+		wantWatermark(t, tracker, 0, wm)
+		clock.advance(5 * time.Second)
+	}
+
+	// A reordered older heartbeat does not move it back
+	tracker.Observe(heartbeat(t, "a", 0, start))
+	wantWatermark(t, tracker, 0, start.Add(10*time.Second))
+}
+
+func TestWatermarkSlowestProducer(t *testing.T) {
+	tracker, clock := newTestTracker(time.Minute)
+	tracker.Observe(heartbeat(t, "a", 0, start.Add(30*time.Second)))
+	tracker.Observe(heartbeat(t, "b", 0, start.Add(10*time.Second)))
+	wantWatermark(t, tracker, 0, start.Add(10*time.Second))
+
+	// Once b stops heartbeating it no longer holds the partition back
+	clock.advance(45 * time.Second)
+	tracker.Observe(heartbeat(t, "a", 0, start.Add(40*time.Second)))
+	wantWatermark(t, tracker, 0, start.Add(10*time.Second))
+	clock.advance(30 * time.Second)
+	wantWatermark(t, tracker, 0, start.Add(40*time.Second))
+
+	// With no live producer left there is no watermark
+	clock.advance(time.Minute)
+	if wm, ok := tracker.Watermark(0); ok {
+		t.Errorf("Watermark = %s after every producer timed out", wm)
+	}
+}
+
+func TestMin(t *testing.T) {
+	tracker, clock := newTestTracker(time.Minute)
+	tracker.Observe(heartbeat(t, "a", 0, start.Add(20*time.Second)))
+	tracker.Observe(heartbeat(t, "a", 1, start.Add(5*time.Second)))
+	if wm, ok := tracker.Min(); !ok || !wm.Equal(start.Add(5*time.Second)) {
+		t.Errorf("Min = %s, %v; want %s", wm, ok, start.Add(5*time.Second))
+	}
+
+	// A partition whose producers all stopped blocks closing windows
+	clock.advance(50 * time.Second)
+	tracker.Observe(heartbeat(t, "a", 0, start.Add(60*time.Second)))
+	clock.advance(20 * time.Second)
+	if wm, ok := tracker.Min(); ok {
+		t.Errorf("Min = %s with a stalled partition", wm)
+	}
+}
+
+func TestState(t *testing.T) {
+	tracker, clock := newTestTracker(time.Minute)
+	if s := tracker.State(0, 10*time.Second, 30*time.Second); s != Unknown {
+		t.Errorf("State = %s, want %s", s, Unknown)
+	}
+
+	if tracker.Observe(kafka.Message{Partition: 0, Value: []byte(`{"event_id":"e1"}`)}) {
+		t.Error("data message reported as a control message")
+	}
+	tracker.Observe(heartbeat(t, "a", 0, start))
+	if s := tracker.State(0, 10*time.Second, 30*time.Second); s != Active {
+		t.Errorf("State = %s, want %s", s, Active)
+	}
+
+	clock.advance(20 * time.Second)
+	tracker.Observe(heartbeat(t, "a", 0, start.Add(20*time.Second)))
+	if s := tracker.State(0, 10*time.Second, 30*time.Second); s != Idle {
+		t.Errorf("State = %s, want %s", s, Idle)
+	}
+
+	clock.advance(time.Minute)
+	if s := tracker.State(0, 10*time.Second, 30*time.Second); s != Stalled {
+		t.Errorf("State = %s, want %s", s, Stalled)
+	}
+}
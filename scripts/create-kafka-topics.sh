@@ -6,7 +6,7 @@ set -euo pipefail
 # Create the standard topics for the ML feature pipeline
 # Run from the repository root: chmod +x scripts/create-kafka-topics.sh && ./scripts/create-kafka-topics.sh
 
-topics=(raw-events processed-events feature-events dead-letter-queue)
+topics=(raw-events raw-events-eu raw-events-quarantine raw-events-replay processed-events feature-events dead-letter-queue patterns anomalies)
 for t in "${topics[@]}"; do
   echo "Creating topic: $t"
   docker compose exec kafka kafka-topics.sh --create --topic "$t" \
@@ -68,6 +68,25 @@ CREATE TABLE IF NOT EXISTS drift_alerts (
 -- Create index for drift alerts
 CREATE INDEX IF NOT EXISTS idx_drift_alerts_feature ON drift_alerts(feature_name, detected_at DESC);
 
+-- Create usage rollups table for per-tenant metering and chargeback
+CREATE TABLE IF NOT EXISTS usage_rollups (
+    day DATE NOT NULL,
+    tenant VARCHAR(100) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    accepted BIGINT NOT NULL DEFAULT 0,
+    rejected BIGINT NOT NULL DEFAULT 0,
+    duplicates BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (day, tenant, event_type)
+);
+
+-- Convert to hypertable for time-series optimization
+SELECT create_hypertable('usage_rollups', 'day', if_not_exists => TRUE);
+
+-- Create index for per-tenant reports
+CREATE INDEX IF NOT EXISTS idx_usage_rollups_tenant ON usage_rollups(tenant, day DESC);
+
 -- Create view for latest features per user
 CREATE OR REPLACE VIEW latest_features AS
 SELECT DISTINCT ON (user_id, feature_name)